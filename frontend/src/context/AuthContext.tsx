@@ -106,9 +106,11 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
         });
         if (!data.ID) setUser(undefined);
       } catch (e) {
+        // Another tab refreshed at the same time, the new cookies are already set
+        if (e === "Token already refreshed") return;
         setUser(undefined);
       }
-      //Refresh token every 90 seconds. Token expires after 120 seconds.
+      //Refresh token every 90 seconds. Access token expires after 5 minutes.
     }, 90000);
     return () => {
       clearInterval(i);
@@ -3,22 +3,30 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/web-stuff-98/go-social-media/pkg/attachmentserver"
+	"github.com/web-stuff-98/go-social-media/pkg/config"
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/changestreams"
-	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/deletion"
+	"github.com/web-stuff-98/go-social-media/pkg/exporter"
 	"github.com/web-stuff-98/go-social-media/pkg/handlers"
 	"github.com/web-stuff-98/go-social-media/pkg/handlers/middleware"
+	"github.com/web-stuff-98/go-social-media/pkg/health"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/metrics"
+	"github.com/web-stuff-98/go-social-media/pkg/notifier"
+	"github.com/web-stuff-98/go-social-media/pkg/passwords"
 	rdb "github.com/web-stuff-98/go-social-media/pkg/redis"
+	"github.com/web-stuff-98/go-social-media/pkg/sandbox"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -30,9 +38,15 @@ import (
 
 	https://github.com/gorilla/mux#serving-single-page-applications
 
-	Rate limiting stuff maybe should not be route specific
+	Rate limits are set per route name, see the config package
 */
 
+// How long in flight requests, queued socket messages and pending uploads get to finish when the
+// server is stopped. Heroku kills the process 30 seconds after sending SIGTERM.
+const shutdownTimeout = time.Second * 25
+
+var log = logger.New("main")
+
 type spaHandler struct {
 	staticPath string
 	indexPath  string
@@ -57,330 +71,174 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	protectedUids := make(map[primitive.ObjectID]struct{})
-	protectedPids := make(map[primitive.ObjectID]struct{})
-	protectedRids := make(map[primitive.ObjectID]struct{})
-
 	if err := godotenv.Load(); err != nil {
-		log.Fatal("DOTENV ERROR : ", err)
+		log.Fatal("Failed to load .env", err, nil)
+	}
+	Config, err := config.Load()
+	if err != nil {
+		log.Fatal("Failed to load config", err, nil)
+	}
+	helpers.Init(Config)
+	if err := passwords.Init(Config.Passwords); err != nil {
+		log.Fatal("Failed to set up passwords", err, nil)
+	}
+
+	// Cancelled on SIGTERM or an interrupt, which stops everything running in the background
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	DB, Collections := db.Init(ctx, Config.MongoDB.URI, Config.MongoDB.DB)
+
+	if len(os.Args) > 1 && os.Args[1] == "sandbox" {
+		if err := sandbox.RunCommand(context.Background(), Collections, Config.Sandbox, os.Args[2:]); err != nil {
+			log.Fatal("Sandbox command failed", err, logger.Fields{"args": os.Args[2:]})
+		}
+		return
+	}
+	Protected, err := sandbox.Load(context.Background(), Collections, Config.Sandbox)
+	if err != nil {
+		log.Fatal("Failed to load protected entities", err, nil)
+	}
+
+	SocketServer, err := socketserver.Init(ctx, Collections)
+	if err != nil {
+		log.Fatal("Failed to set up socket server", err, nil)
+	}
+	AttachmentServer, err := attachmentserver.Init(ctx, Collections, SocketServer)
+	if err != nil {
+		log.Fatal("Failed to set up attachment server", err, nil)
 	}
-	DB, Collections := db.Init()
-	SocketServer, err := socketserver.Init(Collections)
+	Exporter, err := exporter.Init(ctx, Collections, SocketServer, Config.DataExports)
 	if err != nil {
-		log.Fatal("Failed to set up socket server ", err)
+		log.Fatal("Failed to set up data exporter", err, nil)
 	}
-	AttachmentServer, err := attachmentserver.Init(Collections, SocketServer)
+
+	TrustedProxies, err := middleware.ParseTrustedProxies(Config.TrustedProxies)
 	if err != nil {
-		log.Fatal("Failed to set up attachment server ", err)
+		log.Fatal("Invalid trusted proxies", err, nil)
 	}
 
 	router := mux.NewRouter()
-	redisClient := rdb.Init()
+	redisClient := rdb.Init(Config.Redis.URL)
 
-	h := handlers.New(DB, redisClient, Collections, SocketServer, AttachmentServer, &handlers.ProtectedIDs{
-		Uids: protectedUids,
-		Pids: protectedPids,
-		Rids: protectedRids,
-	})
+	DeletionPolicy := sandbox.DeletionPolicy(Config.Sandbox, deletion.NewPolicy(Config.Deletion), Protected)
 
-	var origins []string
-	if os.Getenv("PRODUCTION") == "true" {
-		origins = []string{"https://go-social-media-js.herokuapp.com"}
-	} else {
-		origins = []string{"http://localhost:3000", "http://localhost:8080"}
-	}
+	h := handlers.New(DB, redisClient, Collections, SocketServer, AttachmentServer, Exporter, DeletionPolicy, &handlers.ProtectedIDs{
+		Uids: Protected.Uids,
+		Pids: Protected.Pids,
+		Rids: Protected.Rids,
+	}, Config.Uploads)
 
 	c := cors.New(cors.Options{
-		AllowedOrigins:   origins,
+		AllowedOrigins:   Config.CORSOrigins,
 		AllowedMethods:   []string{"GET", "HEAD", "POST", "PATCH", "DELETE"},
 		AllowCredentials: true,
 	})
 
+	// Wraps a route in the rate limiter, using the limit configured for the route name
+	limit := func(next http.HandlerFunc, route string) http.HandlerFunc {
+		opts, ok := Config.RateLimit(route)
+		if !ok {
+			log.Fatal("No rate limit configured for route", nil, logger.Fields{"route": route})
+		}
+		return middleware.BasicRateLimiter(next, middleware.SimpleLimiterOpts{
+			Window:        opts.Window,
+			MaxReqs:       opts.MaxReqs,
+			BlockDuration: opts.BlockDuration,
+			Message:       opts.Message,
+			RouteName:     route,
+			Algorithm:     opts.Algorithm,
+			KeyBy:         opts.Key,
+		}, redisClient)
+	}
+
 	api := router.PathPrefix("/api/").Subrouter()
-	api.HandleFunc("/users/{id}", middleware.BasicRateLimiter(h.GetUser, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 20,
-		MaxReqs:       500,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_user",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/users/{id}/pfp", middleware.BasicRateLimiter(h.GetPfp, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 20,
-		MaxReqs:       500,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_pfp",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-
-	api.HandleFunc("/account/register", middleware.BasicRateLimiter(h.Register, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 1000,
-		MaxReqs:       3,
-		BlockDuration: time.Second * 10000,
-		Message:       "You have been creating too many accounts",
-		RouteName:     "register",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/account/login", middleware.BasicRateLimiter(h.Login, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 20,
-		MaxReqs:       5,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "login",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/account/logout", middleware.BasicRateLimiter(h.Logout, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 20,
-		MaxReqs:       5,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "logout",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/account/refresh", middleware.BasicRateLimiter(h.RefreshToken, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 20,
-		MaxReqs:       6,
-		BlockDuration: time.Second * 6000,
-		Message:       "Too many requests",
-		RouteName:     "refresh_token",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/account/delete", middleware.BasicRateLimiter(h.DeleteAccount, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 20,
-		MaxReqs:       2,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "delete_account",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/account/pfp", middleware.BasicRateLimiter(h.UploadPfp, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 500,
-		Message:       "Too many requests",
-		RouteName:     "upload_pfp",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/account/conversations", middleware.BasicRateLimiter(h.GetConversations, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 8,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_conversations",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/account/conversation/{id}", middleware.BasicRateLimiter(h.GetConversation, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 8,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_conversation",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
+	api.HandleFunc("/users/{id}", limit(h.GetUser, "get_user")).Methods(http.MethodGet)
+	api.HandleFunc("/users/{id}/pfp", limit(h.GetPfp, "get_pfp")).Methods(http.MethodGet)
 
-	api.HandleFunc("/posts/newest", middleware.BasicRateLimiter(h.GetNewestPosts, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 10,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_new_posts",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/posts/page/{page}", middleware.BasicRateLimiter(h.GetPage, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 10,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_page",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/posts/{postId}/comment", middleware.BasicRateLimiter(h.CommentOnPost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       40,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been making too many comments",
-		RouteName:     "create_comment",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/posts/{postId}/comment/{id}/delete", middleware.BasicRateLimiter(h.DeleteCommentOnPost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       40,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been deleting too many comments",
-		RouteName:     "delete_comment",
-	}, *redisClient, *Collections)).Methods(http.MethodDelete)
-	api.HandleFunc("/posts/{postId}/comment/{id}/update", middleware.BasicRateLimiter(h.UpdatePostComment, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       30,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been editing too many comments",
-		RouteName:     "update_comment",
-	}, *redisClient, *Collections)).Methods(http.MethodPatch)
-	api.HandleFunc("/posts/{slug}", middleware.BasicRateLimiter(h.GetPost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 60,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "get_post",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/posts/{slug}/delete", middleware.BasicRateLimiter(h.DeletePost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "delete_post",
-	}, *redisClient, *Collections)).Methods(http.MethodDelete)
-	api.HandleFunc("/posts/{slug}/update", middleware.BasicRateLimiter(h.UpdatePost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been editing too many posts",
-		RouteName:     "update_post",
-	}, *redisClient, *Collections)).Methods(http.MethodPatch)
-	api.HandleFunc("/posts", middleware.BasicRateLimiter(h.CreatePost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been creating too many posts",
-		RouteName:     "create_post",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/posts/{slug}/image", middleware.BasicRateLimiter(h.UploadPostImage, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 30,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 200,
-		Message:       "Too many requests",
-		RouteName:     "upload_post_image",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/posts/{id}/image", middleware.BasicRateLimiter(h.GetPostImage, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 3,
-		MaxReqs:       60,
-		BlockDuration: time.Second * 100,
-		Message:       "Too many requests",
-		RouteName:     "get_post_image",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/posts/{id}/thumb", middleware.BasicRateLimiter(h.GetPostThumb, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 3,
-		MaxReqs:       60,
-		BlockDuration: time.Second * 100,
-		Message:       "Too many requests",
-		RouteName:     "get_post_thumb",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/posts/{id}/vote", middleware.BasicRateLimiter(h.VoteOnPost, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 2,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 100,
-		Message:       "Too many requests",
-		RouteName:     "post_vote",
-	}, *redisClient, *Collections)).Methods(http.MethodPatch)
-	api.HandleFunc("/posts/{postId}/{commentId}/vote", middleware.BasicRateLimiter(h.VoteOnPostComment, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 2,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 100,
-		Message:       "Too many requests",
-		RouteName:     "post_vote_comment",
-	}, *redisClient, *Collections)).Methods(http.MethodPatch)
-
-	api.HandleFunc("/rooms", middleware.BasicRateLimiter(h.CreateRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 240,
-		MaxReqs:       3,
-		BlockDuration: time.Second * 1000,
-		Message:       "You have been creating too many rooms",
-		RouteName:     "create_room",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/page/{page}", middleware.BasicRateLimiter(h.GetRoomPage, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 10,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 1000,
-		Message:       "Too many requests",
-		RouteName:     "get_room_page",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/rooms/own", middleware.BasicRateLimiter(h.GetOwnRooms, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 10,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 1000,
-		Message:       "Too many requests",
-		RouteName:     "get_own_rooms",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/rooms/{id}", middleware.BasicRateLimiter(h.GetRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 10,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 1000,
-		Message:       "Too many requests",
-		RouteName:     "get_room",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/rooms/{id}/image", middleware.BasicRateLimiter(h.UploadRoomImage, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 30,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 200,
-		Message:       "Too many requests",
-		RouteName:     "upload_room_image",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/{id}/image", middleware.BasicRateLimiter(h.GetRoomImage, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 3,
-		MaxReqs:       60,
-		BlockDuration: time.Second * 100,
-		Message:       "Too many requests",
-		RouteName:     "get_room_image",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/rooms/{id}/update", middleware.BasicRateLimiter(h.UpdateRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been editing too many rooms",
-		RouteName:     "update_room",
-	}, *redisClient, *Collections)).Methods(http.MethodPatch)
-	api.HandleFunc("/rooms/{id}/invite", middleware.BasicRateLimiter(h.InviteToRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "You have been sending too many invitations",
-		RouteName:     "invite_room",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/{id}/ban", middleware.BasicRateLimiter(h.BanUserFromRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "ban_room",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/{id}/unban", middleware.BasicRateLimiter(h.UnBanUserFromRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "unban_room",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/{id}/invite/accept/{msgId}", middleware.BasicRateLimiter(h.AcceptRoomInvite, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "invite_room_accept",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/{id}/invite/decline/{msgId}", middleware.BasicRateLimiter(h.DeclineRoomInvite, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       10,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "invite_room_decline",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/rooms/{id}/private-data", middleware.BasicRateLimiter(h.GetRoomPrivateData, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 3,
-		MaxReqs:       60,
-		BlockDuration: time.Second * 100,
-		Message:       "Too many requests",
-		RouteName:     "get_room_private_data",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
-	api.HandleFunc("/rooms/{id}/delete", middleware.BasicRateLimiter(h.DeleteRoom, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "delete_room",
-	}, *redisClient, *Collections)).Methods(http.MethodDelete)
+	api.HandleFunc("/users/{id}/posts", limit(h.GetUserPosts, "get_user_posts")).Methods(http.MethodGet)
+	api.HandleFunc("/users/{id}/block", limit(h.BlockUser, "block_user")).Methods(http.MethodPost)
+	api.HandleFunc("/users/{id}/unblock", limit(h.UnblockUser, "unblock_user")).Methods(http.MethodPost)
+	api.HandleFunc("/account/blocked", limit(h.GetBlockedUsers, "get_blocked_users")).Methods(http.MethodGet)
+	api.HandleFunc("/account/digest-settings", limit(h.GetDigestSettings, "get_digest_settings")).Methods(http.MethodGet)
+	api.HandleFunc("/account/digest-settings", limit(h.UpdateDigestSettings, "update_digest_settings")).Methods(http.MethodPatch)
+	api.HandleFunc("/account/export", limit(h.StartDataExport, "start_data_export")).Methods(http.MethodPost)
+	api.HandleFunc("/account/export", limit(h.GetDataExport, "get_data_export")).Methods(http.MethodGet)
+	api.HandleFunc("/account/export/{id}/download", limit(h.DownloadDataExport, "download_data_export")).Methods(http.MethodGet)
+	api.HandleFunc("/account/deletion/{id}", limit(h.GetDeletionStatus, "get_deletion_status")).Methods(http.MethodGet)
+	api.HandleFunc("/account/privacy", limit(h.GetPrivacySettings, "get_privacy_settings")).Methods(http.MethodGet)
+	api.HandleFunc("/account/privacy", limit(h.UpdatePrivacySettings, "update_privacy_settings")).Methods(http.MethodPatch)
+	api.HandleFunc("/account/message-requests", limit(h.GetMessageRequests, "get_message_requests")).Methods(http.MethodGet)
+	api.HandleFunc("/account/message-requests/{uid}/accept", limit(h.AcceptMessageRequest, "accept_message_request")).Methods(http.MethodPost)
+	api.HandleFunc("/account/message-requests/{uid}/decline", limit(h.DeclineMessageRequest, "decline_message_request")).Methods(http.MethodPost)
+	api.HandleFunc("/account/notifications", limit(h.GetNotifications, "get_notifications")).Methods(http.MethodGet)
+	api.HandleFunc("/account/notifications/read", limit(h.MarkAllNotificationsRead, "mark_all_notifications_read")).Methods(http.MethodPost)
+	api.HandleFunc("/account/notifications/{id}/read", limit(h.MarkNotificationRead, "mark_notification_read")).Methods(http.MethodPost)
+	api.HandleFunc("/account/register", limit(h.Register, "register")).Methods(http.MethodPost)
+	api.HandleFunc("/account/login", limit(h.Login, "login")).Methods(http.MethodPost)
+	api.HandleFunc("/account/login/two-factor", limit(h.VerifyTwoFactorLogin, "two_factor_login")).Methods(http.MethodPost)
+	api.HandleFunc("/account/two-factor", limit(h.GetTwoFactorStatus, "get_two_factor_status")).Methods(http.MethodGet)
+	api.HandleFunc("/account/two-factor/enroll", limit(h.EnrollTwoFactor, "enroll_two_factor")).Methods(http.MethodPost)
+	api.HandleFunc("/account/two-factor/enable", limit(h.EnableTwoFactor, "enable_two_factor")).Methods(http.MethodPost)
+	api.HandleFunc("/account/two-factor/disable", limit(h.DisableTwoFactor, "disable_two_factor")).Methods(http.MethodPost)
+	api.HandleFunc("/account/logout", limit(h.Logout, "logout")).Methods(http.MethodPost)
+	api.HandleFunc("/account/refresh", limit(h.RefreshToken, "refresh_token")).Methods(http.MethodPost)
+	api.HandleFunc("/account/sessions", limit(h.GetSessions, "get_sessions")).Methods(http.MethodGet)
+	api.HandleFunc("/account/sessions/revoke-others", limit(h.RevokeOtherSessions, "revoke_other_sessions")).Methods(http.MethodDelete)
+	api.HandleFunc("/account/sessions/{id}/revoke", limit(h.RevokeSession, "revoke_session")).Methods(http.MethodDelete)
+	api.HandleFunc("/account/password", limit(h.ChangePassword, "change_password")).Methods(http.MethodPost)
+	api.HandleFunc("/account/profile", limit(h.UpdateProfile, "update_profile")).Methods(http.MethodPatch)
+	api.HandleFunc("/account/username", limit(h.ChangeUsername, "change_username")).Methods(http.MethodPost)
+	api.HandleFunc("/account/delete", limit(h.DeleteAccount, "delete_account")).Methods(http.MethodPost)
+	api.HandleFunc("/account/pfp", limit(h.UploadPfp, "upload_pfp")).Methods(http.MethodPost)
+	api.HandleFunc("/account/conversations", limit(h.GetConversations, "get_conversations")).Methods(http.MethodGet)
+	api.HandleFunc("/account/conversation/{id}", limit(h.GetConversation, "get_conversation")).Methods(http.MethodGet)
 
-	api.HandleFunc("/attachment/metadata/{msgId}/{recipientId}", middleware.BasicRateLimiter(h.HandleAttachmentMetadata, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 30,
-		MaxReqs:       20,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "attachment_metadata",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
-	api.HandleFunc("/attachment/download/{id}", middleware.BasicRateLimiter(h.DownloadAttachment, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 120,
-		MaxReqs:       4,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "download_attachment",
-	}, *redisClient, *Collections)).Methods(http.MethodGet)
+	api.HandleFunc("/posts/newest", limit(h.GetNewestPosts, "get_new_posts")).Methods(http.MethodGet)
+	api.HandleFunc("/posts/page/{page}", limit(h.GetPage, "get_page")).Methods(http.MethodGet)
+	api.HandleFunc("/posts/{postId}/comment", limit(h.CommentOnPost, "create_comment")).Methods(http.MethodPost)
+	api.HandleFunc("/posts/{postId}/comment/{id}/delete", limit(h.DeleteCommentOnPost, "delete_comment")).Methods(http.MethodDelete)
+	api.HandleFunc("/posts/{postId}/comment/{id}/update", limit(h.UpdatePostComment, "update_comment")).Methods(http.MethodPatch)
+	api.HandleFunc("/posts/{slug}", limit(h.GetPost, "get_post")).Methods(http.MethodGet)
+	api.HandleFunc("/posts/{slug}/delete", limit(h.DeletePost, "delete_post")).Methods(http.MethodDelete)
+	api.HandleFunc("/posts/{slug}/update", limit(h.UpdatePost, "update_post")).Methods(http.MethodPatch)
+	api.HandleFunc("/posts", limit(h.CreatePost, "create_post")).Methods(http.MethodPost)
+	api.HandleFunc("/posts/{slug}/image", limit(h.UploadPostImage, "upload_post_image")).Methods(http.MethodPost)
+	api.HandleFunc("/posts/{id}/image", limit(h.GetPostImage, "get_post_image")).Methods(http.MethodGet)
+	api.HandleFunc("/posts/{id}/thumb", limit(h.GetPostThumb, "get_post_thumb")).Methods(http.MethodGet)
+	api.HandleFunc("/posts/{id}/vote", limit(h.VoteOnPost, "post_vote")).Methods(http.MethodPatch)
+	api.HandleFunc("/posts/{postId}/{commentId}/vote", limit(h.VoteOnPostComment, "post_vote_comment")).Methods(http.MethodPatch)
+
+	api.HandleFunc("/rooms", limit(h.CreateRoom, "create_room")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/page/{page}", limit(h.GetRoomPage, "get_room_page")).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/own", limit(h.GetOwnRooms, "get_own_rooms")).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{id}", limit(h.GetRoom, "get_room")).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{id}/image", limit(h.UploadRoomImage, "upload_room_image")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/image", limit(h.GetRoomImage, "get_room_image")).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{id}/update", limit(h.UpdateRoom, "update_room")).Methods(http.MethodPatch)
+	api.HandleFunc("/rooms/{id}/slow-mode", limit(h.SetRoomSlowMode, "room_slow_mode")).Methods(http.MethodPatch)
+	api.HandleFunc("/rooms/{id}/announcement", limit(h.SetRoomAnnouncement, "room_announcement")).Methods(http.MethodPatch)
+	api.HandleFunc("/rooms/{id}/moderators/add", limit(h.AddRoomModerator, "room_add_moderator")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/moderators/remove", limit(h.RemoveRoomModerator, "room_remove_moderator")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/pin/{msgId}", limit(h.PinRoomMessage, "room_pin_message")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/unpin/{msgId}", limit(h.UnpinRoomMessage, "room_unpin_message")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/invite", limit(h.InviteToRoom, "invite_room")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/ban", limit(h.BanUserFromRoom, "ban_room")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/unban", limit(h.UnBanUserFromRoom, "unban_room")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/invite/accept/{msgId}", limit(h.AcceptRoomInvite, "invite_room_accept")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/invite/decline/{msgId}", limit(h.DeclineRoomInvite, "invite_room_decline")).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{id}/private-data", limit(h.GetRoomPrivateData, "get_room_private_data")).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{id}/delete", limit(h.DeleteRoom, "delete_room")).Methods(http.MethodDelete)
+
+	api.HandleFunc("/groups", limit(h.CreateGroupConversation, "create_group")).Methods(http.MethodPost)
+	api.HandleFunc("/groups", limit(h.GetGroupConversations, "get_groups")).Methods(http.MethodGet)
+	api.HandleFunc("/groups/{id}", limit(h.GetGroupConversation, "get_group")).Methods(http.MethodGet)
+	api.HandleFunc("/groups/{id}/participants/add", limit(h.AddGroupParticipant, "group_add_participant")).Methods(http.MethodPost)
+	api.HandleFunc("/groups/{id}/participants/remove", limit(h.RemoveGroupParticipant, "group_remove_participant")).Methods(http.MethodPost)
+	api.HandleFunc("/groups/{id}/delete", limit(h.DeleteGroupConversation, "delete_group")).Methods(http.MethodDelete)
+
+	api.HandleFunc("/attachment/metadata/{msgId}/{recipientId}", limit(h.HandleAttachmentMetadata, "attachment_metadata")).Methods(http.MethodPost)
+	api.HandleFunc("/attachment/download/{id}", limit(h.DownloadAttachment, "download_attachment")).Methods(http.MethodGet)
 	/*api.HandleFunc("/attachment/video/{id}", middleware.BasicRateLimiter(h.GetVideoPartialContent, middleware.SimpleLimiterOpts{
 		Window:        time.Second * 20,
 		MaxReqs:       20,
@@ -388,68 +246,89 @@ func main() {
 		Message:       "Too many requests",
 		RouteName:     "get_video_chunk",
 	}, *redisClient, *Collections)).Methods(http.MethodGet)*/
-	api.HandleFunc("/attachment/chunk/{msgId}", middleware.BasicRateLimiter(h.UploadAttachmentChunk, middleware.SimpleLimiterOpts{
-		Window:        time.Second * 60,
-		MaxReqs:       60,
-		BlockDuration: time.Second * 3000,
-		Message:       "Too many requests",
-		RouteName:     "upload_chunk",
-	}, *redisClient, *Collections)).Methods(http.MethodPost)
+	api.HandleFunc("/attachment/chunk/{msgId}", limit(h.UploadAttachmentChunk, "upload_chunk")).Methods(http.MethodPost)
 
 	api.HandleFunc("/ws", h.WebSocketEndpoint)
 
+	router.Handle("/metrics", metrics.Handler(Config.MetricsToken, *Config.MetricsPublic)).Methods(http.MethodGet)
+
+	Health := health.New(DB, redisClient)
+	router.HandleFunc("/healthz", Health.Healthz).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", Health.Readyz).Methods(http.MethodGet)
+
 	spa := spaHandler{staticPath: "build", indexPath: "index.html"}
 	router.PathPrefix("/").Handler(spa)
 
-	log.Println("Watching changestreams...")
-	changestreams.WatchCollections(DB, SocketServer, AttachmentServer)
-
-	if os.Getenv("PRODUCTION") == "true" {
-		//DB.Drop(context.Background())
-		//go seed.SeedDB(Collections, 50, 300, 50, protectedUids, protectedPids, protectedRids)
-		// Seeds already been generated, so just get everything already in the database instead
-		pcursor, _ := Collections.PostCollection.Find(context.Background(), bson.M{})
-		for pcursor.Next(context.Background()) {
-			post := &models.Post{}
-			pcursor.Decode(&post)
-			protectedPids[post.ID] = struct{}{}
-		}
-		rcursor, _ := Collections.RoomCollection.Find(context.Background(), bson.M{})
-		for rcursor.Next(context.Background()) {
-			room := &models.Room{}
-			rcursor.Decode(&room)
-			protectedPids[room.ID] = struct{}{}
-		}
-		ucursor, _ := Collections.UserCollection.Find(context.Background(), bson.M{})
-		for ucursor.Next(context.Background()) {
-			user := &models.User{}
-			ucursor.Decode(&user)
-			protectedPids[user.ID] = struct{}{}
-		}
-		pcursor.Close(context.Background())
-		rcursor.Close(context.Background())
-		ucursor.Close(context.Background())
-		Collections.InboxCollection.UpdateMany(context.Background(), bson.M{}, bson.M{"$set": bson.M{"messages": []models.PrivateMessage{}, "messages_sent_to": []primitive.ObjectID{}}})
-	} else {
-		//DB.Drop(context.Background())
-		//go seed.SeedDB(Collections, 10, 10, 5, protectedUids, protectedPids, protectedRids)
+	Notifier, err := notifier.New(Config.Digests)
+	if err != nil {
+		log.Fatal("Failed to set up notifier", err, nil)
 	}
+	if Notifier != nil {
+		notifier.RunDigester(ctx, Collections, SocketServer, Notifier, Config.Digests.IdlePeriod)
+	}
+
+	log.Info("Watching changestreams", nil)
+	ChangeStreams := changestreams.WatchCollections(ctx, DB, Collections, SocketServer, AttachmentServer, Config.ChangeStreams)
+	Health.AddCheck("change_streams", ChangeStreams.Check, false)
+
+	log.Info("Running deletion jobs", nil)
+	deletion.Run(ctx, Collections, DeletionPolicy)
+
+	// Innermost first. The client IP is resolved before anything else so that it can be logged.
+	var handler http.Handler = c.Handler(router)
+	handler = middleware.Recoverer(handler)
+	handler = middleware.AccessLog(handler)
+	handler = middleware.RequestID(handler, TrustedProxies)
+	handler = middleware.RealIP(handler, TrustedProxies, Config.ProxyHeader)
 
-	deleteAccountTicker := time.NewTicker(20 * time.Minute)
+	server := &http.Server{
+		Addr:    fmt.Sprint(":", Config.Port),
+		Handler: handler,
+	}
 	go func() {
-		for {
-			select {
-			case <-deleteAccountTicker.C:
-				h.Collections.UserCollection.DeleteMany(context.Background(), bson.M{
-					"$and": []bson.M{
-						{"created_at": bson.M{"$lt": primitive.NewDateTimeFromTime(time.Now().Add(-time.Minute * 20))}},
-						{"_id": bson.M{"$nin": protectedUids}},
-					},
-				})
-			}
+		log.Info("API open", logger.Fields{"port": Config.Port})
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("HTTP server failed", err, nil)
 		}
 	}()
 
-	log.Println("API open on port", os.Getenv("PORT"))
-	log.Fatal(http.ListenAndServe(fmt.Sprint(":", os.Getenv("PORT")), c.Handler(router)))
+	<-ctx.Done()
+	// A second signal kills the server straight away
+	stop()
+	log.Info("Shutting down", nil)
+	Health.SetDraining()
+	// Gives load balancers time to see /readyz failing and stop sending requests here
+	if Config.PreStopDelay > 0 {
+		log.Info("Waiting before closing connections", logger.Fields{"pre_stop_delay": Config.PreStopDelay.String()})
+		time.Sleep(Config.PreStopDelay)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stops accepting connections and waits for requests to finish. Websockets are hijacked, so they aren't waited for.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error("HTTP server shutdown failed", err, nil)
+	}
+	AttachmentServer.Shutdown(shutdownCtx, Collections, SocketServer)
+	SocketServer.Shutdown(shutdownCtx)
+
+	// The change streams were closed by the context being cancelled
+	streamsClosed := make(chan struct{})
+	go func() {
+		ChangeStreams.Wait()
+		close(streamsClosed)
+	}()
+	select {
+	case <-streamsClosed:
+	case <-shutdownCtx.Done():
+		log.Warn("Change streams did not close before the shutdown deadline", nil)
+	}
+
+	if err := redisClient.Close(); err != nil {
+		log.Error("Failed to close Redis", err, nil)
+	}
+	if err := DB.Client().Disconnect(shutdownCtx); err != nil {
+		log.Error("Failed to disconnect from MongoDB", err, nil)
+	}
+	log.Info("Shut down", nil)
 }
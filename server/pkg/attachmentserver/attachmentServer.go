@@ -9,6 +9,8 @@ import (
 
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/metrics"
 	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 	"go.mongodb.org/mongo-driver/bson"
@@ -20,6 +22,8 @@ import (
 	For attachment uploads
 */
 
+var log = logger.New("attachmentserver")
+
 /*--------------- ATTACHMENT SERVER STRUCT ---------------*/
 type AttachmentServer struct {
 	Uploaders Uploaders
@@ -66,7 +70,8 @@ type Uploaders struct {
 	mutex sync.RWMutex
 }
 
-func Init(colls *db.Collections, SocketServer *socketserver.SocketServer) (*AttachmentServer, error) {
+// The cleanup ticker stops when the context is cancelled
+func Init(ctx context.Context, colls *db.Collections, SocketServer *socketserver.SocketServer) (*AttachmentServer, error) {
 	AttachmentServer := &AttachmentServer{
 		Uploaders: Uploaders{
 			data: make(map[primitive.ObjectID]map[primitive.ObjectID]Upload),
@@ -82,7 +87,16 @@ func Init(colls *db.Collections, SocketServer *socketserver.SocketServer) (*Atta
 		DeleteChunksChan: make(chan primitive.ObjectID),
 	}
 	RunServer(colls, SocketServer, AttachmentServer)
-	cleanUp(AttachmentServer, colls)
+	cleanUp(ctx, AttachmentServer, colls)
+	metrics.NewGaugeFunc("attachment_uploads_in_progress", "Attachment uploads that haven't finished or been cleaned up.", "", func() map[string]float64 {
+		AttachmentServer.Uploaders.mutex.RLock()
+		defer AttachmentServer.Uploaders.mutex.RUnlock()
+		count := 0
+		for _, uploads := range AttachmentServer.Uploaders.data {
+			count += len(uploads)
+		}
+		return map[string]float64{"": float64(count)}
+	})
 	return AttachmentServer, nil
 }
 
@@ -99,12 +113,16 @@ func RunServer(colls *db.Collections, SocketServer *socketserver.SocketServer, A
 					if err := colls.AttachmentChunksCollection.FindOne(context.Background(), bson.M{"_id": msgId}).Decode(&firstChunk); err == nil {
 						// Found the chunk. Recursively delete chained chunks
 						AttachmentServer.Uploaders.mutex.Lock()
-						recursivelyDeleteChunks(firstChunk.ID, colls)
+						if err := recursivelyDeleteChunks(firstChunk.ID, colls); err != nil {
+							log.Error("Failed to delete attachment chunks", err, logger.Fields{"msg_id": msgId.Hex()})
+						}
 						AttachmentServer.Uploaders.mutex.Unlock()
 					}
+				} else {
+					log.Error("Failed to find attachment metadata", err, logger.Fields{"msg_id": msgId.Hex()})
 				}
-			} else {
-				colls.AttachmentChunksCollection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": metaData.ChunkIDs}})
+			} else if _, err := colls.AttachmentChunksCollection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": metaData.ChunkIDs}}); err != nil {
+				log.Error("Failed to delete attachment chunks", err, logger.Fields{"msg_id": msgId.Hex()})
 			}
 		}
 	}()
@@ -126,7 +144,9 @@ func RunServer(colls *db.Collections, SocketServer *socketserver.SocketServer, A
 				}
 			}
 			AttachmentServer.Uploaders.mutex.RUnlock()
-			colls.AttachmentMetadataCollection.UpdateByID(context.Background(), info.MsgID, bson.M{"$set": bson.M{"failed": true, "pending": false}})
+			if _, err := colls.AttachmentMetadataCollection.UpdateByID(context.Background(), info.MsgID, bson.M{"$set": bson.M{"failed": true, "pending": false}}); err != nil {
+				log.Error("Failed to mark attachment as failed", err, logger.Fields{"msg_id": info.MsgID.Hex()})
+			}
 			AttachmentServer.DeleteChunksChan <- info.MsgID
 		}
 	}()
@@ -148,7 +168,9 @@ func RunServer(colls *db.Collections, SocketServer *socketserver.SocketServer, A
 				}
 			}
 			AttachmentServer.Uploaders.mutex.RUnlock()
-			colls.AttachmentMetadataCollection.UpdateByID(context.Background(), info.MsgID, bson.M{"$set": bson.M{"failed": false, "pending": false}})
+			if _, err := colls.AttachmentMetadataCollection.UpdateByID(context.Background(), info.MsgID, bson.M{"$set": bson.M{"failed": false, "pending": false}}); err != nil {
+				log.Error("Failed to mark attachment as complete", err, logger.Fields{"msg_id": info.MsgID.Hex()})
+			}
 		}
 	}()
 	/* ------ Handle attachment progress ------ */
@@ -201,24 +223,17 @@ func RunServer(colls *db.Collections, SocketServer *socketserver.SocketServer, A
 
 func recursivelyDeleteChunks(chunkID primitive.ObjectID, colls *db.Collections) error {
 	var chunk models.AttachmentChunk
-	res := colls.AttachmentChunksCollection.FindOneAndDelete(context.Background(), bson.M{"_id": chunkID}).Decode(&chunk)
-	if res.Error() != "" {
-		if res.Error() == mongo.ErrNoDocuments.Error() {
+	if err := colls.AttachmentChunksCollection.FindOneAndDelete(context.Background(), bson.M{"_id": chunkID}).Decode(&chunk); err != nil {
+		if err == mongo.ErrNoDocuments {
 			return nil
-		} else {
-			return fmt.Errorf(res.Error())
 		}
-	} else {
-		return recursivelyDeleteChunks(chunk.NextChunk, colls)
+		return err
 	}
+	return recursivelyDeleteChunks(chunk.NextChunk, colls)
 }
 
-func cleanUp(as *AttachmentServer, colls *db.Collections) {
+func cleanUp(ctx context.Context, as *AttachmentServer, colls *db.Collections) {
 	cleanupTicker := time.NewTicker(5 * time.Minute)
-	quitCleanup := make(chan struct{})
-	defer func() {
-		quitCleanup <- struct{}{}
-	}()
 	go func() {
 		for {
 			select {
@@ -234,7 +249,9 @@ func cleanUp(as *AttachmentServer, colls *db.Collections) {
 							if u.LastUpdate.Before(time.Now().Add(-time.Minute * 10)) {
 								// If the upload never finished delete the chunks aswell
 								if u.ChunksDone < u.TotalChunks-1 {
-									recursivelyDeleteChunks(msgId, colls)
+									if err := recursivelyDeleteChunks(msgId, colls); err != nil {
+										log.Error("Failed to delete chunks of abandoned upload", err, logger.Fields{"msg_id": msgId.Hex()})
+									}
 								}
 								delete(as.Uploaders.data[oi], msgId)
 							}
@@ -242,7 +259,7 @@ func cleanUp(as *AttachmentServer, colls *db.Collections) {
 					}
 				}
 				as.Uploaders.mutex.Unlock()
-			case <-quitCleanup:
+			case <-ctx.Done():
 				cleanupTicker.Stop()
 				return
 			}
@@ -253,3 +270,43 @@ func cleanUp(as *AttachmentServer, colls *db.Collections) {
 func getProgressString(upload Upload) string {
 	return fmt.Sprintf("%v", float32(upload.ChunksDone)/float32(upload.TotalChunks))
 }
+
+// Fails the uploads that haven't finished, since uploads can't be continued once the upload status
+// kept in memory is gone. Subscribers are told the upload failed, so this has to be called before
+// the socket server is shut down.
+func (as *AttachmentServer) Shutdown(ctx context.Context, colls *db.Collections, SocketServer *socketserver.SocketServer) {
+	as.Uploaders.mutex.Lock()
+	defer as.Uploaders.mutex.Unlock()
+	failed := 0
+	for uid, uploads := range as.Uploaders.data {
+		for msgId, upload := range uploads {
+			if upload.ChunksDone >= upload.TotalChunks-1 {
+				continue
+			}
+			if ctx.Err() != nil {
+				log.Warn("Shutdown deadline reached before pending uploads were failed", logger.Fields{"failed": failed})
+				return
+			}
+			outBytes, _ := json.Marshal(socketmodels.OutMessage{
+				Type: "ATTACHMENT_PROGRESS",
+				Data: `{"ID":"` + msgId.Hex() + `","failed":true,"pending":false}`,
+			})
+			select {
+			case SocketServer.SendDataToSubscriptions <- socketserver.SubscriptionDataMessageMulti{
+				Names: upload.SubscriptionNames,
+				Data:  outBytes,
+			}:
+			case <-ctx.Done():
+			}
+			if _, err := colls.AttachmentMetadataCollection.UpdateByID(ctx, msgId, bson.M{"$set": bson.M{"failed": true, "pending": false}}); err != nil {
+				log.Error("Failed to mark attachment as failed", err, logger.Fields{"msg_id": msgId.Hex()})
+			}
+			if err := recursivelyDeleteChunks(msgId, colls); err != nil {
+				log.Error("Failed to delete attachment chunks", err, logger.Fields{"msg_id": msgId.Hex()})
+			}
+			delete(as.Uploaders.data[uid], msgId)
+			failed++
+		}
+	}
+	log.Info("Failed pending uploads", logger.Fields{"count": failed})
+}
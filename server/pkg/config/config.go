@@ -0,0 +1,503 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Server configuration. Defaults are overridden by the YAML file at CONFIG_FILE, if there is one,
+	and then by environment variables. Load returns an error if anything required is missing or invalid.
+
+	PORT, MONGODB_URI, MONGODB_DB and SECRET are required.
+	PRODUCTION, "true" for production. Cookies are secure and only the production origin is allowed by default.
+	REDIS_URL, redis://localhost:6379 if not set.
+	CORS_ORIGINS, a comma separated list of allowed origins.
+	TRUSTED_PROXIES, a comma separated list of CIDRs or addresses. The client IP is only taken from the
+	Forwarded or X-Forwarded-For headers on requests from these. None if not set.
+	PROXY_HEADER, the header the trusted proxies add the client to, x-forwarded-for (the default) or forwarded.
+	Only that header is read, proxies pass the other one on from the client unchanged.
+	COOKIE_SECURE, COOKIE_SAMESITE (default, lax, strict or none) and COOKIE_DOMAIN.
+	MAX_IMAGE_UPLOAD_MB, 20 if not set. MAX_ATTACHMENT_UPLOAD_MB, no limit if not set.
+	METRICS_TOKEN, if set /metrics requires it as a bearer token.
+	METRICS_PUBLIC, "true" to serve /metrics without a token. Defaults to true outside of production, so
+	/metrics is closed in production unless there is a token or it is made public.
+	CHANGE_STREAM_MODE, watch to use change streams, poll to poll the collections instead, or auto (the default)
+	to use change streams and fall back to polling if the deployment doesn't support them.
+	CHANGE_STREAM_POLL_INTERVAL, how often collections are polled, like 5s. 5s if not set.
+	PRE_STOP_DELAY, how long to keep serving after /readyz starts failing on shutdown, like 10s, so load balancers
+	stop sending requests before the server stops accepting them. 0 if not set.
+
+	PASSWORD_MIN_LENGTH, 8 if not set.
+	PASSWORD_REQUIRE_UPPER, PASSWORD_REQUIRE_LOWER, PASSWORD_REQUIRE_DIGIT and PASSWORD_REQUIRE_SYMBOL, "true" to require one.
+	PASSWORD_BLOCKLIST_FILE, a file of common or breached passwords, one per line. common-passwords.txt if not set.
+	BCRYPT_COST, 14 if not set. Existing passwords are only rehashed when it is raised.
+
+	SANDBOX_MODE, "true" to run as a public demo, see the sandbox package.
+	SANDBOX_ACCOUNT_LIFETIME_MINUTES, how long new accounts last in sandbox mode, 20 if not set.
+	SANDBOX_SEED_USERS, SANDBOX_SEED_POSTS and SANDBOX_SEED_ROOMS, used by the seed command. 10, 10 and 5 if not set.
+
+	ACCOUNT_DELETION_GRACE_HOURS, how long deleted accounts can be restored for, 72 if not set. 0 purges accounts straight away.
+	DATA_EXPORT_DIR, where data export archives are kept. data_exports in the temp directory if not set.
+
+	DIGEST_NOTIFIER, WEBHOOK or SMTP. Digests are disabled if not set.
+	DIGEST_WEBHOOK_URL, required for WEBHOOK.
+	SMTP_ADDR (host:port) and SMTP_FROM, required for SMTP. SMTP_USERNAME and SMTP_PASSWORD are optional.
+	SMTP_TIMEOUT, how long the conversation with the SMTP server can take, like 30s. 30s if not set.
+	DIGEST_IDLE_MINUTES, how long notifications go unread before they are sent in a digest, 30 if not set.
+
+	Rate limits can only be changed from the file. A route listed in the file replaces the default
+	for that route entirely, durations are written like 2m or 30s:
+
+	rate_limits:
+	  login:
+	    window: 2m
+	    max_reqs: 5
+	    block_duration: 50m
+	    algorithm: token_bucket
+	    key: ip
+*/
+
+const DefaultRateLimitMessage = "Too many requests"
+
+type Config struct {
+	Port       string  `yaml:"port" validate:"required,numeric"`
+	Production bool    `yaml:"production"`
+	Secret     string  `yaml:"secret" validate:"required"`
+	MongoDB    MongoDB `yaml:"mongodb"`
+	Redis      Redis   `yaml:"redis"`
+
+	CORSOrigins    []string      `yaml:"cors_origins" validate:"required,dive,url"`
+	TrustedProxies []string      `yaml:"trusted_proxies" validate:"dive,cidr|ip"`
+	ProxyHeader    string        `yaml:"proxy_header" validate:"oneof=x-forwarded-for forwarded"`
+	Cookies        Cookies       `yaml:"cookies"`
+	Uploads        Uploads       `yaml:"uploads"`
+	MetricsToken   string        `yaml:"metrics_token"`
+	MetricsPublic  *bool         `yaml:"metrics_public"` // Set to the opposite of Production if left out
+	ChangeStreams  ChangeStreams `yaml:"change_streams"`
+	PreStopDelay   time.Duration `yaml:"pre_stop_delay" validate:"gte=0"`
+
+	Passwords   Passwords   `yaml:"passwords"`
+	Sandbox     Sandbox     `yaml:"sandbox"`
+	Deletion    Deletion    `yaml:"deletion"`
+	DataExports DataExports `yaml:"data_exports"`
+	Digests     Digests     `yaml:"digests"`
+
+	RateLimits map[string]RateLimit `yaml:"rate_limits" validate:"dive"`
+}
+
+type MongoDB struct {
+	URI string `yaml:"uri" validate:"required"`
+	DB  string `yaml:"db" validate:"required"`
+}
+
+type Redis struct {
+	URL string `yaml:"url" validate:"required"`
+}
+
+type Cookies struct {
+	Secure   *bool  `yaml:"secure"` // Set to the value of Production if left out
+	SameSite string `yaml:"same_site" validate:"oneof=default lax strict none"`
+	Domain   string `yaml:"domain"`
+}
+
+// Sizes are in bytes
+type Uploads struct {
+	MaxImageSize      int64 `yaml:"max_image_size" validate:"gt=0"`
+	MaxAttachmentSize int64 `yaml:"max_attachment_size" validate:"gte=0"` // 0 for no limit
+}
+
+type ChangeStreams struct {
+	Mode         string        `yaml:"mode" validate:"oneof=auto watch poll"`
+	PollInterval time.Duration `yaml:"poll_interval" validate:"gte=1000000000"` // At least a second
+}
+
+type Passwords struct {
+	MinLength     int    `yaml:"min_length" validate:"gte=1,lte=72"` // bcrypt only uses the first 72 bytes
+	RequireUpper  bool   `yaml:"require_upper"`
+	RequireLower  bool   `yaml:"require_lower"`
+	RequireDigit  bool   `yaml:"require_digit"`
+	RequireSymbol bool   `yaml:"require_symbol"`
+	BlocklistFile string `yaml:"blocklist_file"` // Empty for no blocklist
+	BcryptCost    int    `yaml:"bcrypt_cost" validate:"gte=4,lte=31"`
+}
+
+type Sandbox struct {
+	Enabled         bool          `yaml:"enabled"`
+	AccountLifetime time.Duration `yaml:"account_lifetime" validate:"gte=60000000000"` // At least a minute
+	SeedUsers       int           `yaml:"seed_users" validate:"gt=0"`
+	SeedPosts       int           `yaml:"seed_posts" validate:"gt=0"`
+	SeedRooms       int           `yaml:"seed_rooms" validate:"gt=0"`
+}
+
+type Deletion struct {
+	GracePeriod time.Duration `yaml:"grace_period" validate:"gte=0"`
+}
+
+type DataExports struct {
+	Dir string `yaml:"dir" validate:"required"`
+}
+
+type Digests struct {
+	Notifier     string        `yaml:"notifier" validate:"omitempty,oneof=WEBHOOK SMTP"` // Digests are disabled if left out
+	IdlePeriod   time.Duration `yaml:"idle_period" validate:"gte=60000000000"`           // At least a minute
+	WebhookURL   string        `yaml:"webhook_url" validate:"required_if=Notifier WEBHOOK,omitempty,url"`
+	SMTPAddr     string        `yaml:"smtp_addr" validate:"required_if=Notifier SMTP,omitempty,hostname_port"`
+	SMTPFrom     string        `yaml:"smtp_from" validate:"required_if=Notifier SMTP,omitempty,email"`
+	SMTPUsername string        `yaml:"smtp_username"`
+	SMTPPassword string        `yaml:"smtp_password"`
+	SMTPTimeout  time.Duration `yaml:"smtp_timeout" validate:"gte=1000000000"` // At least a second
+}
+
+type RateLimit struct {
+	Window        time.Duration `yaml:"window" validate:"gt=0"`
+	MaxReqs       uint16        `yaml:"max_reqs" validate:"gt=0"`
+	BlockDuration time.Duration `yaml:"block_duration" validate:"gte=0"` // 0 to only reject requests until the limit allows them again
+	Message       string        `yaml:"message"`
+	Algorithm     string        `yaml:"algorithm" validate:"omitempty,oneof=sliding_window token_bucket"` // sliding_window if left out
+	Key           string        `yaml:"key" validate:"omitempty,oneof=user ip"`                           // user if left out, which falls back to the IP for guests
+}
+
+func (c Cookies) SameSiteMode() http.SameSite {
+	switch c.SameSite {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+// The rate limit for a route, the second return value is false if the route has no rate limit
+func (cfg *Config) RateLimit(route string) (RateLimit, bool) {
+	limit, ok := cfg.RateLimits[route]
+	if limit.Message == "" {
+		limit.Message = DefaultRateLimitMessage
+	}
+	return limit, ok
+}
+
+func Load() (*Config, error) {
+	cfg := &Config{
+		Redis:       Redis{URL: "redis://localhost:6379"},
+		ProxyHeader: "x-forwarded-for",
+		Cookies: Cookies{
+			SameSite: "default",
+		},
+		Uploads: Uploads{
+			MaxImageSize: 20 * 1024 * 1024,
+		},
+		ChangeStreams: ChangeStreams{
+			Mode:         "auto",
+			PollInterval: time.Second * 5,
+		},
+		Passwords: Passwords{
+			MinLength:     8,
+			BlocklistFile: "common-passwords.txt",
+			BcryptCost:    14,
+		},
+		Sandbox: Sandbox{
+			AccountLifetime: time.Minute * 20,
+			SeedUsers:       10,
+			SeedPosts:       10,
+			SeedRooms:       5,
+		},
+		Deletion:    Deletion{GracePeriod: time.Hour * 72},
+		DataExports: DataExports{Dir: filepath.Join(os.TempDir(), "data_exports")},
+		Digests: Digests{
+			IdlePeriod:  time.Minute * 30,
+			SMTPTimeout: time.Second * 30,
+		},
+		RateLimits: make(map[string]RateLimit, len(DefaultRateLimits)),
+	}
+	for route, limit := range DefaultRateLimits {
+		cfg.RateLimits[route] = limit
+	}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("Failed to parse config file: %w", err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// Defaults that depend on whether this is production
+	if cfg.Cookies.Secure == nil {
+		secure := cfg.Production
+		cfg.Cookies.Secure = &secure
+	}
+	if cfg.MetricsPublic == nil {
+		public := !cfg.Production
+		cfg.MetricsPublic = &public
+	}
+	if cfg.CORSOrigins == nil {
+		if cfg.Production {
+			cfg.CORSOrigins = []string{"https://go-social-media-js.herokuapp.com"}
+		} else {
+			cfg.CORSOrigins = []string{"http://localhost:3000", "http://localhost:8080"}
+		}
+	}
+
+	if err := validator.New().Struct(cfg); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %w", err)
+	}
+	// Browsers reject SameSite=None cookies that aren't secure
+	if cfg.Cookies.SameSite == "none" && !*cfg.Cookies.Secure {
+		return nil, errors.New("Invalid configuration: cookies must be secure to use SameSite none")
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadEnv() error {
+	stringFromEnv(&cfg.Port, "PORT")
+	stringFromEnv(&cfg.MongoDB.URI, "MONGODB_URI")
+	stringFromEnv(&cfg.MongoDB.DB, "MONGODB_DB")
+	stringFromEnv(&cfg.Secret, "SECRET")
+	stringFromEnv(&cfg.Redis.URL, "REDIS_URL")
+	stringFromEnv(&cfg.Cookies.SameSite, "COOKIE_SAMESITE")
+	stringFromEnv(&cfg.Cookies.Domain, "COOKIE_DOMAIN")
+	stringFromEnv(&cfg.MetricsToken, "METRICS_TOKEN")
+	stringFromEnv(&cfg.ProxyHeader, "PROXY_HEADER")
+	stringFromEnv(&cfg.ChangeStreams.Mode, "CHANGE_STREAM_MODE")
+	stringFromEnv(&cfg.Passwords.BlocklistFile, "PASSWORD_BLOCKLIST_FILE")
+	stringFromEnv(&cfg.DataExports.Dir, "DATA_EXPORT_DIR")
+	stringFromEnv(&cfg.Digests.Notifier, "DIGEST_NOTIFIER")
+	stringFromEnv(&cfg.Digests.WebhookURL, "DIGEST_WEBHOOK_URL")
+	stringFromEnv(&cfg.Digests.SMTPAddr, "SMTP_ADDR")
+	stringFromEnv(&cfg.Digests.SMTPFrom, "SMTP_FROM")
+	stringFromEnv(&cfg.Digests.SMTPUsername, "SMTP_USERNAME")
+	stringFromEnv(&cfg.Digests.SMTPPassword, "SMTP_PASSWORD")
+	boolFromEnv(&cfg.Production, "PRODUCTION")
+	boolFromEnv(&cfg.Passwords.RequireUpper, "PASSWORD_REQUIRE_UPPER")
+	boolFromEnv(&cfg.Passwords.RequireLower, "PASSWORD_REQUIRE_LOWER")
+	boolFromEnv(&cfg.Passwords.RequireDigit, "PASSWORD_REQUIRE_DIGIT")
+	boolFromEnv(&cfg.Passwords.RequireSymbol, "PASSWORD_REQUIRE_SYMBOL")
+	boolFromEnv(&cfg.Sandbox.Enabled, "SANDBOX_MODE")
+	if v, ok := os.LookupEnv("COOKIE_SECURE"); ok {
+		secure := v == "true"
+		cfg.Cookies.Secure = &secure
+	}
+	if v, ok := os.LookupEnv("METRICS_PUBLIC"); ok {
+		public := v == "true"
+		cfg.MetricsPublic = &public
+	}
+	listFromEnv(&cfg.CORSOrigins, "CORS_ORIGINS")
+	listFromEnv(&cfg.TrustedProxies, "TRUSTED_PROXIES")
+	if err := megabytesFromEnv(&cfg.Uploads.MaxImageSize, "MAX_IMAGE_UPLOAD_MB"); err != nil {
+		return err
+	}
+	if err := megabytesFromEnv(&cfg.Uploads.MaxAttachmentSize, "MAX_ATTACHMENT_UPLOAD_MB"); err != nil {
+		return err
+	}
+	if err := durationFromEnv(&cfg.ChangeStreams.PollInterval, "CHANGE_STREAM_POLL_INTERVAL"); err != nil {
+		return err
+	}
+	if err := durationFromEnv(&cfg.PreStopDelay, "PRE_STOP_DELAY"); err != nil {
+		return err
+	}
+	if err := durationFromEnv(&cfg.Digests.SMTPTimeout, "SMTP_TIMEOUT"); err != nil {
+		return err
+	}
+	for key, dst := range map[string]*int{
+		"PASSWORD_MIN_LENGTH": &cfg.Passwords.MinLength,
+		"BCRYPT_COST":         &cfg.Passwords.BcryptCost,
+		"SANDBOX_SEED_USERS":  &cfg.Sandbox.SeedUsers,
+		"SANDBOX_SEED_POSTS":  &cfg.Sandbox.SeedPosts,
+		"SANDBOX_SEED_ROOMS":  &cfg.Sandbox.SeedRooms,
+	} {
+		if err := intFromEnv(dst, key); err != nil {
+			return err
+		}
+	}
+	if err := unitsFromEnv(&cfg.Sandbox.AccountLifetime, "SANDBOX_ACCOUNT_LIFETIME_MINUTES", time.Minute, "minutes"); err != nil {
+		return err
+	}
+	if err := unitsFromEnv(&cfg.Deletion.GracePeriod, "ACCOUNT_DELETION_GRACE_HOURS", time.Hour, "hours"); err != nil {
+		return err
+	}
+	return unitsFromEnv(&cfg.Digests.IdlePeriod, "DIGEST_IDLE_MINUTES", time.Minute, "minutes")
+}
+
+func stringFromEnv(dst *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*dst = v
+	}
+}
+
+// Only "true" is true
+func boolFromEnv(dst *bool, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v == "true"
+	}
+}
+
+func intFromEnv(dst *int, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v must be a whole number", key)
+	}
+	*dst = n
+	return nil
+}
+
+// For durations given as a whole number of some unit, like DIGEST_IDLE_MINUTES
+func unitsFromEnv(dst *time.Duration, key string, unit time.Duration, unitName string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid configuration: %v must be a whole number of %v", key, unitName)
+	}
+	*dst = unit * time.Duration(n)
+	return nil
+}
+
+// Comma separated
+func listFromEnv(dst *[]string, key string) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	*dst = []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+func megabytesFromEnv(dst *int64, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	mb, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || mb < 0 {
+		return fmt.Errorf("Invalid configuration: %v must be a whole number of megabytes", key)
+	}
+	*dst = mb * 1024 * 1024
+	return nil
+}
+
+func durationFromEnv(dst *time.Duration, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v must be a duration, like 5s", key)
+	}
+	*dst = d
+	return nil
+}
+
+// Every rate limited route, by route name
+var DefaultRateLimits = map[string]RateLimit{
+	"get_user":                    {Window: time.Second * 20, MaxReqs: 500, BlockDuration: time.Minute * 50},
+	"get_pfp":                     {Window: time.Second * 20, MaxReqs: 500, BlockDuration: time.Minute * 50},
+	"get_user_posts":              {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"block_user":                  {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"unblock_user":                {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"get_blocked_users":           {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"get_digest_settings":         {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"update_digest_settings":      {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"start_data_export":           {Window: time.Minute * 2, MaxReqs: 3, BlockDuration: time.Minute * 50},
+	"get_data_export":             {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"download_data_export":        {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"get_deletion_status":         {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"get_privacy_settings":        {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"update_privacy_settings":     {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"get_message_requests":        {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"accept_message_request":      {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50},
+	"decline_message_request":     {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50},
+	"get_notifications":           {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"mark_all_notifications_read": {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50},
+	"mark_notification_read":      {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"register":                    {Window: time.Second * 1000, MaxReqs: 3, BlockDuration: time.Second * 10000, Message: "You have been creating too many accounts"},
+	"login":                       {Window: time.Second * 20, MaxReqs: 5, BlockDuration: time.Minute * 50},
+	"two_factor_login":            {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"get_two_factor_status":       {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"enroll_two_factor":           {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"enable_two_factor":           {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"disable_two_factor":          {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"logout":                      {Window: time.Second * 20, MaxReqs: 5, BlockDuration: time.Minute * 50},
+	"refresh_token":               {Window: time.Second * 20, MaxReqs: 6, BlockDuration: time.Minute * 100},
+	"get_sessions":                {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"revoke_other_sessions":       {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"revoke_session":              {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50},
+	"change_password":             {Window: time.Minute * 2, MaxReqs: 5, BlockDuration: time.Minute * 50},
+	"update_profile":              {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"change_username":             {Window: time.Minute * 2, MaxReqs: 5, BlockDuration: time.Minute * 50},
+	"delete_account":              {Window: time.Second * 20, MaxReqs: 2, BlockDuration: time.Minute * 50},
+	"upload_pfp":                  {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Second * 500},
+	"get_conversations":           {Window: time.Second * 8, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"get_conversation":            {Window: time.Second * 8, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"get_new_posts":               {Window: time.Second * 10, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"get_page":                    {Window: time.Second * 10, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"create_comment":              {Window: time.Minute * 2, MaxReqs: 40, BlockDuration: time.Minute * 50, Message: "You have been making too many comments"},
+	"delete_comment":              {Window: time.Minute * 2, MaxReqs: 40, BlockDuration: time.Minute * 50, Message: "You have been deleting too many comments"},
+	"update_comment":              {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50, Message: "You have been editing too many comments"},
+	"get_post":                    {Window: time.Minute, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"delete_post":                 {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"update_post":                 {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50, Message: "You have been editing too many posts"},
+	"create_post":                 {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50, Message: "You have been creating too many posts"},
+	"upload_post_image":           {Window: time.Second * 30, MaxReqs: 20, BlockDuration: time.Second * 200},
+	"get_post_image":              {Window: time.Second * 3, MaxReqs: 60, BlockDuration: time.Second * 100},
+	"get_post_thumb":              {Window: time.Second * 3, MaxReqs: 60, BlockDuration: time.Second * 100},
+	"post_vote":                   {Window: time.Second * 2, MaxReqs: 10, BlockDuration: time.Second * 100},
+	"post_vote_comment":           {Window: time.Second * 2, MaxReqs: 10, BlockDuration: time.Second * 100},
+	"create_room":                 {Window: time.Minute * 4, MaxReqs: 3, BlockDuration: time.Second * 1000, Message: "You have been creating too many rooms"},
+	"get_room_page":               {Window: time.Second * 10, MaxReqs: 20, BlockDuration: time.Second * 1000},
+	"get_own_rooms":               {Window: time.Second * 10, MaxReqs: 20, BlockDuration: time.Second * 1000},
+	"get_room":                    {Window: time.Second * 10, MaxReqs: 20, BlockDuration: time.Second * 1000},
+	"upload_room_image":           {Window: time.Second * 30, MaxReqs: 20, BlockDuration: time.Second * 200},
+	"get_room_image":              {Window: time.Second * 3, MaxReqs: 60, BlockDuration: time.Second * 100},
+	"update_room":                 {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50, Message: "You have been editing too many rooms"},
+	"room_slow_mode":              {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"room_announcement":           {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"room_add_moderator":          {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"room_remove_moderator":       {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"room_pin_message":            {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"room_unpin_message":          {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"invite_room":                 {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50, Message: "You have been sending too many invitations"},
+	"ban_room":                    {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"unban_room":                  {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"invite_room_accept":          {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"invite_room_decline":         {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"get_room_private_data":       {Window: time.Second * 3, MaxReqs: 60, BlockDuration: time.Second * 100},
+	"delete_room":                 {Window: time.Minute * 2, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"create_group":                {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"get_groups":                  {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"get_group":                   {Window: time.Minute * 2, MaxReqs: 60, BlockDuration: time.Minute * 50},
+	"group_add_participant":       {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50},
+	"group_remove_participant":    {Window: time.Minute * 2, MaxReqs: 30, BlockDuration: time.Minute * 50},
+	"delete_group":                {Window: time.Minute * 2, MaxReqs: 10, BlockDuration: time.Minute * 50},
+	"attachment_metadata":         {Window: time.Second * 30, MaxReqs: 20, BlockDuration: time.Minute * 50},
+	"download_attachment":         {Window: time.Minute * 2, MaxReqs: 4, BlockDuration: time.Minute * 50},
+	"upload_chunk":                {Window: time.Minute, MaxReqs: 60, BlockDuration: time.Minute * 50},
+}
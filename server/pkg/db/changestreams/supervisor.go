@@ -0,0 +1,401 @@
+package changestreams
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Runs the watchers and keeps them running.
+
+	Each watcher gets its own goroutine. If its change stream fails it is reopened after a backoff,
+	starting from 1 second and doubling up to a minute, reset once the stream has been up for a minute.
+	The resume token is saved in the change_stream_tokens collection after every event, so a reopened
+	stream, or the stream opened after a restart, picks up after the last event that was handled. If the
+	token is too old to resume from (the oplog has moved past it) it is dropped and the events since
+	then are lost.
+
+	Deployments without change streams (a standalone mongod) have the collections polled instead. Each
+	poll is compared against the previous one to find inserts, updates and deletes. This reads every
+	document in the collection for update watchers, so it is only meant for development. Polling has no
+	resume token, changes made while the server is down are missed.
+
+	A panic in a handler is logged and the event is skipped, the watcher keeps going.
+*/
+
+const (
+	minBackoff   = time.Second
+	maxBackoff   = time.Minute
+	healthyAfter = time.Minute
+)
+
+const (
+	stateStarting   = "starting"
+	stateWatching   = "watching"
+	statePolling    = "polling"
+	stateRestarting = "restarting"
+	stateStopped    = "stopped"
+)
+
+var (
+	changeStreamEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "changestream_events_total",
+		Help: "Change stream events handled, by watcher. Includes changes found by polling.",
+	}, []string{"watcher"})
+	changeStreamRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "changestream_restarts_total",
+		Help: "Change stream watcher restarts after an error, by watcher.",
+	}, []string{"watcher"})
+)
+
+type watcher struct {
+	name       string
+	collection string
+	operation  string // insert, update or delete
+	// The handler needs the full document. Inserts always have it, for updates it is looked up.
+	fullDocument bool
+	handle       func(ev event) error
+}
+
+type event struct {
+	ID           primitive.ObjectID
+	FullDocument bson.Raw // Empty for deletes, or if the watcher doesn't need it, or if the document is already gone
+}
+
+var (
+	errNoDocument   = errors.New("Change event has no full document")
+	errTokenDropped = errors.New("Resume token dropped")
+)
+
+func (ev event) decode(v interface{}) error {
+	if len(ev.FullDocument) == 0 {
+		return errNoDocument
+	}
+	return bson.Unmarshal(ev.FullDocument, v)
+}
+
+type watcherStatus struct {
+	state     string
+	lastError string
+	lastEvent time.Time
+}
+
+type Supervisor struct {
+	wg           sync.WaitGroup
+	tokens       *mongo.Collection
+	mode         string
+	pollInterval time.Duration
+	polling      atomic.Bool // Set in auto mode once the deployment turns out not to support change streams
+
+	mutex    sync.Mutex
+	statuses map[string]*watcherStatus
+}
+
+func newSupervisor(tokens *mongo.Collection, cfg config.ChangeStreams) *Supervisor {
+	s := &Supervisor{
+		tokens:       tokens,
+		mode:         cfg.Mode,
+		pollInterval: cfg.PollInterval,
+		statuses:     make(map[string]*watcherStatus),
+	}
+	s.polling.Store(cfg.Mode == "poll")
+	return s
+}
+
+// Waits for every watcher to stop, after the context is cancelled
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// For the readiness check. Fails if any watcher isn't running.
+func (s *Supervisor) Check(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	failing := []string{}
+	for name, status := range s.statuses {
+		if status.state == stateWatching || status.state == statePolling {
+			continue
+		}
+		msg := name + " is " + status.state
+		if status.lastError != "" {
+			msg += " (" + status.lastError + ")"
+		}
+		failing = append(failing, msg)
+	}
+	if len(failing) == 0 {
+		return nil
+	}
+	sort.Strings(failing)
+	return errors.New(strings.Join(failing, ", "))
+}
+
+// 1 for each watcher that is running, 0 otherwise
+func (s *Supervisor) upGauge() map[string]float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values := make(map[string]float64, len(s.statuses))
+	for name, status := range s.statuses {
+		if status.state == stateWatching || status.state == statePolling {
+			values[name] = 1
+		} else {
+			values[name] = 0
+		}
+	}
+	return values
+}
+
+func (s *Supervisor) setState(name string, state string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := s.statuses[name]
+	status.state = state
+	if err != nil {
+		status.lastError = err.Error()
+	} else if state == stateWatching || state == statePolling {
+		status.lastError = ""
+	}
+}
+
+func (s *Supervisor) start(ctx context.Context, db *mongo.Database, w watcher) {
+	s.mutex.Lock()
+	s.statuses[w.name] = &watcherStatus{state: stateStarting}
+	s.mutex.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx, db, w)
+	}()
+}
+
+func (s *Supervisor) run(ctx context.Context, db *mongo.Database, w watcher) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		var err error
+		if s.polling.Load() {
+			err = s.poll(ctx, db, w)
+		} else {
+			err = s.watch(ctx, db, w)
+		}
+		if ctx.Err() != nil {
+			s.setState(w.name, stateStopped, nil)
+			return
+		}
+
+		if s.mode == "auto" && changeStreamsUnsupported(err) {
+			if !s.polling.Swap(true) {
+				log.Warn("Change streams are not supported by this deployment, polling instead", logger.Fields{"poll_interval": s.pollInterval.String()})
+			}
+			continue
+		}
+		if err == errTokenDropped {
+			continue
+		}
+
+		if time.Since(started) >= healthyAfter {
+			backoff = minBackoff
+		}
+		if err == nil {
+			// The stream was invalidated, by the collection being dropped or renamed
+			err = errors.New("Change stream closed")
+		}
+		s.setState(w.name, stateRestarting, err)
+		changeStreamRestarts.WithLabelValues(w.name).Inc()
+		log.Error("Change stream watcher stopped, restarting", err, logger.Fields{"watcher": w.name, "retry_in": backoff.String()})
+		select {
+		case <-ctx.Done():
+			s.setState(w.name, stateStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Returns when the stream fails or the context is cancelled
+func (s *Supervisor) watch(ctx context.Context, db *mongo.Database, w watcher) error {
+	var saved models.ChangeStreamToken
+	if err := s.tokens.FindOne(ctx, bson.M{"_id": w.name}).Decode(&saved); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	opts := options.ChangeStream()
+	if w.fullDocument && w.operation == "update" {
+		opts.SetFullDocument(options.UpdateLookup)
+	}
+	// Unlike resumeAfter, startAfter works with the token of an invalidate event
+	if saved.Token != nil {
+		opts.SetStartAfter(saved.Token)
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: w.operation}}}}}
+	cs, err := db.Collection(w.collection).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return s.checkHistoryLost(w.name, saved.Token, err)
+	}
+	defer cs.Close(context.Background())
+	s.setState(w.name, stateWatching, nil)
+	// Saved straight away so that events are resumed from here if the server restarts before the first one
+	s.saveToken(w.name, cs.ResumeToken())
+
+	for cs.Next(ctx) {
+		id, ok := cs.Current.Lookup("documentKey", "_id").ObjectIDOK()
+		if !ok {
+			log.Warn("Skipping change event without an ObjectID", logger.Fields{"watcher": w.name})
+		} else {
+			ev := event{ID: id}
+			if doc, ok := cs.Current.Lookup("fullDocument").DocumentOK(); ok {
+				ev.FullDocument = doc
+			}
+			s.handle(w, ev)
+		}
+		s.saveToken(w.name, cs.ResumeToken())
+	}
+	// Saved on the way out as well, the token moves forward even when there are no events
+	s.saveToken(w.name, cs.ResumeToken())
+	return s.checkHistoryLost(w.name, saved.Token, cs.Err())
+}
+
+// Drops the saved token if the stream can't be resumed from it, so that the next stream starts from now
+func (s *Supervisor) checkHistoryLost(name string, token bson.Raw, err error) error {
+	if token == nil || !historyLost(err) {
+		return err
+	}
+	log.Warn("Resume token is too old to resume from, changes since it are lost", logger.Fields{"watcher": name})
+	if _, err := s.tokens.DeleteOne(context.Background(), bson.M{"_id": name}); err != nil {
+		log.Error("Failed to delete resume token", err, logger.Fields{"watcher": name})
+		return err
+	}
+	return errTokenDropped
+}
+
+func (s *Supervisor) saveToken(name string, token bson.Raw) {
+	if token == nil {
+		return
+	}
+	if _, err := s.tokens.UpdateByID(context.Background(), name, bson.M{"$set": bson.M{
+		"token":      token,
+		"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+	}}, options.Update().SetUpsert(true)); err != nil {
+		log.Error("Failed to save resume token", err, logger.Fields{"watcher": name})
+	}
+}
+
+// Returns when a poll fails or the context is cancelled
+func (s *Supervisor) poll(ctx context.Context, db *mongo.Database, w watcher) error {
+	coll := db.Collection(w.collection)
+	var seen map[primitive.ObjectID]uint64
+	for {
+		current, err := s.pollOnce(ctx, coll, w, seen)
+		if err != nil {
+			return err
+		}
+		seen = current
+		s.setState(w.name, statePolling, nil)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// Compares the collection against the previous poll, which is nil on the first poll so nothing is
+// handled. Returns the IDs in the collection, along with a hash of each document for update watchers.
+func (s *Supervisor) pollOnce(ctx context.Context, coll *mongo.Collection, w watcher, seen map[primitive.ObjectID]uint64) (map[primitive.ObjectID]uint64, error) {
+	opts := options.Find()
+	if w.operation != "update" {
+		opts.SetProjection(bson.M{"_id": 1})
+	}
+	cursor, err := coll.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	current := make(map[primitive.ObjectID]uint64, len(seen))
+	for cursor.Next(ctx) {
+		id, ok := cursor.Current.Lookup("_id").ObjectIDOK()
+		if !ok {
+			continue
+		}
+		var sum uint64
+		if w.operation == "update" {
+			hash := fnv.New64a()
+			hash.Write(cursor.Current)
+			sum = hash.Sum64()
+		}
+		current[id] = sum
+		if seen == nil {
+			continue
+		}
+		previous, existed := seen[id]
+		switch {
+		case w.operation == "insert" && !existed:
+			ev := event{ID: id}
+			if w.fullDocument {
+				if ev.FullDocument, err = coll.FindOne(ctx, bson.M{"_id": id}).DecodeBytes(); err != nil && err != mongo.ErrNoDocuments {
+					return nil, err
+				}
+			}
+			s.handle(w, ev)
+		case w.operation == "update" && existed && previous != sum:
+			s.handle(w, event{ID: id, FullDocument: cursor.Current})
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if w.operation == "delete" && seen != nil {
+		for id := range seen {
+			if _, ok := current[id]; !ok {
+				s.handle(w, event{ID: id})
+			}
+		}
+	}
+	return current, nil
+}
+
+func (s *Supervisor) handle(w watcher, ev event) {
+	changeStreamEvents.WithLabelValues(w.name).Inc()
+	s.mutex.Lock()
+	s.statuses[w.name].lastEvent = time.Now()
+	s.mutex.Unlock()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Panic("change stream watcher", recovered, logger.Fields{"watcher": w.name, "id": ev.ID.Hex()})
+		}
+	}()
+	if err := w.handle(ev); err != nil {
+		log.Error("Failed to handle change event", err, logger.Fields{"watcher": w.name, "id": ev.ID.Hex()})
+	}
+}
+
+// 40573 is returned when opening a change stream on a standalone server, 40324 by servers too old to have them
+func changeStreamsUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && (serverErr.HasErrorCode(40573) || serverErr.HasErrorCode(40324))
+}
+
+// ChangeStreamHistoryLost, InvalidResumeToken and ChangeStreamFatalError
+func historyLost(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && (serverErr.HasErrorCode(286) || serverErr.HasErrorCode(260) || serverErr.HasErrorCode(280))
+}
@@ -2,13 +2,15 @@ package db
 
 import (
 	"context"
-	"log"
-	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -22,12 +24,19 @@ import (
 	20 minutes, along with all their stuff (i havent wrote that last bit yet though)
 */
 
+// Usernames are unique and compared case insensitively, queries on username should use this collation so they can use the index
+var UsernameCollation = &options.Collation{Locale: "en", Strength: 2}
+
 type Collections struct {
 	UserCollection          *mongo.Collection
 	InboxCollection         *mongo.Collection
 	SessionCollection       *mongo.Collection
 	PfpCollection           *mongo.Collection
 	NotificationsCollection *mongo.Collection
+	DataExportCollection    *mongo.Collection
+	DeletionJobCollection   *mongo.Collection
+	ProtectedCollection     *mongo.Collection
+	ChangeStreamCollection  *mongo.Collection
 
 	PostCollection         *mongo.Collection
 	PostVoteCollection     *mongo.Collection
@@ -40,31 +49,53 @@ type Collections struct {
 	RoomImageCollection       *mongo.Collection
 	RoomPrivateDataCollection *mongo.Collection
 
+	GroupConversationCollection *mongo.Collection
+	GroupMessagesCollection     *mongo.Collection
+
 	AttachmentMetadataCollection *mongo.Collection
 	AttachmentChunksCollection   *mongo.Collection
 }
 
-func Init() (*mongo.Database, *Collections) {
-	log.Println("Connecting to MongoDB...")
-	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGODB_URI")))
+var mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "mongodb_command_duration_seconds",
+	Help: "MongoDB command latency by command name and outcome.",
+}, []string{"command", "outcome"})
+
+var log = logger.New("db")
+
+// Background cleanup stops when the context is cancelled
+func Init(ctx context.Context, uri string, dbName string) (*mongo.Database, *Collections) {
+	log.Info("Connecting to MongoDB", nil)
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri).SetMonitor(&event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName, "ok").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName, "error").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+	}))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Invalid MongoDB options", err, nil)
 	}
 	err = client.Connect(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Failed to connect to MongoDB", err, nil)
 	}
 	err = client.Ping(context.Background(), readpref.Primary())
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Failed to ping MongoDB", err, nil)
 	}
-	DB := client.Database(os.Getenv("MONGODB_DB"))
+	DB := client.Database(dbName)
 	colls := &Collections{
 		UserCollection:          DB.Collection("users"),
 		InboxCollection:         DB.Collection("inboxes"),
 		SessionCollection:       DB.Collection("sessions"),
 		PfpCollection:           DB.Collection("pfps"),
 		NotificationsCollection: DB.Collection("notifications"),
+		DataExportCollection:    DB.Collection("data_exports"),
+		DeletionJobCollection:   DB.Collection("deletion_jobs"),
+		ProtectedCollection:     DB.Collection("protected_entities"),
+		ChangeStreamCollection:  DB.Collection("change_stream_tokens"),
 
 		PostCollection:         DB.Collection("posts"),
 		PostVoteCollection:     DB.Collection("post_votes"),
@@ -77,9 +108,18 @@ func Init() (*mongo.Database, *Collections) {
 		RoomImageCollection:       DB.Collection("room_images"),
 		RoomPrivateDataCollection: DB.Collection("room_private_data"),
 
+		GroupConversationCollection: DB.Collection("group_conversations"),
+		GroupMessagesCollection:     DB.Collection("group_messages"),
+
 		AttachmentMetadataCollection: DB.Collection("attachment_metadata"),
 		AttachmentChunksCollection:   DB.Collection("attachment_chunks"),
 	}
+	if _, err := colls.UserCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"username": 1},
+		Options: options.Index().SetName("username_unique").SetUnique(true).SetCollation(UsernameCollation),
+	}); err != nil {
+		log.Error("Failed to create the unique username index, usernames that only differ by case need renaming", err, nil)
+	}
 	colls.PostCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
 		Keys: bson.M{
 			"title": "text",
@@ -92,22 +132,53 @@ func Init() (*mongo.Database, *Collections) {
 		},
 		Options: options.Index().SetName("name_text"),
 	})
-	cleanUp(colls)
+	colls.SessionCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"exp": 1},
+		Options: options.Index().SetName("exp_ttl").SetExpireAfterSeconds(0),
+	})
+	colls.SessionCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"_uid": 1},
+		Options: options.Index().SetName("uid"),
+	})
+	colls.SessionCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"refresh_hash": 1},
+		Options: options.Index().SetName("refresh_hash"),
+	})
+	colls.SessionCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"used_hashes": 1},
+		Options: options.Index().SetName("used_hashes"),
+	})
+	colls.DataExportCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"uid": 1},
+		Options: options.Index().SetName("uid"),
+	})
+	// Only one export can be pending per user, concurrent requests fail on the insert
+	if _, err := colls.DataExportCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"uid": 1},
+		Options: options.Index().SetName("uid_pending_unique").SetUnique(true).SetPartialFilterExpression(bson.M{"status": models.DataExportPending}),
+	}); err != nil {
+		log.Error("Failed to create the unique pending data export index", err, nil)
+	}
+	colls.DeletionJobCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "status", Value: 1}, {Key: "lease_until", Value: 1}},
+		Options: options.Index().SetName("status_lease_until"),
+	})
+	colls.GroupConversationCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"participants": 1},
+		Options: options.Index().SetName("participants"),
+	})
+	cleanUp(ctx, colls)
 	return DB, colls
 }
 
-func cleanUp(colls *Collections) {
+func cleanUp(ctx context.Context, colls *Collections) {
 	cleanupTicker := time.NewTicker(24 * time.Hour)
-	quitCleanup := make(chan struct{})
-	defer func() {
-		quitCleanup <- struct{}{}
-	}()
 	go func() {
 		for {
 			select {
 			case <-cleanupTicker.C:
 				cleanUpPosts(colls)
-			case <-quitCleanup:
+			case <-ctx.Done():
 				cleanupTicker.Stop()
 				return
 			}
@@ -132,8 +203,10 @@ func getChildrenOfOrphanedComment(orphanId string, cmts map[string]string) map[s
 func cleanUpPosts(colls *Collections) {
 	cmtsCursor, err := colls.PostCommentsCollection.Find(context.Background(), bson.D{})
 	if err != nil {
-		log.Fatal("ERROR IN POSTS CLEANUP CURSOR :", err)
+		log.Error("Failed to open the posts cleanup cursor", err, nil)
+		return
 	}
+	defer cmtsCursor.Close(context.Background())
 	for cmtsCursor.Next(context.Background()) {
 		postCmts := &models.PostComments{}
 		cmtsCursor.Decode(&postCmts)
@@ -158,7 +231,8 @@ func cleanUpPosts(colls *Collections) {
 		for id := range orphanedCmts {
 			oid, err := primitive.ObjectIDFromHex(id)
 			if err != nil {
-				log.Fatal("Invalid ID : ", err)
+				log.Error("Invalid comment ID in posts cleanup", err, logger.Fields{"comment_id": id})
+				continue
 			}
 			deleteIds = append(deleteIds, oid)
 		}
@@ -167,8 +241,7 @@ func cleanUpPosts(colls *Collections) {
 			"comments": bson.M{"_id": bson.M{"$in": deleteIds}},
 			"votes":    bson.M{"$elemMatch": bson.M{"parent_id": bson.M{"$in": deleteIds}}},
 		}}); err != nil {
-			log.Fatal("ERROR IN POSTS CLEANUP DELETE COMMENTS OPERATION :", err)
+			log.Error("Failed to delete orphaned comments in posts cleanup", err, logger.Fields{"post_id": postCmts.ID.Hex()})
 		}
 	}
-	defer cmtsCursor.Close(context.Background())
 }
@@ -1,6 +1,9 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 /*
 	Private messages are kept in Inbox collection, and room messages are kept
@@ -13,28 +16,85 @@ import "go.mongodb.org/mongo-driver/bson/primitive"
 type User struct {
 	ID              primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
 	Username        string               `bson:"username,maxlength=16" json:"username"`
+	DisplayName     string               `bson:"display_name" json:"display_name"`
+	Bio             string               `bson:"bio" json:"bio"`
+	Links           []string             `bson:"links" json:"links"`
+	CreatedAt       primitive.DateTime   `bson:"created_at" json:"created_at"`
+	UsernameHistory []UsernameChange     `bson:"username_history" json:"username_history"` // Oldest first
 	Password        string               `bson:"password" json:"-"`
 	Base64pfp       string               `bson:"-" json:"base64pfp,omitempty"`
 	RoomsMessagesIn []primitive.ObjectID `bson:"rooms_messages_in" json:"-"`
+	Blocked         []primitive.ObjectID `bson:"blocked" json:"-"`
+	DMPrivacy       string               `bson:"dm_privacy" json:"-"` // EVERYONE, CONTACTS or NOBODY. Empty is the same as EVERYONE.
+	Digest          DigestSettings       `bson:"digest" json:"-"`
+	TwoFactor       TwoFactorSettings    `bson:"two_factor" json:"-"`
+	Presence        string               `bson:"presence" json:"presence"` // The presence state the user set, GetUser replaces it with what other users see
+	LastSeen        primitive.DateTime   `bson:"last_seen" json:"last_seen,omitempty"`
 	IsOnline        bool                 `bson:"-" json:"online"`
+	DeletedAt       primitive.DateTime   `bson:"deleted_at,omitempty" json:"-"` // Set while the account is soft deleted, see the deletion package
+	PurgeAt         primitive.DateTime   `bson:"purge_at,omitempty" json:"-"`   // When a soft deleted account stops being restorable and is deleted for real
+}
+
+type UsernameChange struct {
+	Username  string             `bson:"username" json:"username"` // The username before the change
+	ChangedAt primitive.DateTime `bson:"changed_at" json:"changed_at"`
+}
+
+// Opt-in settings for digests of unread notifications sent while the user is offline
+type DigestSettings struct {
+	Enabled  bool               `bson:"enabled" json:"enabled"`
+	Address  string             `bson:"address" json:"address"` // Where the notifier should deliver to, an email address for SMTP
+	LastSent primitive.DateTime `bson:"last_sent" json:"-"`     // Only notifications created after this are included in the next digest
+}
+
+type TwoFactorSettings struct {
+	Enabled       bool     `bson:"enabled"`
+	Secret        string   `bson:"secret"`
+	PendingSecret string   `bson:"pending_secret"` // Set on enrollment, becomes the secret once the user has verified a code
+	RecoveryCodes []string `bson:"recovery_codes"` // SHA256 hashes, removed once used
+	LastUsedStep  int64    `bson:"last_used_step"` // The TOTP period of the last accepted code, so codes can't be used twice
 }
 
 type Inbox struct {
 	ID             primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
 	Messages       []PrivateMessage     `bson:"messages" json:"messages"`
 	MessagesSentTo []primitive.ObjectID `bson:"messages_sent_to" json:"-"` // list of all the people the user has messaged, needed to join both users messages together for display
+	// Messages from users the DM privacy setting doesn't allow, kept here until the user accepts or declines them
+	MessageRequests      []PrivateMessage     `bson:"message_requests" json:"-"`
+	AcceptedRequestsFrom []primitive.ObjectID `bson:"accepted_requests_from" json:"-"`
+	DeclinedRequestsFrom []primitive.ObjectID `bson:"declined_requests_from" json:"-"`
 }
 
+const (
+	DMPrivacyEveryone = "EVERYONE"
+	DMPrivacyContacts = "CONTACTS" // Only users the user has messaged
+	DMPrivacyNobody   = "NOBODY"
+)
+
+const (
+	PresenceOnline    = "ONLINE"
+	PresenceIdle      = "IDLE"
+	PresenceDND       = "DND" // Do not disturb, no notifications are created for the users private messages
+	PresenceInvisible = "INVISIBLE"
+	PresenceOffline   = "OFFLINE" // Never stored, it's what other users see when the user isn't connected or is invisible
+)
+
 // Notifications kept in seperate collection so that changestreams can be used to easily update the client, not the most efficient way but it doesn't really matter
 type Notifications struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty"`
 	Notifications []Notification     `bson:"notifications" json:"notifications"`
 }
 
-// Notification will not be created if the user already has the conversation open
+// Newest notifications are first. Message notifications will not be created if the user already has the conversation open.
 type Notification struct {
-	//Notification will be MSG:userid but if its a notification for a message from the server it will be MSG:SERVER
-	Type string `bson:"type" json:"type"`
+	ID         primitive.ObjectID `bson:"_id" json:"ID"`
+	Kind       string             `bson:"kind" json:"kind"` // See the notifications package for the kinds
+	Actor      primitive.ObjectID `bson:"actor" json:"actor"`
+	TargetID   primitive.ObjectID `bson:"target_id" json:"target_id"`
+	TargetType string             `bson:"target_type" json:"target_type"`         // USER, GROUP, POST, POST_COMMENT, ROOM or ROOM_MESSAGE
+	ContextID  primitive.ObjectID `bson:"context_id,omitempty" json:"context_id"` // The post a comment is on, the room a message is in etc
+	CreatedAt  primitive.DateTime `bson:"created_at" json:"created_at"`
+	Read       bool               `bson:"read" json:"read"`
 }
 
 type Pfp struct {
@@ -42,9 +102,78 @@ type Pfp struct {
 	Binary primitive.Binary   `bson:"binary"`
 }
 
+// An archive of a users personal data, the archive itself is written to the exporters directory
+type DataExport struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Uid       primitive.ObjectID `bson:"uid" json:"-"`
+	Status    string             `bson:"status" json:"status"` // PENDING, COMPLETE or FAILED
+	Progress  float32            `bson:"progress" json:"progress"`
+	Size      int64              `bson:"size" json:"size"`
+	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
+	ExpiresAt primitive.DateTime `bson:"expires_at" json:"expires_at"` // The archive is deleted after this
+}
+
+const (
+	DataExportPending  = "PENDING"
+	DataExportComplete = "COMPLETE"
+	DataExportFailed   = "FAILED"
+)
+
+// Example content that can't be modified in sandbox mode, see the sandbox package
+type ProtectedEntity struct {
+	ID   primitive.ObjectID `bson:"_id"`
+	Kind string             `bson:"kind"` // USER, POST or ROOM
+	// The entities documents when the snapshot was taken, keyed by collection name
+	Documents map[string]bson.Raw `bson:"documents,omitempty"`
+}
+
+const (
+	ProtectedUser = "USER"
+	ProtectedPost = "POST"
+	ProtectedRoom = "ROOM"
+)
+
+// Removes everything tied to a deleted user, see the deletion package. The ID is the deleted users ID.
+type DeletionJob struct {
+	ID         primitive.ObjectID `bson:"_id" json:"ID"`
+	Status     string             `bson:"status" json:"status"` // PENDING, RUNNING, COMPLETE or FAILED
+	Step       int                `bson:"step" json:"step"`     // The next step to run
+	Attempts   int                `bson:"attempts" json:"-"`
+	LeaseUntil primitive.DateTime `bson:"lease_until" json:"-"` // Other runners leave the job alone until this, also used for retry backoff
+	Error      string             `bson:"error" json:"-"`
+	CreatedAt  primitive.DateTime `bson:"created_at" json:"created_at"`
+	UpdatedAt  primitive.DateTime `bson:"updated_at" json:"updated_at"`
+}
+
+const (
+	DeletionJobPending  = "PENDING"
+	DeletionJobRunning  = "RUNNING"
+	DeletionJobComplete = "COMPLETE"
+	DeletionJobFailed   = "FAILED"
+)
+
+// The resume token of a change stream watcher, see the changestreams package. The ID is the watchers name.
+type ChangeStreamToken struct {
+	ID        string             `bson:"_id"`
+	Token     bson.Raw           `bson:"token"`
+	UpdatedAt primitive.DateTime `bson:"updated_at"`
+}
+
+// Each device the user logs in on has its own session
 type Session struct {
-	UID       primitive.ObjectID `bson:"_uid"` // I dont know why i put an underscore here but it doesn't matter
-	ExpiresAt primitive.DateTime `bson:"exp"`
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	UID       primitive.ObjectID `bson:"_uid" json:"-"` // I dont know why i put an underscore here but it doesn't matter
+	ExpiresAt primitive.DateTime `bson:"exp" json:"expires_at"`
+	UserAgent string             `bson:"user_agent" json:"user_agent"`
+	IP        string             `bson:"ip" json:"ip"`
+	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
+	LastUsed  primitive.DateTime `bson:"last_used" json:"last_used"`
+	IsCurrent bool               `bson:"-" json:"current"` // True for the session the request was made with
+	// Hashes of the refresh tokens, see helpers for how they are used
+	RefreshHash  string             `bson:"refresh_hash" json:"-"`
+	PreviousHash string             `bson:"previous_hash" json:"-"`
+	UsedHashes   []string           `bson:"used_hashes" json:"-"`
+	RotatedAt    primitive.DateTime `bson:"rotated_at" json:"-"`
 }
 
 type PrivateMessage struct {
@@ -78,6 +207,35 @@ type RoomMessage struct {
 	HasAttachment      bool                  `bson:"has_attachment" json:"has_attachment"`
 	AttachmentProgress AttachmentProgress    `bson:"-" json:"attachment_progress"`
 	AttachmentMetadata OutAttachmentMetadata `bson:"-" json:"attachment_metadata"`
+	Blocked            bool                  `bson:"-" json:"blocked"` // True if the user receiving the message has blocked its author
+	Mentions           []primitive.ObjectID  `bson:"mentions" json:"mentions"`
+}
+
+type GroupConversation struct {
+	ID           primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
+	Name         string               `bson:"name,maxlength=24" json:"name"`
+	Author       primitive.ObjectID   `bson:"author_id" json:"author_id"` // Only the creator can add and remove participants
+	Participants []primitive.ObjectID `bson:"participants" json:"participants"`
+	CreatedAt    primitive.DateTime   `bson:"created_at" json:"created_at"`
+	UpdatedAt    primitive.DateTime   `bson:"updated_at" json:"updated_at"`
+	Messages     []GroupMessage       `bson:"-" json:"messages,omitempty"`
+}
+
+// Group messages are stored in a seperate collection, using the same ID as the group conversation
+type GroupMessages struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Messages []GroupMessage     `bson:"messages" json:"messages"`
+}
+
+type GroupMessage struct {
+	ID                 primitive.ObjectID    `bson:"_id,omitempty" json:"ID"`
+	Content            string                `bson:"content,maxlength=200" json:"content"`
+	Uid                primitive.ObjectID    `bson:"uid" json:"uid"`
+	CreatedAt          primitive.DateTime    `bson:"created_at" json:"created_at"`
+	UpdatedAt          primitive.DateTime    `bson:"updated_at" json:"updated_at"`
+	HasAttachment      bool                  `bson:"has_attachment" json:"has_attachment"`
+	AttachmentProgress AttachmentProgress    `bson:"-" json:"attachment_progress"`
+	AttachmentMetadata OutAttachmentMetadata `bson:"-" json:"attachment_metadata"`
 }
 
 type AttachmentMetadata struct {
@@ -106,22 +264,24 @@ type AttachmentChunk struct {
 }
 
 type Post struct {
-	ID                primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
-	Author            primitive.ObjectID `bson:"author_id" json:"author_id"`
-	CreatedAt         primitive.DateTime `bson:"created_at" json:"created_at"`
-	UpdatedAt         primitive.DateTime `bson:"updated_at" json:"updated_at"`
-	Slug              string             `bson:"slug" json:"slug"`
-	Title             string             `bson:"title" json:"title"`
-	Description       string             `bson:"description" json:"description"`
-	Body              string             `bson:"body" json:"body"`
-	ImagePending      bool               `bson:"image_pending" json:"image_pending"`
-	Tags              []string           `bson:"tags" json:"tags"`
-	ImgBlur           string             `bson:"img_blur" json:"img_blur"`
-	Comments          []PostComment      `bson:"-" json:"comments"`
-	PositiveVoteCount int                `bson:"-" json:"vote_pos_count"`  // The vote count is sent to the client (excluding the users own vote)
-	NegativeVoteCount int                `bson:"-" json:"vote_neg_count"`  // The vote count is sent to the client (excluding the users own vote)
-	UsersVote         PostVote           `bson:"-" json:"my_vote"`         // The clients own vote is sent to the client... the client checks if uid of own vote is 0000000000000, to make sure that the client actually voted
-	SortVoteCount     int                `bson:"sort_vote_count" json:"-"` // Used serverside when sorting by popularity. positive vote count - negative vote count.
+	ID                primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
+	Author            primitive.ObjectID   `bson:"author_id" json:"author_id"`
+	CreatedAt         primitive.DateTime   `bson:"created_at" json:"created_at"`
+	UpdatedAt         primitive.DateTime   `bson:"updated_at" json:"updated_at"`
+	Slug              string               `bson:"slug" json:"slug"`
+	Title             string               `bson:"title" json:"title"`
+	Description       string               `bson:"description" json:"description"`
+	Body              string               `bson:"body" json:"body"`
+	ImagePending      bool                 `bson:"image_pending" json:"image_pending"`
+	Tags              []string             `bson:"tags" json:"tags"`
+	ImgBlur           string               `bson:"img_blur" json:"img_blur"`
+	Comments          []PostComment        `bson:"-" json:"comments"`
+	PositiveVoteCount int                  `bson:"-" json:"vote_pos_count"`  // The vote count is sent to the client (excluding the users own vote)
+	NegativeVoteCount int                  `bson:"-" json:"vote_neg_count"`  // The vote count is sent to the client (excluding the users own vote)
+	UsersVote         PostVote             `bson:"-" json:"my_vote"`         // The clients own vote is sent to the client... the client checks if uid of own vote is 0000000000000, to make sure that the client actually voted
+	SortVoteCount     int                  `bson:"sort_vote_count" json:"-"` // Used serverside when sorting by popularity. positive vote count - negative vote count.
+	Mentions          []primitive.ObjectID `bson:"mentions" json:"mentions"` // Users mentioned in the body
+	Hidden            bool                 `bson:"hidden" json:"-"`          // True while the authors account is soft deleted
 }
 
 type PostVotes struct {
@@ -157,15 +317,16 @@ type PostCommentVote struct {
 }
 
 type PostComment struct {
-	ID                primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
-	Author            primitive.ObjectID `bson:"author_id" json:"author_id"`
-	Content           string             `bson:"content" json:"content"`
-	CreatedAt         primitive.DateTime `bson:"created_at" json:"created_at"`
-	UpdatedAt         primitive.DateTime `bson:"updated_at" json:"updated_at"`
-	ParentID          string             `bson:"parent_id" json:"parent_id"`
-	PositiveVoteCount int                `bson:"-" json:"vote_pos_count"` // The vote count is sent to the client (excluding the users own vote)
-	NegativeVoteCount int                `bson:"-" json:"vote_neg_count"` // The vote count is sent to the client (excluding the users own vote)
-	UsersVote         PostVote           `bson:"-" json:"my_vote"`        // The clients own vote is sent to the client... the client checks if uid of own vote is 0000000000000, to make sure that the client actually voted
+	ID                primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
+	Author            primitive.ObjectID   `bson:"author_id" json:"author_id"`
+	Content           string               `bson:"content" json:"content"`
+	CreatedAt         primitive.DateTime   `bson:"created_at" json:"created_at"`
+	UpdatedAt         primitive.DateTime   `bson:"updated_at" json:"updated_at"`
+	ParentID          string               `bson:"parent_id" json:"parent_id"`
+	Mentions          []primitive.ObjectID `bson:"mentions" json:"mentions"`
+	PositiveVoteCount int                  `bson:"-" json:"vote_pos_count"` // The vote count is sent to the client (excluding the users own vote)
+	NegativeVoteCount int                  `bson:"-" json:"vote_neg_count"` // The vote count is sent to the client (excluding the users own vote)
+	UsersVote         PostVote             `bson:"-" json:"my_vote"`        // The clients own vote is sent to the client... the client checks if uid of own vote is 0000000000000, to make sure that the client actually voted
 }
 
 type Room struct {
@@ -178,19 +339,30 @@ type Room struct {
 	Messages     []RoomMessage      `bson:"-" json:"messages"`
 	ImagePending bool               `bson:"image_pending" json:"image_pending"`
 	Private      bool               `bson:"private" json:"private"`
+	SlowMode     int                `bson:"slow_mode" json:"slow_mode"` // (seconds) Minimum time between messages from the same user, 0 if disabled
+	Hidden       bool               `bson:"hidden" json:"-"`            // True while the authors account is soft deleted
 	// If the room is private and the user is not a member, or if the user is banned this will be sent back as false
 	CanAccess bool `bson:"-" json:"can_access"`
+	// True if the user is the rooms author or one of its moderators
+	CanModerate  bool                 `bson:"-" json:"can_moderate"`
+	Pinned       []primitive.ObjectID `bson:"-" json:"pinned"`
+	Announcement string               `bson:"-" json:"announcement"`
 }
+
+// Pinned messages and the announcement are kept with the messages so that they are only sent to users that can access the room
 type RoomMessages struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
-	Messages []RoomMessage      `bson:"messages" json:"messages"`
+	ID           primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
+	Messages     []RoomMessage        `bson:"messages" json:"messages"`
+	Pinned       []primitive.ObjectID `bson:"pinned" json:"pinned"`
+	Announcement string               `bson:"announcement" json:"announcement"`
 }
 
 // A RoomPrivateData document will exist for rooms even if they aren't private
 type RoomPrivateData struct {
-	ID      primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
-	Members []primitive.ObjectID `bson:"members" json:"members"`
-	Banned  []primitive.ObjectID `bson:"banned" json:"banned"`
+	ID         primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
+	Members    []primitive.ObjectID `bson:"members" json:"members"`
+	Banned     []primitive.ObjectID `bson:"banned" json:"banned"`
+	Moderators []primitive.ObjectID `bson:"moderators" json:"moderators"`
 }
 
 type RoomImage struct {
@@ -0,0 +1,709 @@
+package deletion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/maps"
+)
+
+var log = logger.New("deletion")
+
+/*
+	Account deletion. Deleting an account soft deletes it, the users posts and rooms are
+	hidden and they can't log in unless they restore the account, which they can do
+	until the grace period is up. After that the account is purged, which queues a
+	deletion job, stored in the deletion_jobs collection under the users ID. The runner
+	picks up jobs and works through the steps below, removing or anonymizing everything
+	tied to the user.
+
+	Each step runs in a transaction along with the update that moves the job on to
+	the next step, so if the server stops the job carries on from where it was.
+	Steps only ever remove things belonging to the user, so running a step twice
+	does nothing the second time. Comments by the user on other users posts are
+	anonymized instead of removed so that the replies to them are kept.
+
+	Transactions need a replica set, which change streams need anyway.
+
+	The grace period is set in the config package.
+	New accounts are only purged for their age in sandbox mode, see the sandbox package.
+*/
+
+const (
+	pollInterval = time.Second * 5
+	leaseLength  = time.Minute * 2 // A job running longer than this is assumed to have been abandoned
+	maxAttempts  = 10
+)
+
+type Policy struct {
+	GracePeriod        time.Duration
+	NewAccountLifetime time.Duration                   // 0 if new accounts are kept
+	Protected          map[primitive.ObjectID]struct{} // Never purged because of their age
+}
+
+func NewPolicy(cfg config.Deletion) Policy {
+	return Policy{GracePeriod: cfg.GracePeriod}
+}
+
+/*--------------- SOFT DELETION ---------------*/
+
+// Marks the account as deleted and hides the users posts and rooms. Returns when the account will be purged.
+func SoftDelete(ctx context.Context, colls *db.Collections, uid primitive.ObjectID, policy Policy) (time.Time, error) {
+	now := time.Now()
+	purgeAt := now.Add(policy.GracePeriod)
+	err := withTransaction(ctx, colls, func(sc mongo.SessionContext) error {
+		res, err := colls.UserCollection.UpdateOne(sc, bson.M{"_id": uid, "deleted_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{
+			"deleted_at": primitive.NewDateTimeFromTime(now),
+			"purge_at":   primitive.NewDateTimeFromTime(purgeAt),
+		}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		return setContentHidden(sc, colls, uid, true)
+	})
+	return purgeAt, err
+}
+
+// Undoes SoftDelete, returns false if the account isn't deleted or can no longer be restored
+func Restore(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) (bool, error) {
+	restored := false
+	err := withTransaction(ctx, colls, func(sc mongo.SessionContext) error {
+		res, err := colls.UserCollection.UpdateOne(sc, bson.M{
+			"_id":      uid,
+			"purge_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+		}, bson.M{"$unset": bson.M{"deleted_at": "", "purge_at": ""}})
+		if err != nil {
+			return err
+		}
+		if restored = res.ModifiedCount > 0; !restored {
+			return nil
+		}
+		return setContentHidden(sc, colls, uid, false)
+	})
+	return restored, err
+}
+
+func setContentHidden(ctx context.Context, colls *db.Collections, uid primitive.ObjectID, hidden bool) error {
+	if _, err := colls.PostCollection.UpdateMany(ctx, bson.M{"author_id": uid}, bson.M{"$set": bson.M{"hidden": hidden}}); err != nil {
+		return err
+	}
+	_, err := colls.RoomCollection.UpdateMany(ctx, bson.M{"author_id": uid}, bson.M{"$set": bson.M{"hidden": hidden}})
+	return err
+}
+
+func withTransaction(ctx context.Context, colls *db.Collections, fn func(sc mongo.SessionContext) error) error {
+	session, err := colls.UserCollection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+type step struct {
+	name string
+	run  func(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error
+}
+
+var steps = []step{
+	{"user", deleteUser},
+	{"inbox", deleteInbox},
+	{"sent_messages", deleteSentMessages},
+	{"posts", deletePosts},
+	{"comments", anonymizeComments},
+	{"votes", deleteVotes},
+	{"rooms", deleteRooms},
+	{"room_messages", deleteRoomMessages},
+	{"room_memberships", deleteRoomMemberships},
+	{"groups", deleteGroups},
+	{"mentions", deleteMentions},
+	{"blocks", deleteBlocks},
+	{"notifications", deleteNotificationsByUser},
+}
+
+// The number of steps in a job, for the status endpoint
+func StepCount() int {
+	return len(steps)
+}
+
+// Queues the deletion of everything tied to the user. Queuing a user twice is harmless,
+// a failed job is retried from the step it failed on.
+func Enqueue(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	_, err := colls.DeletionJobCollection.UpdateOne(ctx, bson.M{
+		"_id":    uid,
+		"status": bson.M{"$ne": models.DeletionJobRunning},
+	}, bson.M{
+		"$set": bson.M{
+			"status":      models.DeletionJobPending,
+			"attempts":    0,
+			"lease_until": now,
+			"updated_at":  now,
+		},
+		"$setOnInsert": bson.M{
+			"step":       0,
+			"error":      "",
+			"created_at": now,
+		},
+	}, options.Update().SetUpsert(true))
+	// The job exists and is running
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+/*--------------- RUNNER ---------------*/
+
+// Polls for jobs to run, and queues accounts to be purged every minute, until the context is
+// cancelled. Jobs are leased, so a job cut off by the server stopping is picked up again later.
+func Run(ctx context.Context, colls *db.Collections, policy Policy) {
+	purgeTicker := time.NewTicker(time.Minute)
+	go func() {
+		defer purgeTicker.Stop()
+		for {
+			select {
+			case <-purgeTicker.C:
+				if err := queuePurges(context.Background(), colls, policy); err != nil {
+					log.Error("Failed to queue account purges", err, nil)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			for ctx.Err() == nil {
+				job, err := claim(context.Background(), colls)
+				if err != nil {
+					if err != mongo.ErrNoDocuments {
+						log.Error("Failed to claim deletion job", err, nil)
+					}
+					break
+				}
+				if err := runJob(context.Background(), mongoStore{colls}, steps, job); err != nil {
+					log.Error("Deletion job failed", err, logger.Fields{"job": job.ID.Hex(), "step": job.Step})
+				}
+			}
+		}
+	}()
+}
+
+// Queues soft deleted accounts past their grace period, and new accounts past their lifetime
+func queuePurges(ctx context.Context, colls *db.Collections, policy Policy) error {
+	now := time.Now()
+	filter := bson.M{"purge_at": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}}
+	if policy.NewAccountLifetime > 0 {
+		filter = bson.M{"$or": bson.A{
+			filter,
+			bson.M{
+				"created_at": bson.M{"$lt": primitive.NewDateTimeFromTime(now.Add(-policy.NewAccountLifetime))},
+				"_id":        bson.M{"$nin": maps.Keys(policy.Protected)},
+			},
+		}}
+	}
+	cursor, err := colls.UserCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		if err := Enqueue(ctx, colls, user.ID); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Takes the lease on the next job that is waiting, or running with an expired lease
+func claim(ctx context.Context, colls *db.Collections) (*models.DeletionJob, error) {
+	now := time.Now()
+	job := &models.DeletionJob{}
+	err := colls.DeletionJobCollection.FindOneAndUpdate(ctx, bson.M{
+		"status":      bson.M{"$in": bson.A{models.DeletionJobPending, models.DeletionJobRunning}},
+		"lease_until": bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+	}, bson.M{
+		"$set": bson.M{
+			"status":      models.DeletionJobRunning,
+			"lease_until": primitive.NewDateTimeFromTime(now.Add(leaseLength)),
+			"updated_at":  primitive.NewDateTimeFromTime(now),
+		},
+		"$inc": bson.M{"attempts": 1},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.M{"created_at": 1}).
+		SetReturnDocument(options.After)).Decode(job)
+	return job, err
+}
+
+// How the runner commits its progress. mongoStore is the real one, the tests use a fake
+// so that the runner can be tested without MongoDB.
+type jobStore interface {
+	// Runs the step and moves the job on to the next one, atomically. Returns errLeaseLost,
+	// without keeping anything the step did, if the job isn't at that step any more.
+	commitStep(ctx context.Context, job *models.DeletionJob, s step) error
+	complete(ctx context.Context, job *models.DeletionJob) error
+	fail(ctx context.Context, job *models.DeletionJob, err error)
+}
+
+var errLeaseLost = errors.New("Job was moved on by another runner")
+
+// Runs the job from its current step. If the lease was lost the job is left alone, the runner
+// that has it now carries on with it.
+func runJob(ctx context.Context, store jobStore, steps []step, job *models.DeletionJob) error {
+	for job.Step < len(steps) {
+		s := steps[job.Step]
+		if err := store.commitStep(ctx, job, s); err != nil {
+			if !errors.Is(err, errLeaseLost) {
+				store.fail(ctx, job, fmt.Errorf("%v: %w", s.name, err))
+			}
+			return err
+		}
+		job.Step++
+	}
+	return store.complete(ctx, job)
+}
+
+type mongoStore struct {
+	colls *db.Collections
+}
+
+// The step runs in the same transaction as the update that moves the job on. The job is only
+// moved on if it is still at the step, so if the lease was lost the step is rolled back and
+// another runner can't skip ahead.
+func (m mongoStore) commitStep(ctx context.Context, job *models.DeletionJob, s step) error {
+	return withTransaction(ctx, m.colls, func(sc mongo.SessionContext) error {
+		if err := s.run(sc, m.colls, job.ID); err != nil {
+			return err
+		}
+		now := time.Now()
+		res, err := m.colls.DeletionJobCollection.UpdateOne(sc, bson.M{"_id": job.ID, "step": job.Step}, bson.M{"$set": bson.M{
+			"step":        job.Step + 1,
+			"lease_until": primitive.NewDateTimeFromTime(now.Add(leaseLength)),
+			"updated_at":  primitive.NewDateTimeFromTime(now),
+		}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return errLeaseLost
+		}
+		return nil
+	})
+}
+
+func (m mongoStore) complete(ctx context.Context, job *models.DeletionJob) error {
+	_, err := m.colls.DeletionJobCollection.UpdateOne(ctx, bson.M{"_id": job.ID, "step": job.Step}, bson.M{"$set": bson.M{
+		"status":     models.DeletionJobComplete,
+		"error":      "",
+		"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+	}})
+	return err
+}
+
+// Backs off before the job is retried, jobs that keep failing are left as FAILED
+func (m mongoStore) fail(ctx context.Context, job *models.DeletionJob, err error) {
+	status := models.DeletionJobPending
+	if job.Attempts >= maxAttempts {
+		status = models.DeletionJobFailed
+	}
+	backoff := time.Second * time.Duration(1<<job.Attempts)
+	// Only if the job is still at the step, so that a runner that lost the lease doesn't interfere
+	if _, err := m.colls.DeletionJobCollection.UpdateOne(ctx, bson.M{"_id": job.ID, "step": job.Step}, bson.M{"$set": bson.M{
+		"status":      status,
+		"error":       err.Error(),
+		"lease_until": primitive.NewDateTimeFromTime(time.Now().Add(backoff)),
+		"updated_at":  primitive.NewDateTimeFromTime(time.Now()),
+	}}); err != nil {
+		log.Error("Failed to update deletion job", err, logger.Fields{"job": job.ID.Hex(), "step": job.Step})
+	}
+}
+
+/*--------------- STEPS ---------------*/
+
+// Attachment chunks are chained together, the metadata has all the chunk IDs but
+// if the upload never finished there might only be the chain
+func deleteAttachment(ctx context.Context, colls *db.Collections, msgId primitive.ObjectID) error {
+	var metaData models.AttachmentMetadata
+	err := colls.AttachmentMetadataCollection.FindOne(ctx, bson.M{"_id": msgId}).Decode(&metaData)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	chunkIds := metaData.ChunkIDs
+	if err == mongo.ErrNoDocuments {
+		for next := msgId; next != primitive.NilObjectID; {
+			var chunk models.AttachmentChunk
+			if err := colls.AttachmentChunksCollection.FindOne(ctx, bson.M{"_id": next}, options.FindOne().SetProjection(bson.M{"next_id": 1})).Decode(&chunk); err != nil {
+				if err == mongo.ErrNoDocuments {
+					break
+				}
+				return err
+			}
+			chunkIds = append(chunkIds, chunk.ID)
+			next = chunk.NextChunk
+		}
+	}
+	if len(chunkIds) > 0 {
+		if _, err := colls.AttachmentChunksCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": chunkIds}}); err != nil {
+			return err
+		}
+	}
+	_, err = colls.AttachmentMetadataCollection.DeleteOne(ctx, bson.M{"_id": msgId})
+	return err
+}
+
+func deleteUser(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	if _, err := colls.UserCollection.DeleteOne(ctx, bson.M{"_id": uid}); err != nil {
+		return err
+	}
+	if _, err := colls.PfpCollection.DeleteOne(ctx, bson.M{"_id": uid}); err != nil {
+		return err
+	}
+	if _, err := colls.SessionCollection.DeleteMany(ctx, bson.M{"_uid": uid}); err != nil {
+		return err
+	}
+	if _, err := colls.NotificationsCollection.DeleteOne(ctx, bson.M{"_id": uid}); err != nil {
+		return err
+	}
+	// Expired exports are removed along with their archives by the exporter
+	now := primitive.NewDateTimeFromTime(time.Now())
+	_, err := colls.DataExportCollection.UpdateMany(ctx, bson.M{"uid": uid, "expires_at": bson.M{"$gt": now}}, bson.M{"$set": bson.M{"expires_at": now}})
+	return err
+}
+
+func deleteInbox(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	var inbox models.Inbox
+	if err := colls.InboxCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&inbox); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	for _, msgs := range [][]models.PrivateMessage{inbox.Messages, inbox.MessageRequests} {
+		for _, m := range msgs {
+			if m.HasAttachment {
+				if err := deleteAttachment(ctx, colls, m.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := colls.InboxCollection.DeleteOne(ctx, bson.M{"_id": uid})
+	return err
+}
+
+// Messages sent by the user are kept in the recipients inboxes
+func deleteSentMessages(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	cursor, err := colls.InboxCollection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"messages.uid": uid},
+		bson.M{"message_requests.uid": uid},
+		bson.M{"messages_sent_to": uid},
+		bson.M{"accepted_requests_from": uid},
+		bson.M{"declined_requests_from": uid},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var inbox models.Inbox
+		if err := cursor.Decode(&inbox); err != nil {
+			return err
+		}
+		for _, msgs := range [][]models.PrivateMessage{inbox.Messages, inbox.MessageRequests} {
+			for _, m := range msgs {
+				if m.Uid == uid && m.HasAttachment {
+					if err := deleteAttachment(ctx, colls, m.ID); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if _, err := colls.InboxCollection.UpdateByID(ctx, inbox.ID, bson.M{"$pull": bson.M{
+			"messages":               bson.M{"uid": uid},
+			"message_requests":       bson.M{"uid": uid},
+			"messages_sent_to":       uid,
+			"accepted_requests_from": uid,
+			"declined_requests_from": uid,
+		}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func deletePosts(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	cursor, err := colls.PostCollection.Find(ctx, bson.M{"author_id": uid}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	ids := []primitive.ObjectID{}
+	for cursor.Next(ctx) {
+		var post models.Post
+		if err := cursor.Decode(&post); err != nil {
+			return err
+		}
+		ids = append(ids, post.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	for _, coll := range []*mongo.Collection{
+		colls.PostImageCollection,
+		colls.PostThumbCollection,
+		colls.PostVoteCollection,
+		colls.PostCommentsCollection,
+		colls.PostCollection,
+	} {
+		if _, err := coll.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func anonymizeComments(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	_, err := colls.PostCommentsCollection.UpdateMany(ctx, bson.M{"comments.author_id": uid}, bson.M{"$set": bson.M{
+		"comments.$[c].author_id": primitive.NilObjectID,
+		"comments.$[c].content":   "[deleted]",
+		"comments.$[c].mentions":  []primitive.ObjectID{},
+	}}, options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"c.author_id": uid}},
+	}))
+	return err
+}
+
+// Post votes are counted into the posts sort_vote_count, so that is corrected too
+func deleteVotes(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	cursor, err := colls.PostVoteCollection.Find(ctx, bson.M{"votes.uid": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var votes models.PostVotes
+		if err := cursor.Decode(&votes); err != nil {
+			return err
+		}
+		change := 0
+		for _, v := range votes.Votes {
+			if v.Uid == uid {
+				if v.IsUpvote {
+					change--
+				} else {
+					change++
+				}
+			}
+		}
+		if _, err := colls.PostVoteCollection.UpdateByID(ctx, votes.ID, bson.M{"$pull": bson.M{"votes": bson.M{"uid": uid}}}); err != nil {
+			return err
+		}
+		if _, err := colls.PostCollection.UpdateByID(ctx, votes.ID, bson.M{"$inc": bson.M{"sort_vote_count": change}}); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	_, err = colls.PostCommentsCollection.UpdateMany(ctx, bson.M{"votes.uid": uid}, bson.M{"$pull": bson.M{"votes": bson.M{"uid": uid}}})
+	return err
+}
+
+func deleteRooms(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	cursor, err := colls.RoomCollection.Find(ctx, bson.M{"author_id": uid}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	ids := []primitive.ObjectID{}
+	for cursor.Next(ctx) {
+		var room models.Room
+		if err := cursor.Decode(&room); err != nil {
+			return err
+		}
+		ids = append(ids, room.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var roomMsgs models.RoomMessages
+		if err := colls.RoomMessagesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&roomMsgs); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		for _, m := range roomMsgs.Messages {
+			if m.HasAttachment {
+				if err := deleteAttachment(ctx, colls, m.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	for _, coll := range []*mongo.Collection{
+		colls.RoomMessagesCollection,
+		colls.RoomImageCollection,
+		colls.RoomPrivateDataCollection,
+		colls.RoomCollection,
+	} {
+		if _, err := coll.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteRoomMessages(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	cursor, err := colls.RoomMessagesCollection.Find(ctx, bson.M{"messages.uid": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var roomMsgs models.RoomMessages
+		if err := cursor.Decode(&roomMsgs); err != nil {
+			return err
+		}
+		msgIds := []primitive.ObjectID{}
+		for _, m := range roomMsgs.Messages {
+			if m.Uid != uid {
+				continue
+			}
+			msgIds = append(msgIds, m.ID)
+			if m.HasAttachment {
+				if err := deleteAttachment(ctx, colls, m.ID); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := colls.RoomMessagesCollection.UpdateByID(ctx, roomMsgs.ID, bson.M{"$pull": bson.M{
+			"messages": bson.M{"uid": uid},
+			"pinned":   bson.M{"$in": msgIds},
+		}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func deleteRoomMemberships(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	_, err := colls.RoomPrivateDataCollection.UpdateMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"members": uid},
+		bson.M{"banned": uid},
+		bson.M{"moderators": uid},
+	}}, bson.M{"$pull": bson.M{
+		"members":    uid,
+		"banned":     uid,
+		"moderators": uid,
+	}})
+	return err
+}
+
+// Groups the user created are deleted, the user is removed from the rest along with their messages
+func deleteGroups(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	cursor, err := colls.GroupConversationCollection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"author_id": uid},
+		bson.M{"participants": uid},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var group models.GroupConversation
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		isAuthor := group.Author == uid
+		var groupMsgs models.GroupMessages
+		if err := colls.GroupMessagesCollection.FindOne(ctx, bson.M{"_id": group.ID}).Decode(&groupMsgs); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		for _, m := range groupMsgs.Messages {
+			if m.HasAttachment && (isAuthor || m.Uid == uid) {
+				if err := deleteAttachment(ctx, colls, m.ID); err != nil {
+					return err
+				}
+			}
+		}
+		if isAuthor {
+			if _, err := colls.GroupMessagesCollection.DeleteOne(ctx, bson.M{"_id": group.ID}); err != nil {
+				return err
+			}
+			if _, err := colls.GroupConversationCollection.DeleteOne(ctx, bson.M{"_id": group.ID}); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := colls.GroupMessagesCollection.UpdateByID(ctx, group.ID, bson.M{"$pull": bson.M{"messages": bson.M{"uid": uid}}}); err != nil {
+			return err
+		}
+		if _, err := colls.GroupConversationCollection.UpdateByID(ctx, group.ID, bson.M{"$pull": bson.M{"participants": uid}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func deleteMentions(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	if _, err := colls.PostCollection.UpdateMany(ctx, bson.M{"mentions": uid}, bson.M{"$pull": bson.M{"mentions": uid}}); err != nil {
+		return err
+	}
+	// Only elements that mention the user are updated, older elements might not have a mentions array
+	if _, err := colls.PostCommentsCollection.UpdateMany(ctx, bson.M{"comments.mentions": uid}, bson.M{"$pull": bson.M{"comments.$[c].mentions": uid}}, options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"c.mentions": uid}},
+	})); err != nil {
+		return err
+	}
+	_, err := colls.RoomMessagesCollection.UpdateMany(ctx, bson.M{"messages.mentions": uid}, bson.M{"$pull": bson.M{"messages.$[m].mentions": uid}}, options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"m.mentions": uid}},
+	}))
+	return err
+}
+
+func deleteBlocks(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	_, err := colls.UserCollection.UpdateMany(ctx, bson.M{"blocked": uid}, bson.M{"$pull": bson.M{"blocked": uid}})
+	return err
+}
+
+// Notifications other users got because of something the user did
+func deleteNotificationsByUser(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+	_, err := colls.NotificationsCollection.UpdateMany(ctx, bson.M{"notifications.actor": uid}, bson.M{"$pull": bson.M{"notifications": bson.M{"actor": uid}}})
+	return err
+}
@@ -0,0 +1,459 @@
+package deletion
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*--------------- RUNNER ---------------*/
+
+// Works like mongoStore. The step runs first and what it did is only kept if the job is still
+// at the step, a step that fails or loses the lease is "rolled back" by not being recorded.
+type fakeStore struct {
+	step      int      // The step the stored job is at
+	committed []string // Steps that were kept, in order
+	failed    error
+	completed bool
+}
+
+func (f *fakeStore) commitStep(ctx context.Context, job *models.DeletionJob, s step) error {
+	if err := s.run(ctx, nil, job.ID); err != nil {
+		return err
+	}
+	if f.step != job.Step {
+		return errLeaseLost
+	}
+	f.step++
+	f.committed = append(f.committed, s.name)
+	return nil
+}
+
+func (f *fakeStore) complete(ctx context.Context, job *models.DeletionJob) error {
+	if f.step == job.Step {
+		f.completed = true
+	}
+	return nil
+}
+
+func (f *fakeStore) fail(ctx context.Context, job *models.DeletionJob, err error) {
+	if f.step == job.Step {
+		f.failed = err
+	}
+}
+
+// Steps that count how many times they were run
+func countingSteps(names ...string) ([]step, map[string]int) {
+	runs := map[string]int{}
+	out := []step{}
+	for _, name := range names {
+		name := name
+		out = append(out, step{name, func(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+			runs[name]++
+			return nil
+		}})
+	}
+	return out, runs
+}
+
+func TestRunJobRunsEveryStep(t *testing.T) {
+	steps, runs := countingSteps("a", "b", "c")
+	store := &fakeStore{}
+	job := &models.DeletionJob{ID: primitive.NewObjectID()}
+
+	if err := runJob(context.Background(), store, steps, job); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(store.committed, []string{"a", "b", "c"}) {
+		t.Errorf("committed %v", store.committed)
+	}
+	if !store.completed || store.failed != nil {
+		t.Errorf("completed %v, failed %v", store.completed, store.failed)
+	}
+	for name, n := range runs {
+		if n != 1 {
+			t.Errorf("%v ran %v times", name, n)
+		}
+	}
+}
+
+func TestRunJobResumesFromSavedStep(t *testing.T) {
+	steps, runs := countingSteps("a", "b", "c", "d")
+	store := &fakeStore{step: 2}
+	job := &models.DeletionJob{ID: primitive.NewObjectID(), Step: 2}
+
+	if err := runJob(context.Background(), store, steps, job); err != nil {
+		t.Fatal(err)
+	}
+	if runs["a"] != 0 || runs["b"] != 0 {
+		t.Errorf("steps before the saved step were run again: %v", runs)
+	}
+	if !reflect.DeepEqual(store.committed, []string{"c", "d"}) {
+		t.Errorf("committed %v", store.committed)
+	}
+	if !store.completed || store.step != 4 {
+		t.Errorf("completed %v at step %v", store.completed, store.step)
+	}
+}
+
+func TestRunJobFailedStepIsRetried(t *testing.T) {
+	broken := true
+	steps, runs := countingSteps("a", "b", "c")
+	steps[1].run = func(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+		runs["b"]++
+		if broken {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	store := &fakeStore{}
+	job := &models.DeletionJob{ID: primitive.NewObjectID()}
+
+	if err := runJob(context.Background(), store, steps, job); err == nil {
+		t.Fatal("expected the failing step to stop the job")
+	}
+	if store.failed == nil || !strings.HasPrefix(store.failed.Error(), "b: ") {
+		t.Errorf("expected the failure to name the step, got %v", store.failed)
+	}
+	if store.completed || store.step != 1 || runs["c"] != 0 {
+		t.Errorf("job moved past the failed step: completed %v, step %v, runs %v", store.completed, store.step, runs)
+	}
+
+	// Claiming the job again hands it over at the step it failed on
+	broken = false
+	store.failed = nil
+	job = &models.DeletionJob{ID: job.ID, Step: store.step}
+	if err := runJob(context.Background(), store, steps, job); err != nil {
+		t.Fatal(err)
+	}
+	if runs["a"] != 1 || runs["b"] != 2 || runs["c"] != 1 {
+		t.Errorf("unexpected runs %v", runs)
+	}
+	if !store.completed {
+		t.Error("job wasn't completed")
+	}
+}
+
+// A runner whose lease expired picks the job back up after another runner already moved it on
+func TestRunJobStaleRunnerCannotSkipAhead(t *testing.T) {
+	steps, runs := countingSteps("a", "b", "c", "d")
+	store := &fakeStore{step: 3}
+	stale := &models.DeletionJob{ID: primitive.NewObjectID(), Step: 1}
+
+	err := runJob(context.Background(), store, steps, stale)
+	if !errors.Is(err, errLeaseLost) {
+		t.Fatalf("expected errLeaseLost, got %v", err)
+	}
+	if store.step != 3 || len(store.committed) != 0 {
+		t.Errorf("stale runner moved the job to step %v, committed %v", store.step, store.committed)
+	}
+	if runs["c"] != 0 || runs["d"] != 0 {
+		t.Errorf("stale runner carried on past the step it lost: %v", runs)
+	}
+	if store.failed != nil || store.completed {
+		t.Errorf("stale runner changed the job status: failed %v, completed %v", store.failed, store.completed)
+	}
+}
+
+// The lease is lost while a step is running, the other runner commits the same step first
+func TestRunJobLeaseLostDuringStep(t *testing.T) {
+	steps, runs := countingSteps("a", "b", "c")
+	store := &fakeStore{}
+	steps[1].run = func(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+		runs["b"]++
+		if runs["b"] == 1 {
+			store.step++
+			store.committed = append(store.committed, "b (other runner)")
+		}
+		return nil
+	}
+	job := &models.DeletionJob{ID: primitive.NewObjectID()}
+
+	if err := runJob(context.Background(), store, steps, job); !errors.Is(err, errLeaseLost) {
+		t.Fatalf("expected errLeaseLost, got %v", err)
+	}
+	if !reflect.DeepEqual(store.committed, []string{"a", "b (other runner)"}) {
+		t.Errorf("committed %v", store.committed)
+	}
+	if runs["c"] != 0 || store.completed || store.failed != nil {
+		t.Errorf("runner carried on after losing the lease: runs %v, completed %v, failed %v", runs, store.completed, store.failed)
+	}
+}
+
+/*--------------- MONGODB ---------------*/
+
+// The steps and mongoStore need a real MongoDB replica set, for transactions. Set MONGODB_TEST_URI
+// to run these, a database is created for each test and dropped afterwards.
+func testCollections(t *testing.T) *db.Collections {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	DB, colls := db.Init(ctx, uri, "deletion_test_"+primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		cancel()
+		DB.Drop(context.Background())
+		DB.Client().Disconnect(context.Background())
+	})
+	return colls
+}
+
+func insert(t *testing.T, coll *mongo.Collection, docs ...interface{}) {
+	t.Helper()
+	if _, err := coll.InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Everything the steps touch, for the user being deleted and for another user
+func seed(t *testing.T, colls *db.Collections, uid, other primitive.ObjectID) {
+	t.Helper()
+	now := primitive.NewDateTimeFromTime(time.Now())
+	later := primitive.NewDateTimeFromTime(time.Now().Add(time.Hour))
+	ownPost, otherPost := primitive.NewObjectID(), primitive.NewObjectID()
+	ownRoom, otherRoom := primitive.NewObjectID(), primitive.NewObjectID()
+	ownGroup, otherGroup := primitive.NewObjectID(), primitive.NewObjectID()
+	sentMsg, roomMsg := primitive.NewObjectID(), primitive.NewObjectID()
+	chunk := primitive.NewObjectID()
+
+	insert(t, colls.UserCollection,
+		bson.M{"_id": uid, "username": "deleted", "blocked": bson.A{}},
+		bson.M{"_id": other, "username": "other", "blocked": bson.A{uid}})
+	insert(t, colls.PfpCollection, bson.M{"_id": uid}, bson.M{"_id": other})
+	insert(t, colls.SessionCollection, bson.M{"_uid": uid, "exp": later}, bson.M{"_uid": other, "exp": later})
+	insert(t, colls.DataExportCollection, bson.M{"uid": uid, "expires_at": later})
+	insert(t, colls.NotificationsCollection,
+		bson.M{"_id": uid, "notifications": bson.A{}},
+		bson.M{"_id": other, "notifications": bson.A{bson.M{"actor": uid, "created_at": now}, bson.M{"actor": other, "created_at": now}}})
+	insert(t, colls.InboxCollection,
+		bson.M{"_id": uid, "messages": bson.A{}, "message_requests": bson.A{}, "messages_sent_to": bson.A{other}},
+		bson.M{"_id": other,
+			"messages":         bson.A{bson.M{"_id": sentMsg, "uid": uid, "has_attachment": true}, bson.M{"_id": primitive.NewObjectID(), "uid": other}},
+			"message_requests": bson.A{}, "messages_sent_to": bson.A{uid}, "accepted_requests_from": bson.A{uid}})
+	insert(t, colls.AttachmentMetadataCollection, bson.M{"_id": sentMsg, "chunk_ids": bson.A{sentMsg, chunk}})
+	insert(t, colls.AttachmentChunksCollection,
+		bson.M{"_id": sentMsg, "next_id": chunk},
+		bson.M{"_id": chunk, "next_id": primitive.NilObjectID},
+		// Only the chain is left from an upload that never finished
+		bson.M{"_id": roomMsg, "next_id": primitive.NilObjectID})
+
+	insert(t, colls.PostCollection,
+		bson.M{"_id": ownPost, "author_id": uid, "mentions": bson.A{}},
+		bson.M{"_id": otherPost, "author_id": other, "mentions": bson.A{uid}, "sort_vote_count": 1})
+	insert(t, colls.PostImageCollection, bson.M{"_id": ownPost}, bson.M{"_id": otherPost})
+	insert(t, colls.PostThumbCollection, bson.M{"_id": ownPost}, bson.M{"_id": otherPost})
+	insert(t, colls.PostVoteCollection,
+		bson.M{"_id": ownPost, "votes": bson.A{}},
+		bson.M{"_id": otherPost, "votes": bson.A{bson.M{"uid": uid, "is_upvote": true}}})
+	insert(t, colls.PostCommentsCollection,
+		bson.M{"_id": ownPost, "comments": bson.A{}, "votes": bson.A{}},
+		bson.M{"_id": otherPost,
+			"comments": bson.A{
+				bson.M{"_id": primitive.NewObjectID(), "author_id": uid, "content": "hello", "mentions": bson.A{other}},
+				bson.M{"_id": primitive.NewObjectID(), "author_id": other, "content": "hi", "mentions": bson.A{uid}},
+			},
+			"votes": bson.A{bson.M{"uid": uid, "is_upvote": false}}})
+
+	insert(t, colls.RoomCollection,
+		bson.M{"_id": ownRoom, "author_id": uid},
+		bson.M{"_id": otherRoom, "author_id": other})
+	insert(t, colls.RoomImageCollection, bson.M{"_id": ownRoom}, bson.M{"_id": otherRoom})
+	insert(t, colls.RoomPrivateDataCollection,
+		bson.M{"_id": ownRoom, "members": bson.A{other}, "banned": bson.A{}, "moderators": bson.A{}},
+		bson.M{"_id": otherRoom, "members": bson.A{uid}, "banned": bson.A{}, "moderators": bson.A{uid}})
+	insert(t, colls.RoomMessagesCollection,
+		bson.M{"_id": ownRoom, "messages": bson.A{}, "pinned": bson.A{}},
+		bson.M{"_id": otherRoom,
+			"messages": bson.A{
+				bson.M{"_id": roomMsg, "uid": uid, "has_attachment": true, "mentions": bson.A{}},
+				bson.M{"_id": primitive.NewObjectID(), "uid": other, "mentions": bson.A{uid}},
+			},
+			"pinned": bson.A{roomMsg}})
+
+	insert(t, colls.GroupConversationCollection,
+		bson.M{"_id": ownGroup, "author_id": uid, "participants": bson.A{uid, other}},
+		bson.M{"_id": otherGroup, "author_id": other, "participants": bson.A{other, uid}})
+	insert(t, colls.GroupMessagesCollection,
+		bson.M{"_id": ownGroup, "messages": bson.A{bson.M{"_id": primitive.NewObjectID(), "uid": other}}},
+		bson.M{"_id": otherGroup, "messages": bson.A{bson.M{"_id": primitive.NewObjectID(), "uid": uid}, bson.M{"_id": primitive.NewObjectID(), "uid": other}}})
+}
+
+// Every document in the collections the steps touch, as extended JSON
+func snapshot(t *testing.T, colls *db.Collections) map[string][]string {
+	t.Helper()
+	out := map[string][]string{}
+	for _, coll := range []*mongo.Collection{
+		colls.UserCollection, colls.PfpCollection, colls.SessionCollection, colls.DataExportCollection,
+		colls.NotificationsCollection, colls.InboxCollection, colls.AttachmentMetadataCollection,
+		colls.AttachmentChunksCollection, colls.PostCollection, colls.PostImageCollection,
+		colls.PostThumbCollection, colls.PostVoteCollection, colls.PostCommentsCollection,
+		colls.RoomCollection, colls.RoomImageCollection, colls.RoomPrivateDataCollection,
+		colls.RoomMessagesCollection, colls.GroupConversationCollection, colls.GroupMessagesCollection,
+	} {
+		cursor, err := coll.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var docs []bson.Raw
+		if err := cursor.All(context.Background(), &docs); err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range docs {
+			out[coll.Name()] = append(out[coll.Name()], doc.String())
+		}
+	}
+	return out
+}
+
+func TestStepsAreIdempotent(t *testing.T) {
+	colls := testCollections(t)
+	uid, other := primitive.NewObjectID(), primitive.NewObjectID()
+	seed(t, colls, uid, other)
+	ctx := context.Background()
+
+	for _, s := range steps {
+		if err := s.run(ctx, colls, uid); err != nil {
+			t.Fatalf("%v: %v", s.name, err)
+		}
+		before := snapshot(t, colls)
+		if err := s.run(ctx, colls, uid); err != nil {
+			t.Fatalf("%v run twice: %v", s.name, err)
+		}
+		if after := snapshot(t, colls); !reflect.DeepEqual(before, after) {
+			t.Errorf("running %v a second time changed the data\nbefore: %v\nafter: %v", s.name, before, after)
+		}
+	}
+
+	// Nothing that belonged to the user is left
+	for name, docs := range snapshot(t, colls) {
+		for _, doc := range docs {
+			if strings.Contains(doc, uid.Hex()) {
+				t.Errorf("%v still references the user: %v", name, doc)
+			}
+		}
+	}
+}
+
+func testJob(t *testing.T, colls *db.Collections, uid primitive.ObjectID) *models.DeletionJob {
+	t.Helper()
+	if err := Enqueue(context.Background(), colls, uid); err != nil {
+		t.Fatal(err)
+	}
+	job, err := claim(context.Background(), colls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func storedJob(t *testing.T, colls *db.Collections, uid primitive.ObjectID) *models.DeletionJob {
+	t.Helper()
+	job := &models.DeletionJob{}
+	if err := colls.DeletionJobCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestMongoStoreResumesFromSavedStep(t *testing.T) {
+	colls := testCollections(t)
+	uid, other := primitive.NewObjectID(), primitive.NewObjectID()
+	seed(t, colls, uid, other)
+	job := testJob(t, colls, uid)
+	store := mongoStore{colls}
+
+	// The first runner stops after three steps, the job is handed to the next one from there
+	for _, s := range steps[:3] {
+		if err := store.commitStep(context.Background(), job, s); err != nil {
+			t.Fatal(err)
+		}
+		job.Step++
+	}
+	if _, err := colls.DeletionJobCollection.UpdateByID(context.Background(), uid, bson.M{"$set": bson.M{"lease_until": primitive.NewDateTimeFromTime(time.Now())}}); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := claim(context.Background(), colls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Step != 3 {
+		t.Fatalf("job resumed at step %v, want 3", resumed.Step)
+	}
+
+	ran := []string{}
+	wrapped := make([]step, len(steps))
+	for i, s := range steps {
+		s := s
+		wrapped[i] = step{s.name, func(ctx context.Context, colls *db.Collections, uid primitive.ObjectID) error {
+			ran = append(ran, s.name)
+			return s.run(ctx, colls, uid)
+		}}
+	}
+	if err := runJob(context.Background(), store, wrapped, resumed); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) == 0 || ran[0] != steps[3].name || len(ran) != len(steps)-3 {
+		t.Errorf("resumed job ran %v", ran)
+	}
+	if stored := storedJob(t, colls, uid); stored.Status != models.DeletionJobComplete || stored.Step != len(steps) {
+		t.Errorf("job ended as %v at step %v", stored.Status, stored.Step)
+	}
+}
+
+func TestMongoStoreStaleRunnerCannotSkipAhead(t *testing.T) {
+	colls := testCollections(t)
+	uid, other := primitive.NewObjectID(), primitive.NewObjectID()
+	seed(t, colls, uid, other)
+	job := testJob(t, colls, uid)
+	store := mongoStore{colls}
+
+	// The lease expires and another runner takes the job and moves it on
+	stale := *job
+	if _, err := colls.DeletionJobCollection.UpdateByID(context.Background(), uid, bson.M{"$set": bson.M{"lease_until": primitive.NewDateTimeFromTime(time.Now())}}); err != nil {
+		t.Fatal(err)
+	}
+	current, err := claim(context.Background(), colls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range steps[:2] {
+		if err := store.commitStep(context.Background(), current, s); err != nil {
+			t.Fatal(err)
+		}
+		current.Step++
+	}
+
+	// The stale runner still thinks the job is at step 0. Nothing it does is kept.
+	before := snapshot(t, colls)
+	if err := runJob(context.Background(), store, steps, &stale); !errors.Is(err, errLeaseLost) {
+		t.Fatalf("expected errLeaseLost, got %v", err)
+	}
+	if after := snapshot(t, colls); !reflect.DeepEqual(before, after) {
+		t.Error("the stale runners step was kept")
+	}
+	stored := storedJob(t, colls, uid)
+	if stored.Step != 2 || stored.Status != models.DeletionJobRunning || stored.Error != "" {
+		t.Errorf("stale runner left the job as %v at step %v with error %q", stored.Status, stored.Step, stored.Error)
+	}
+
+	// Nor can it complete or fail the job
+	stale.Step = len(steps)
+	store.complete(context.Background(), &stale)
+	store.fail(context.Background(), &stale, errors.New("stale"))
+	if stored := storedJob(t, colls, uid); stored.Step != 2 || stored.Status != models.DeletionJobRunning {
+		t.Errorf("stale runner left the job as %v at step %v", stored.Status, stored.Step)
+	}
+}
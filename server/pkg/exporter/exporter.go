@@ -0,0 +1,685 @@
+package exporter
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
+	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Personal data exports. An export is a zip archive of everything tied to a user, built
+	in the background and written to the data export directory, see the config package.
+	Progress is sent to the user through the socket as DATA_EXPORT_PROGRESS
+	messages. Archives are deleted once they expire.
+
+	Archive layout:
+	 - user.json
+	 - pfp.jpg
+	 - sessions.json
+	 - posts.json, posts/ID.jpg
+	 - post_votes.json (votes the user cast)
+	 - comments.json, comment_votes.json
+	 - messages.json, attachments/MESSAGE_ID/NAME
+	 - groups.json (group conversations the user is in, and messages sent to groups they have left)
+	 - rooms.json, rooms/ID.jpg
+	 - room_messages.json (messages the user sent in other users rooms)
+	 - notifications.json
+*/
+
+var log = logger.New("exporter")
+
+const (
+	exportLifetime    = time.Hour * 24
+	maxConcurrentJobs = 2
+)
+
+type Exporter struct {
+	Dir string
+
+	colls *db.Collections
+	ss    *socketserver.SocketServer
+	jobs  chan struct{} // Limits how many archives are built at once
+}
+
+// The cleanup ticker stops when the context is cancelled
+func Init(ctx context.Context, colls *db.Collections, ss *socketserver.SocketServer, cfg config.DataExports) (*Exporter, error) {
+	dir := cfg.Dir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		Dir:   dir,
+		colls: colls,
+		ss:    ss,
+		jobs:  make(chan struct{}, maxConcurrentJobs),
+	}
+	// Exports that were being built when the server stopped will never finish
+	if _, err := colls.DataExportCollection.UpdateMany(context.Background(), bson.M{"status": models.DataExportPending}, bson.M{"$set": bson.M{"status": models.DataExportFailed}}); err != nil {
+		return nil, err
+	}
+	e.cleanUp(ctx)
+	return e, nil
+}
+
+// Where the archive for an export is written
+func (e *Exporter) Path(id primitive.ObjectID) string {
+	return filepath.Join(e.Dir, id.Hex()+".zip")
+}
+
+// Creates the export and builds the archive in the background
+func (e *Exporter) Start(uid primitive.ObjectID) (*models.DataExport, error) {
+	export := &models.DataExport{
+		ID:        primitive.NewObjectID(),
+		Uid:       uid,
+		Status:    models.DataExportPending,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+		ExpiresAt: primitive.NewDateTimeFromTime(time.Now().Add(exportLifetime)),
+	}
+	if _, err := e.colls.DataExportCollection.InsertOne(context.Background(), export); err != nil {
+		return nil, err
+	}
+	go e.run(export)
+	return export, nil
+}
+
+func (e *Exporter) run(export *models.DataExport) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Panic("building data export", r, logger.Fields{"export": export.ID.Hex()})
+			e.finish(export, models.DataExportFailed, 0)
+		}
+	}()
+
+	e.jobs <- struct{}{}
+	defer func() { <-e.jobs }()
+
+	size, err := e.build(context.Background(), export)
+	if err != nil {
+		log.Error("Failed to build data export", err, logger.Fields{"export": export.ID.Hex()})
+		os.Remove(e.Path(export.ID) + ".tmp")
+		e.finish(export, models.DataExportFailed, 0)
+		return
+	}
+	e.finish(export, models.DataExportComplete, size)
+}
+
+func (e *Exporter) finish(export *models.DataExport, status string, size int64) {
+	progress := float32(0)
+	if status == models.DataExportComplete {
+		progress = 1
+	}
+	if _, err := e.colls.DataExportCollection.UpdateByID(context.Background(), export.ID, bson.M{"$set": bson.M{
+		"status":   status,
+		"progress": progress,
+		"size":     size,
+	}}); err != nil {
+		log.Error("Failed to update data export", err, logger.Fields{"export": export.ID.Hex(), "status": status})
+	}
+	e.sendProgress(export, status, progress)
+}
+
+func (e *Exporter) sendProgress(export *models.DataExport, status string, progress float32) {
+	e.ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid: export.Uid,
+		Data: socketmodels.OutMessage{
+			Data: `{"ID":"` + export.ID.Hex() + `","status":"` + status + `","progress":` + strconv.FormatFloat(float64(progress), 'f', 2, 32) + `}`,
+		},
+		Type: "DATA_EXPORT_PROGRESS",
+	}
+}
+
+/*--------------- ARCHIVE ---------------*/
+
+type exportStep func(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error
+
+var exportSteps = []exportStep{
+	writeUser,
+	writeSessions,
+	writePosts,
+	writeComments,
+	writeMessages,
+	writeGroups,
+	writeRooms,
+	writeRoomMessages,
+	writeNotifications,
+}
+
+// Writes the archive to a temporary file, which is renamed once complete. Returns the size of the archive.
+func (e *Exporter) build(ctx context.Context, export *models.DataExport) (int64, error) {
+	tmpPath := e.Path(export.ID) + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i, step := range exportSteps {
+		if err := step(ctx, e, zw, export.Uid); err != nil {
+			return 0, err
+		}
+		progress := float32(i+1) / float32(len(exportSteps)+1)
+		e.colls.DataExportCollection.UpdateByID(ctx, export.ID, bson.M{"$set": bson.M{"progress": progress}})
+		e.sendProgress(export, models.DataExportPending, progress)
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmpPath, e.Path(export.ID))
+}
+
+func writeJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Follows the chunk chain of an attachment, same as when it is downloaded
+func writeAttachment(ctx context.Context, colls *db.Collections, zw *zip.Writer, msgId primitive.ObjectID) error {
+	var metaData models.AttachmentMetadata
+	if err := colls.AttachmentMetadataCollection.FindOne(ctx, bson.M{"_id": msgId}).Decode(&metaData); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	if metaData.Pending || metaData.Failed {
+		return nil
+	}
+	w, err := zw.Create(fmt.Sprintf("attachments/%v/%v", msgId.Hex(), filepath.Base(metaData.Name)))
+	if err != nil {
+		return err
+	}
+	for next := msgId; next != primitive.NilObjectID; {
+		var chunk models.AttachmentChunk
+		if err := colls.AttachmentChunksCollection.FindOne(ctx, bson.M{"_id": next}).Decode(&chunk); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			return err
+		}
+		if _, err := w.Write(chunk.Bytes.Data); err != nil {
+			return err
+		}
+		next = chunk.NextChunk
+	}
+	return nil
+}
+
+// The user record including the settings that are normally kept from the client
+type exportedUser struct {
+	models.User
+	Blocked          []primitive.ObjectID  `json:"blocked"`
+	DMPrivacy        string                `json:"dm_privacy"`
+	Digest           models.DigestSettings `json:"digest"`
+	TwoFactorEnabled bool                  `json:"two_factor_enabled"`
+}
+
+func writeUser(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	var user models.User
+	if err := e.colls.UserCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&user); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "user.json", exportedUser{
+		User:             user,
+		Blocked:          user.Blocked,
+		DMPrivacy:        user.DMPrivacy,
+		Digest:           user.Digest,
+		TwoFactorEnabled: user.TwoFactor.Enabled,
+	}); err != nil {
+		return err
+	}
+
+	var pfp models.Pfp
+	if err := e.colls.PfpCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&pfp); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	return writeFile(zw, "pfp.jpg", pfp.Binary.Data)
+}
+
+func writeSessions(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	sessions := []models.Session{}
+	cursor, err := e.colls.SessionCollection.Find(ctx, bson.M{"_uid": uid}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return err
+	}
+	return writeJSON(zw, "sessions.json", sessions)
+}
+
+type exportedPostVote struct {
+	PostID   primitive.ObjectID `json:"post_id"`
+	IsUpvote bool               `json:"is_upvote"`
+}
+
+func writePosts(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	cursor, err := e.colls.PostCollection.Find(ctx, bson.M{"author_id": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	posts := []models.Post{}
+	for cursor.Next(ctx) {
+		var post models.Post
+		if err := cursor.Decode(&post); err != nil {
+			return err
+		}
+		var votes models.PostVotes
+		if err := e.colls.PostVoteCollection.FindOne(ctx, bson.M{"_id": post.ID}).Decode(&votes); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		for _, v := range votes.Votes {
+			if v.Uid == uid {
+				post.UsersVote = v
+			} else if v.IsUpvote {
+				post.PositiveVoteCount++
+			} else {
+				post.NegativeVoteCount++
+			}
+		}
+		var img models.PostImage
+		if err := e.colls.PostImageCollection.FindOne(ctx, bson.M{"_id": post.ID}).Decode(&img); err == nil {
+			if err := writeFile(zw, "posts/"+post.ID.Hex()+".jpg", img.Binary.Data); err != nil {
+				return err
+			}
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+		posts = append(posts, post)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "posts.json", posts); err != nil {
+		return err
+	}
+
+	votesCursor, err := e.colls.PostVoteCollection.Find(ctx, bson.M{"votes.uid": uid})
+	if err != nil {
+		return err
+	}
+	defer votesCursor.Close(ctx)
+	castVotes := []exportedPostVote{}
+	for votesCursor.Next(ctx) {
+		var votes models.PostVotes
+		if err := votesCursor.Decode(&votes); err != nil {
+			return err
+		}
+		for _, v := range votes.Votes {
+			if v.Uid == uid {
+				castVotes = append(castVotes, exportedPostVote{PostID: votes.ID, IsUpvote: v.IsUpvote})
+			}
+		}
+	}
+	if err := votesCursor.Err(); err != nil {
+		return err
+	}
+	return writeJSON(zw, "post_votes.json", castVotes)
+}
+
+type exportedComment struct {
+	PostID primitive.ObjectID `json:"post_id"`
+	models.PostComment
+}
+
+type exportedCommentVote struct {
+	PostID    primitive.ObjectID `json:"post_id"`
+	CommentID primitive.ObjectID `json:"comment_id"`
+	IsUpvote  bool               `json:"is_upvote"`
+}
+
+func writeComments(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	cursor, err := e.colls.PostCommentsCollection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"comments.author_id": uid},
+		bson.M{"votes.uid": uid},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	comments := []exportedComment{}
+	votes := []exportedCommentVote{}
+	for cursor.Next(ctx) {
+		var postCmts models.PostComments
+		if err := cursor.Decode(&postCmts); err != nil {
+			return err
+		}
+		for _, c := range postCmts.Comments {
+			if c.Author == uid {
+				comments = append(comments, exportedComment{PostID: postCmts.ID, PostComment: c})
+			}
+		}
+		for _, v := range postCmts.Votes {
+			if v.Uid == uid {
+				votes = append(votes, exportedCommentVote{PostID: postCmts.ID, CommentID: v.CommentID, IsUpvote: v.IsUpvote})
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "comments.json", comments); err != nil {
+		return err
+	}
+	return writeJSON(zw, "comment_votes.json", votes)
+}
+
+type exportedMessages struct {
+	Received        []models.PrivateMessage `json:"received"`
+	MessageRequests []models.PrivateMessage `json:"message_requests"`
+	Sent            []models.PrivateMessage `json:"sent"` // recipient_id is set on sent messages
+}
+
+func writeMessages(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	out := exportedMessages{
+		Received:        []models.PrivateMessage{},
+		MessageRequests: []models.PrivateMessage{},
+		Sent:            []models.PrivateMessage{},
+	}
+
+	var inbox models.Inbox
+	if err := e.colls.InboxCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&inbox); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if inbox.Messages != nil {
+		out.Received = inbox.Messages
+	}
+	if inbox.MessageRequests != nil {
+		out.MessageRequests = inbox.MessageRequests
+	}
+
+	// Sent messages are kept in the recipients inboxes
+	cursor, err := e.colls.InboxCollection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"messages.uid": uid},
+		bson.M{"message_requests.uid": uid},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var recipientInbox models.Inbox
+		if err := cursor.Decode(&recipientInbox); err != nil {
+			return err
+		}
+		for _, msgs := range [][]models.PrivateMessage{recipientInbox.Messages, recipientInbox.MessageRequests} {
+			for _, m := range msgs {
+				if m.Uid == uid {
+					m.RecipientId = recipientInbox.ID
+					out.Sent = append(out.Sent, m)
+				}
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	for _, msgs := range [][]models.PrivateMessage{out.Received, out.MessageRequests, out.Sent} {
+		for _, m := range msgs {
+			if m.HasAttachment {
+				if err := writeAttachment(ctx, e.colls, zw, m.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return writeJSON(zw, "messages.json", out)
+}
+
+type exportedGroups struct {
+	Conversations []models.GroupConversation `json:"conversations"` // Groups the user is a participant of, with every message
+	Sent          []exportedGroupMessage     `json:"sent"`          // Messages the user sent to groups they have since left
+}
+
+type exportedGroupMessage struct {
+	GroupID primitive.ObjectID `json:"group_id"`
+	models.GroupMessage
+}
+
+func writeGroups(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	out := exportedGroups{
+		Conversations: []models.GroupConversation{},
+		Sent:          []exportedGroupMessage{},
+	}
+
+	cursor, err := e.colls.GroupConversationCollection.Find(ctx, bson.M{"participants": uid})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &out.Conversations); err != nil {
+		return err
+	}
+	groupIds := []primitive.ObjectID{}
+	for i, group := range out.Conversations {
+		var groupMsgs models.GroupMessages
+		if err := e.colls.GroupMessagesCollection.FindOne(ctx, bson.M{"_id": group.ID}).Decode(&groupMsgs); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		out.Conversations[i].Messages = groupMsgs.Messages
+		if out.Conversations[i].Messages == nil {
+			out.Conversations[i].Messages = []models.GroupMessage{}
+		}
+		for _, m := range groupMsgs.Messages {
+			if m.HasAttachment {
+				if err := writeAttachment(ctx, e.colls, zw, m.ID); err != nil {
+					return err
+				}
+			}
+		}
+		groupIds = append(groupIds, group.ID)
+	}
+
+	// Messages are left behind when a participant leaves or is removed
+	sentCursor, err := e.colls.GroupMessagesCollection.Find(ctx, bson.M{"_id": bson.M{"$nin": groupIds}, "messages.uid": uid})
+	if err != nil {
+		return err
+	}
+	defer sentCursor.Close(ctx)
+	for sentCursor.Next(ctx) {
+		var groupMsgs models.GroupMessages
+		if err := sentCursor.Decode(&groupMsgs); err != nil {
+			return err
+		}
+		for _, m := range groupMsgs.Messages {
+			if m.Uid != uid {
+				continue
+			}
+			if m.HasAttachment {
+				if err := writeAttachment(ctx, e.colls, zw, m.ID); err != nil {
+					return err
+				}
+			}
+			out.Sent = append(out.Sent, exportedGroupMessage{GroupID: groupMsgs.ID, GroupMessage: m})
+		}
+	}
+	if err := sentCursor.Err(); err != nil {
+		return err
+	}
+	return writeJSON(zw, "groups.json", out)
+}
+
+func writeRooms(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	cursor, err := e.colls.RoomCollection.Find(ctx, bson.M{"author_id": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	rooms := []models.Room{}
+	for cursor.Next(ctx) {
+		var room models.Room
+		if err := cursor.Decode(&room); err != nil {
+			return err
+		}
+		var roomMsgs models.RoomMessages
+		if err := e.colls.RoomMessagesCollection.FindOne(ctx, bson.M{"_id": room.ID}).Decode(&roomMsgs); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		room.Messages = roomMsgs.Messages
+		if room.Messages == nil {
+			room.Messages = []models.RoomMessage{}
+		}
+		room.Pinned = roomMsgs.Pinned
+		room.Announcement = roomMsgs.Announcement
+		var img models.RoomImage
+		if err := e.colls.RoomImageCollection.FindOne(ctx, bson.M{"_id": room.ID}).Decode(&img); err == nil {
+			if err := writeFile(zw, "rooms/"+room.ID.Hex()+".jpg", img.Binary.Data); err != nil {
+				return err
+			}
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+		rooms = append(rooms, room)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return writeJSON(zw, "rooms.json", rooms)
+}
+
+type exportedRoomMessage struct {
+	RoomID primitive.ObjectID `json:"room_id"`
+	models.RoomMessage
+}
+
+// Messages the user sent in other users rooms, messages in their own rooms are already in rooms.json
+func writeRoomMessages(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	ownRoomIds := []primitive.ObjectID{}
+	roomsCursor, err := e.colls.RoomCollection.Find(ctx, bson.M{"author_id": uid}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer roomsCursor.Close(ctx)
+	for roomsCursor.Next(ctx) {
+		var room models.Room
+		if err := roomsCursor.Decode(&room); err != nil {
+			return err
+		}
+		ownRoomIds = append(ownRoomIds, room.ID)
+	}
+	if err := roomsCursor.Err(); err != nil {
+		return err
+	}
+
+	cursor, err := e.colls.RoomMessagesCollection.Find(ctx, bson.M{"_id": bson.M{"$nin": ownRoomIds}, "messages.uid": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	msgs := []exportedRoomMessage{}
+	for cursor.Next(ctx) {
+		var roomMsgs models.RoomMessages
+		if err := cursor.Decode(&roomMsgs); err != nil {
+			return err
+		}
+		for _, m := range roomMsgs.Messages {
+			if m.Uid != uid {
+				continue
+			}
+			if m.HasAttachment {
+				if err := writeAttachment(ctx, e.colls, zw, m.ID); err != nil {
+					return err
+				}
+			}
+			msgs = append(msgs, exportedRoomMessage{RoomID: roomMsgs.ID, RoomMessage: m})
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return writeJSON(zw, "room_messages.json", msgs)
+}
+
+func writeNotifications(ctx context.Context, e *Exporter, zw *zip.Writer, uid primitive.ObjectID) error {
+	var notifications models.Notifications
+	if err := e.colls.NotificationsCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&notifications); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if notifications.Notifications == nil {
+		notifications.Notifications = []models.Notification{}
+	}
+	return writeJSON(zw, "notifications.json", notifications.Notifications)
+}
+
+/*--------------- CLEANUP ---------------*/
+
+// Deletes expired exports and their archives every 10 minutes
+func (e *Exporter) cleanUp(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute * 10)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := e.deleteExpired(context.Background()); err != nil {
+					log.Error("Failed to clean up data exports", err, nil)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (e *Exporter) deleteExpired(ctx context.Context) error {
+	filter := bson.M{"expires_at": bson.M{"$lt": primitive.NewDateTimeFromTime(time.Now())}}
+	cursor, err := e.colls.DataExportCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var export models.DataExport
+		if err := cursor.Decode(&export); err != nil {
+			return err
+		}
+		if err := os.Remove(e.Path(export.ID)); err != nil && !os.IsNotExist(err) {
+			log.Error("Failed to delete data export archive", err, logger.Fields{"export": export.ID.Hex()})
+			continue
+		}
+		e.colls.DataExportCollection.DeleteOne(ctx, bson.M{"_id": export.ID})
+	}
+	return cursor.Err()
+}
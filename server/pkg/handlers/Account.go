@@ -4,26 +4,29 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"sort"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/deletion"
 	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/passwords"
 	"github.com/web-stuff-98/go-social-media/pkg/validation"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-playground/validator/v10"
 	"github.com/nfnt/resize"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/bcrypt"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func (h handler) Register(w http.ResponseWriter, r *http.Request) {
@@ -49,24 +52,49 @@ func (h handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 14)
+	if err := passwords.Check(credentialsInput.Password, credentialsInput.Username); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if taken, err := usernameTaken(r.Context(), h.Collections, credentialsInput.Username); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if taken {
+		responseMessage(w, http.StatusBadRequest, "That username is taken")
+		return
+	}
+
+	hash, err := passwords.Hash(credentialsInput.Password)
 	if err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
 	user.Username = credentialsInput.Username
-	user.Password = string(hash)
+	user.Password = hash
+	user.Blocked = []primitive.ObjectID{}
+	user.DMPrivacy = models.DMPrivacyEveryone
+	user.Links = []string{}
+	user.UsernameHistory = []models.UsernameChange{}
+	user.CreatedAt = primitive.NewDateTimeFromTime(time.Now())
 
 	inserted, err := h.Collections.UserCollection.InsertOne(r.Context(), user)
 	if err != nil {
-		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		if mongo.IsDuplicateKeyError(err) {
+			responseMessage(w, http.StatusBadRequest, "That username is taken")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
 		return
 	}
 
 	inbox.ID = inserted.InsertedID.(primitive.ObjectID)
 	inbox.Messages = []models.PrivateMessage{}
 	inbox.MessagesSentTo = []primitive.ObjectID{}
+	inbox.MessageRequests = []models.PrivateMessage{}
+	inbox.AcceptedRequestsFrom = []primitive.ObjectID{}
+	inbox.DeclinedRequestsFrom = []primitive.ObjectID{}
 
 	if _, err := h.Collections.InboxCollection.InsertOne(r.Context(), inbox); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -76,13 +104,17 @@ func (h handler) Register(w http.ResponseWriter, r *http.Request) {
 	notifications.ID = inserted.InsertedID.(primitive.ObjectID)
 	notifications.Notifications = []models.Notification{}
 
-	if _, err := h.Collections.NotificationsCollection.InsertOne(r.Context(), inbox); err != nil {
+	if _, err := h.Collections.NotificationsCollection.InsertOne(r.Context(), notifications); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
-	cookie, err := helpers.GenerateCookieAndSession(inserted.InsertedID.(primitive.ObjectID), *h.Collections)
-	http.SetCookie(w, &cookie)
+	cookies, err := helpers.GenerateCookiesAndSession(inserted.InsertedID.(primitive.ObjectID), r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	setCookies(w, cookies)
 
 	user.IsOnline = true
 
@@ -111,7 +143,7 @@ func (h handler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user models.User
-	if err := h.Collections.UserCollection.FindOne(r.Context(), bson.M{"username": bson.M{"$regex": credentialsInput.Username, "$options": "i"}}).Decode(&user); err != nil {
+	if err := h.Collections.UserCollection.FindOne(r.Context(), bson.M{"username": credentialsInput.Username}, options.FindOne().SetCollation(db.UsernameCollation)).Decode(&user); err != nil {
 		if err != mongo.ErrNoDocuments {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 		} else {
@@ -120,11 +152,62 @@ func (h handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentialsInput.Password)); err != nil {
+	if !passwords.Compare(user.Password, credentialsInput.Password) {
 		responseMessage(w, http.StatusUnauthorized, "Incorrect credentials")
 		return
 	}
 
+	// Soft deleted accounts can only be logged in to by restoring them. Users with two
+	// factor authentication have their account restored once they have sent a code.
+	if user.DeletedAt != 0 {
+		if user.PurgeAt.Time().Before(time.Now()) {
+			responseMessage(w, http.StatusNotFound, "Account does not exist")
+			return
+		}
+		if !credentialsInput.Restore {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"msg":      "This account has been deleted. Log in with restore to get it back",
+				"deleted":  true,
+				"purge_at": user.PurgeAt,
+			})
+			return
+		}
+		if !user.TwoFactor.Enabled {
+			if restored, err := deletion.Restore(r.Context(), h.Collections, user.ID); err != nil {
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
+				return
+			} else if !restored {
+				responseMessage(w, http.StatusNotFound, "Account does not exist")
+				return
+			}
+		}
+	}
+
+	// Rehash with the configured cost if it has been raised since the password was set
+	if passwords.NeedsRehash(user.Password) {
+		if hash, err := passwords.Hash(credentialsInput.Password); err == nil {
+			h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": bson.M{"password": hash}})
+		}
+	}
+
+	// Users with two factor authentication have to send a code to VerifyTwoFactorLogin before they get a session
+	if user.TwoFactor.Enabled {
+		challengeCookie, err := helpers.CreateTwoFactorChallengeCookie(user.ID)
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		http.SetCookie(w, &challengeCookie)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"two_factor_required": true,
+		})
+		return
+	}
+
 	var pfp models.Pfp
 	if err := h.Collections.PfpCollection.FindOne(r.Context(), bson.M{"_id": user.ID}).Decode(&pfp); err != nil {
 		if err != mongo.ErrNoDocuments {
@@ -135,8 +218,12 @@ func (h handler) Login(w http.ResponseWriter, r *http.Request) {
 		user.Base64pfp = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(pfp.Binary.Data)
 	}
 
-	cookie, err := helpers.GenerateCookieAndSession(user.ID, *h.Collections)
-	http.SetCookie(w, &cookie)
+	cookies, err := helpers.GenerateCookiesAndSession(user.ID, r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	setCookies(w, cookies)
 
 	user.IsOnline = true
 
@@ -146,35 +233,25 @@ func (h handler) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
-	originalCookie, err := r.Cookie("refresh_token")
+	session, cookies, err := helpers.RotateRefreshToken(r, *h.Collections)
 	if err != nil {
-		responseMessage(w, http.StatusUnauthorized, "You have no token")
-		return
-	}
-	token, err := jwt.ParseWithClaims(originalCookie.Value, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("SECRET")), nil
-	})
-	rawSID := token.Claims.(*jwt.StandardClaims).Issuer
-	sessionId, err := primitive.ObjectIDFromHex(rawSID)
-
-	var session models.Session
-	if h.Collections.SessionCollection.FindOne(r.Context(), bson.M{"_id": sessionId}).Decode(&session); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		} else {
-			responseMessage(w, http.StatusNotFound, "Account does not exist")
+		switch err {
+		case helpers.ErrRefreshTokenRaced:
+			// Another tab refreshed first, the new cookies will already be set
+			responseMessage(w, http.StatusConflict, "Token already refreshed")
+		case helpers.ErrRefreshTokenReused:
+			h.SocketServer.CloseSessionConns <- session.ID
+			setCookies(w, helpers.GetClearedCookies())
+			responseMessage(w, http.StatusUnauthorized, "Your session was revoked because your login was used somewhere else")
+		default:
+			setCookies(w, helpers.GetClearedCookies())
+			responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		}
 		return
 	}
 
-	cookie, err := helpers.GenerateCookieAndSession(session.UID, *h.Collections)
-	if err != nil {
-		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
 	var user models.User
-	if h.Collections.UserCollection.FindOne(r.Context(), bson.M{"_id": session.UID}).Decode(&user); err != nil {
+	if err := h.Collections.UserCollection.FindOne(r.Context(), bson.M{"_id": session.UID}).Decode(&user); err != nil {
 		if err != mongo.ErrNoDocuments {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 		} else {
@@ -195,60 +272,120 @@ func (h handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
 
 	user.IsOnline = true
 
-	http.SetCookie(w, &cookie)
+	setCookies(w, cookies)
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(user)
 }
 
-func (h handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
-	originalCookie, err := r.Cookie("refresh_token")
+func (h handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, session, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
-	token, err := jwt.ParseWithClaims(originalCookie.Value, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("SECRET")), nil
-	})
-	rawSID := token.Claims.(*jwt.StandardClaims).Issuer
-	sessionId, err := primitive.ObjectIDFromHex(rawSID)
 
-	var session models.Session
-	if h.Collections.SessionCollection.FindOne(r.Context(), bson.M{"_id": sessionId}).Decode(&session); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		} else {
-			responseMessage(w, http.StatusNotFound, "Could not find your session")
-		}
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
 		return
 	}
 
-	if _, isProtected := h.ProtectedIDs.Uids[session.UID]; isProtected {
-		responseMessage(w, http.StatusUnauthorized, "You cannot delete example accounts")
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
 		return
 	}
 
-	if h.Collections.UserCollection.DeleteOne(r.Context(), bson.M{"_id": session.UID}); err != nil {
+	var passwordInput validation.ChangePassword
+	if err := json.Unmarshal(body, &passwordInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(passwordInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !passwords.Compare(user.Password, passwordInput.CurrentPassword) {
+		responseMessage(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+	if passwordInput.NewPassword == passwordInput.CurrentPassword {
+		responseMessage(w, http.StatusBadRequest, "Your new password must be different")
+		return
+	}
+	if err := passwords.Check(passwordInput.NewPassword, user.Username); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hash, err := passwords.Hash(passwordInput.NewPassword)
+	if err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
-	clearedCookie := helpers.GetClearedCookie()
-	http.SetCookie(w, &clearedCookie)
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": bson.M{"password": hash}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	// Log out everywhere else, in case the password was changed because someone else knew it
+	if err := h.revokeOtherSessions(r.Context(), user.ID, session.ID); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Password changed")
+}
+
+func (h handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[uid]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot delete example accounts")
+		return
+	}
+
+	// The account is purged by a deletion job once the grace period is up, until then the user can restore it by logging in
+	purgeAt, err := deletion.SoftDelete(r.Context(), h.Collections, uid, h.DeletionPolicy)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Account does not exist")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	// Log out everywhere
+	if err := h.revokeOtherSessions(r.Context(), uid, primitive.NilObjectID); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	setCookies(w, helpers.GetClearedCookies())
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode("Deleted")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"msg":      "Deleted",
+		"purge_at": purgeAt,
+	})
 }
 
 func (h handler) Logout(w http.ResponseWriter, r *http.Request) {
-	_, session, _ := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	session, _ := helpers.GetSessionFromRefreshToken(r, *h.Collections)
 
-	clearedCookie := helpers.GetClearedCookie()
-	http.SetCookie(w, &clearedCookie)
+	setCookies(w, helpers.GetClearedCookies())
 
 	if session != nil {
-		res, err := h.Collections.SessionCollection.DeleteOne(r.Context(), bson.M{"_id": session.UID})
+		res, err := h.Collections.SessionCollection.DeleteOne(r.Context(), bson.M{"_id": session.ID})
 		if err != nil {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 			return
@@ -257,6 +394,7 @@ func (h handler) Logout(w http.ResponseWriter, r *http.Request) {
 			responseMessage(w, http.StatusBadRequest, "You are not logged in")
 			return
 		}
+		h.SocketServer.CloseSessionConns <- session.ID
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -276,7 +414,7 @@ func (h handler) UploadPfp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.ParseMultipartForm(32 << 20) // what is <<, binary shift whatever that is. Is used here to define max size in bytes (20mb)
+	r.ParseMultipartForm(h.Uploads.MaxImageSize)
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
@@ -284,8 +422,8 @@ func (h handler) UploadPfp(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	if handler.Size > 20*1024*1024 {
-		responseMessage(w, http.StatusRequestEntityTooLarge, "File too large, max 20mb.")
+	if handler.Size > h.Uploads.MaxImageSize {
+		responseMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, max %vmb.", h.Uploads.MaxImageSize/1024/1024))
 		return
 	}
 
@@ -349,14 +487,14 @@ func (h handler) UploadPfp(w http.ResponseWriter, r *http.Request) {
 
 // Get uids of all conversations (excluding the messages - getConversation will be used to retrieve messages when the conversation is opened)
 func (h handler) GetConversations(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	var inbox = &models.Inbox{}
-	if err := h.Collections.InboxCollection.FindOne(r.Context(), bson.M{"_id": user.ID}).Decode(&inbox); err != nil {
+	if err := h.Collections.InboxCollection.FindOne(r.Context(), bson.M{"_id": uid}).Decode(&inbox); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
@@ -386,7 +524,7 @@ func (h handler) GetConversations(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) GetConversation(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -402,7 +540,7 @@ func (h handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 	match := bson.M{
 		"$match": bson.M{
 			"_id": bson.M{
-				"$in": []primitive.ObjectID{user.ID, recipientId},
+				"$in": []primitive.ObjectID{uid, recipientId},
 			},
 		},
 	}
@@ -429,10 +567,10 @@ func (h handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 		elems, err := cursor.Current.Elements()
 		var msg models.PrivateMessage
 		bson.Unmarshal(elems[1].Value().Value, &msg)
-		if msg.Uid == user.ID {
+		if msg.Uid == uid {
 			msg.RecipientId = recipientId
 		} else {
-			msg.RecipientId = user.ID
+			msg.RecipientId = uid
 		}
 		if err != nil {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -473,3 +611,42 @@ func (h handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(messages)
 }
+
+// The ID of a deletion job is the ID of the deleted user. Only the user themself gets the details,
+// anyone else only gets the status, since the account is usually gone along with its sessions.
+func (h handler) GetDeletionStatus(w http.ResponseWriter, r *http.Request) {
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	var job models.DeletionJob
+	if err := h.Collections.DeletionJobCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if uid, err := helpers.GetUidFromRequest(r); err != nil || uid != job.ID {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ID":     job.ID,
+			"status": job.Status,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ID":          job.ID,
+		"status":      job.Status,
+		"step":        job.Step,
+		"total_steps": deletion.StepCount(),
+		"created_at":  job.CreatedAt,
+		"updated_at":  job.UpdatedAt,
+	})
+}
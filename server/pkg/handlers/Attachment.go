@@ -42,6 +42,10 @@ func (h handler) HandleAttachmentMetadata(w http.ResponseWriter, r *http.Request
 		responseMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if h.Uploads.MaxAttachmentSize > 0 && int64(metadataInput.Size) > h.Uploads.MaxAttachmentSize {
+		responseMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, max %vmb.", h.Uploads.MaxAttachmentSize/1024/1024))
+		return
+	}
 
 	rawMsgId := mux.Vars(r)["msgId"]
 	msgId, err := primitive.ObjectIDFromHex(rawMsgId)
@@ -50,7 +54,7 @@ func (h handler) HandleAttachmentMetadata(w http.ResponseWriter, r *http.Request
 		return
 	}
 	rawRecipientId := mux.Vars(r)["recipientId"]
-	// Recipient ID can be either a user for private messages, or a room
+	// Recipient ID can be either a user for private messages, a group conversation, or a room
 	recipientId, err := primitive.ObjectIDFromHex(rawRecipientId)
 	if err != nil {
 		responseMessage(w, http.StatusBadRequest, "Invalid ID")
@@ -100,6 +104,20 @@ func (h handler) HandleAttachmentMetadata(w http.ResponseWriter, r *http.Request
 				break
 			}
 		}
+	} else if count, err := h.Collections.GroupMessagesCollection.CountDocuments(r.Context(), bson.M{
+		"_id":      recipientId,
+		"messages": bson.M{"$elemMatch": bson.M{"_id": msgId, "uid": user.ID}},
+	}); err != nil || count > 0 {
+		// Recipient ID is a group conversation
+		if err != nil {
+			h.AttachmentServer.UploadFailedChan <- attachmentserver.UploadStatusInfo{
+				MsgID: msgId,
+				Uid:   user.ID,
+			}
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		found = true
 	} else {
 		var roomMsgs models.RoomMessages
 		if err := h.Collections.RoomMessagesCollection.FindOne(r.Context(), bson.M{"_id": recipientId}).Decode(&roomMsgs); err != nil {
@@ -153,7 +171,7 @@ func (h handler) HandleAttachmentMetadata(w http.ResponseWriter, r *http.Request
 }
 
 func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -169,7 +187,7 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	recvChan := make(chan map[primitive.ObjectID]attachmentserver.Upload)
 	h.AttachmentServer.GetUploaderStatus <- attachmentserver.GetUploaderStatus{
 		RecvChan: recvChan,
-		Uid:      user.ID,
+		Uid:      uid,
 	}
 	uploads := <-recvChan
 	upload, ok := uploads[msgId]
@@ -177,14 +195,14 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		h.AttachmentServer.UploadFailedChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
 	h.AttachmentServer.UploadStatusChan <- attachmentserver.UploadStatus{
-		Uid: user.ID,
+		Uid: uid,
 		Status: attachmentserver.Upload{
 			ChunksDone:        upload.ChunksDone + 1,
 			TotalChunks:       upload.TotalChunks,
@@ -201,7 +219,7 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	if r.ContentLength <= 0 {
 		h.AttachmentServer.UploadFailedChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 		responseMessage(w, http.StatusBadRequest, "Bad request")
 		return
@@ -209,7 +227,7 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	if r.ContentLength > 1*1024*1024 {
 		h.AttachmentServer.UploadFailedChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 		responseMessage(w, http.StatusRequestEntityTooLarge, "Bad request")
 		return
@@ -224,7 +242,7 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	}); err != nil {
 		h.AttachmentServer.UploadFailedChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
@@ -233,7 +251,7 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	if upload.ChunksDone > 20 {
 		h.AttachmentServer.UploadFailedChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 		responseMessage(w, http.StatusRequestEntityTooLarge, "File too large. Max 20mb")
 		return
@@ -242,12 +260,12 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 	if upload.ChunksDone == upload.TotalChunks-1 {
 		h.AttachmentServer.UploadCompleteChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 	} else {
 		h.AttachmentServer.UploadProgressChan <- attachmentserver.UploadStatusInfo{
 			MsgID: msgId,
-			Uid:   user.ID,
+			Uid:   uid,
 		}
 	}
 
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Personal data exports. The archive is built by the exporter in the background, progress
+	is sent to the user through the socket as DATA_EXPORT_PROGRESS messages.
+*/
+
+// Users have to wait this long between exports
+const dataExportCooldown = time.Hour
+
+func (h handler) StartDataExport(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var latest models.DataExport
+	if err := h.Collections.DataExportCollection.FindOne(r.Context(), bson.M{"uid": uid}, options.FindOne().SetSort(bson.M{"created_at": -1})).Decode(&latest); err != nil {
+		if err != mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	} else if latest.Status == models.DataExportPending {
+		responseMessage(w, http.StatusBadRequest, "Your data is already being exported")
+		return
+	} else if latest.Status == models.DataExportComplete && time.Now().Before(latest.CreatedAt.Time().Add(dataExportCooldown)) {
+		responseMessage(w, http.StatusTooManyRequests, "You can only export your data once an hour")
+		return
+	}
+
+	export, err := h.Exporter.Start(uid)
+	if err != nil {
+		// Another request started an export after the check above
+		if mongo.IsDuplicateKeyError(err) {
+			responseMessage(w, http.StatusBadRequest, "Your data is already being exported")
+			return
+		}
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(export)
+}
+
+// Returns the users most recent export
+func (h handler) GetDataExport(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var export models.DataExport
+	if err := h.Collections.DataExportCollection.FindOne(r.Context(), bson.M{
+		"uid":        uid,
+		"expires_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}, options.FindOne().SetSort(bson.M{"created_at": -1})).Decode(&export); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(export)
+}
+
+func (h handler) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	var export models.DataExport
+	if err := h.Collections.DataExportCollection.FindOne(r.Context(), bson.M{
+		"_id":        id,
+		"uid":        uid,
+		"expires_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}).Decode(&export); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+	if export.Status != models.DataExportComplete {
+		responseMessage(w, http.StatusBadRequest, "The export is not ready")
+		return
+	}
+
+	f, err := os.Open(h.Exporter.Path(export.ID))
+	if err != nil {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Add("Content-Type", "application/zip")
+	w.Header().Add("Content-Disposition", `attachment; filename="data-export-`+export.CreatedAt.Time().Format("2006-01-02")+`.zip"`)
+	http.ServeContent(w, r, "", export.CreatedAt.Time(), f)
+}
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
+	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
+	"github.com/web-stuff-98/go-social-media/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+	Group conversations. Participants are added and removed by the creator, messages are
+	sent through the socket (GROUP_MESSAGE) and sent out to the group=ID subscription.
+*/
+
+const maxGroupParticipants = 10
+
+func (h handler) CreateGroupConversation(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var groupInput validation.GroupConversation
+	if err := json.Unmarshal(body, &groupInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(groupInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	participants := []primitive.ObjectID{user.ID}
+	for _, rawUid := range helpers.RemoveDuplicates(groupInput.Participants) {
+		uid, err := primitive.ObjectIDFromHex(rawUid)
+		if err != nil {
+			responseMessage(w, http.StatusBadRequest, "Invalid UID")
+			return
+		}
+		if uid == user.ID {
+			continue
+		}
+		if status, msg := h.canAddGroupParticipant(r, user.ID, uid); status != http.StatusOK {
+			responseMessage(w, status, msg)
+			return
+		}
+		participants = append(participants, uid)
+	}
+
+	group := &models.GroupConversation{
+		Name:         groupInput.Name,
+		Author:       user.ID,
+		Participants: participants,
+		CreatedAt:    primitive.NewDateTimeFromTime(time.Now()),
+		UpdatedAt:    primitive.NewDateTimeFromTime(time.Now()),
+	}
+
+	inserted, err := h.Collections.GroupConversationCollection.InsertOne(r.Context(), group)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	group.ID = inserted.InsertedID.(primitive.ObjectID)
+
+	if _, err := h.Collections.GroupMessagesCollection.InsertOne(r.Context(), models.GroupMessages{
+		ID:       group.ID,
+		Messages: []models.GroupMessage{},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	for _, uid := range participants {
+		if uid != user.ID {
+			h.sendGroupChangeToUser(uid, "INSERT", group)
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+func (h handler) GetGroupConversations(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	groups := []models.GroupConversation{}
+	cursor, err := h.Collections.GroupConversationCollection.Find(r.Context(), bson.M{"participants": uid})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if err := cursor.All(r.Context(), &groups); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(groups)
+}
+
+func (h handler) GetGroupConversation(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	group, status, msg := h.getGroupConversation(r, mux.Vars(r)["id"])
+	if status != http.StatusOK {
+		responseMessage(w, status, msg)
+		return
+	}
+
+	if !containsObjectID(group.Participants, uid) {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var groupMessages models.GroupMessages
+	if err := h.Collections.GroupMessagesCollection.FindOne(r.Context(), bson.M{"_id": group.ID}).Decode(&groupMessages); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Group messages not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	for i, msg := range groupMessages.Messages {
+		if msg.HasAttachment {
+			var metadata models.AttachmentMetadata
+			if err := h.Collections.AttachmentMetadataCollection.FindOne(r.Context(), bson.M{"_id": msg.ID}).Decode(&metadata); err != nil {
+				if err != mongo.ErrNoDocuments {
+					responseMessage(w, http.StatusInternalServerError, "Internal error")
+					return
+				}
+				// The metadata hasn't been created yet
+				groupMessages.Messages[i].AttachmentProgress = models.AttachmentProgress{
+					Failed:  false,
+					Pending: true,
+					Ratio:   0,
+				}
+				continue
+			}
+			groupMessages.Messages[i].AttachmentProgress = models.AttachmentProgress{
+				Failed:  metadata.Failed,
+				Pending: metadata.Pending,
+				Ratio:   0.05, //arbitrary value
+			}
+			groupMessages.Messages[i].AttachmentMetadata = models.OutAttachmentMetadata{
+				MimeType: metadata.MimeType,
+				Name:     metadata.Name,
+				Size:     metadata.Size,
+				Length:   metadata.VideoLength,
+			}
+		}
+	}
+
+	group.Messages = groupMessages.Messages
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(group)
+}
+
+func (h handler) AddGroupParticipant(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	group, status, msg := h.getGroupConversation(r, mux.Vars(r)["id"])
+	if status != http.StatusOK {
+		responseMessage(w, status, msg)
+		return
+	}
+
+	if group.Author != user.ID {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var rawUid string
+	if r.URL.Query().Has("uid") {
+		rawUid = r.URL.Query().Get("uid")
+	} else {
+		responseMessage(w, http.StatusBadRequest, "No UID provided")
+		return
+	}
+
+	uid, err := primitive.ObjectIDFromHex(rawUid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid UID")
+		return
+	}
+
+	if containsObjectID(group.Participants, uid) {
+		responseMessage(w, http.StatusBadRequest, "This user is already in the group")
+		return
+	}
+
+	if status, msg := h.canAddGroupParticipant(r, user.ID, uid); status != http.StatusOK {
+		responseMessage(w, status, msg)
+		return
+	}
+
+	// Only matches if the group isn't full, so that participants added at the same time can't go over the limit
+	res, err := h.Collections.GroupConversationCollection.UpdateOne(r.Context(), bson.M{
+		"_id": group.ID,
+		"participants." + strconv.Itoa(maxGroupParticipants-1): bson.M{"$exists": false},
+	}, bson.M{
+		"$addToSet": bson.M{"participants": uid},
+		"$set":      bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "The group is full")
+		return
+	}
+
+	h.sendGroupParticipantChange(group.ID, uid, "INSERT")
+	group.Participants = append(group.Participants, uid)
+	h.sendGroupChangeToUser(uid, "INSERT", group)
+
+	responseMessage(w, http.StatusOK, "Participant added")
+}
+
+func (h handler) RemoveGroupParticipant(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	group, status, msg := h.getGroupConversation(r, mux.Vars(r)["id"])
+	if status != http.StatusOK {
+		responseMessage(w, status, msg)
+		return
+	}
+
+	var rawUid string
+	if r.URL.Query().Has("uid") {
+		rawUid = r.URL.Query().Get("uid")
+	} else {
+		responseMessage(w, http.StatusBadRequest, "No UID provided")
+		return
+	}
+
+	uid, err := primitive.ObjectIDFromHex(rawUid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid UID")
+		return
+	}
+
+	// Participants can leave by removing themselves, otherwise only the creator can remove participants
+	if group.Author != user.ID && uid != user.ID {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if uid == group.Author {
+		responseMessage(w, http.StatusBadRequest, "The creator cannot leave the group, delete it instead")
+		return
+	}
+
+	res, err := h.Collections.GroupConversationCollection.UpdateByID(r.Context(), group.ID, bson.M{
+		"$pull": bson.M{"participants": uid},
+		"$set":  bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "This user is not in the group")
+		return
+	}
+
+	h.SocketServer.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+		Name: "group=" + group.ID.Hex(),
+		Uid:  uid,
+	}
+	h.sendGroupParticipantChange(group.ID, uid, "DELETE")
+	h.sendGroupChangeToUser(uid, "DELETE", &models.GroupConversation{ID: group.ID})
+
+	responseMessage(w, http.StatusOK, "Participant removed")
+}
+
+func (h handler) DeleteGroupConversation(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	group, status, msg := h.getGroupConversation(r, mux.Vars(r)["id"])
+	if status != http.StatusOK {
+		responseMessage(w, status, msg)
+		return
+	}
+
+	if group.Author != user.ID {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var groupMessages models.GroupMessages
+	if err := h.Collections.GroupMessagesCollection.FindOneAndDelete(r.Context(), bson.M{"_id": group.ID}).Decode(&groupMessages); err != nil && err != mongo.ErrNoDocuments {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for _, msg := range groupMessages.Messages {
+		if msg.HasAttachment {
+			h.AttachmentServer.DeleteChunksChan <- msg.ID
+		}
+	}
+
+	if _, err := h.Collections.GroupConversationCollection.DeleteOne(r.Context(), bson.M{"_id": group.ID}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	for _, uid := range group.Participants {
+		h.sendGroupChangeToUser(uid, "DELETE", &models.GroupConversation{ID: group.ID})
+	}
+	h.SocketServer.DestroySubscription <- "group=" + group.ID.Hex()
+
+	responseMessage(w, http.StatusOK, "Group deleted")
+}
+
+func (h handler) getGroupConversation(r *http.Request, rawId string) (*models.GroupConversation, int, string) {
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid ID"
+	}
+	group := &models.GroupConversation{}
+	if err := h.Collections.GroupConversationCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&group); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, http.StatusNotFound, "Group not found"
+		}
+		return nil, http.StatusInternalServerError, "Internal error"
+	}
+	return group, http.StatusOK, ""
+}
+
+// Checks that the user exists and hasn't blocked the person adding them
+func (h handler) canAddGroupParticipant(r *http.Request, adderId primitive.ObjectID, uid primitive.ObjectID) (int, string) {
+	if count, err := h.Collections.UserCollection.CountDocuments(r.Context(), bson.M{"_id": uid}); err != nil {
+		return http.StatusInternalServerError, "Internal error"
+	} else if count == 0 {
+		return http.StatusNotFound, "User not found"
+	}
+	if blocked, err := helpers.IsBlockedBy(r.Context(), *h.Collections, uid, adderId); err != nil {
+		return http.StatusInternalServerError, "Internal error"
+	} else if blocked {
+		return http.StatusForbidden, "This user has blocked you"
+	}
+	return http.StatusOK, ""
+}
+
+func (h handler) sendGroupParticipantChange(groupId primitive.ObjectID, uid primitive.ObjectID, method string) {
+	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: method,
+		Entity: "GROUP_PARTICIPANT",
+		Data:   `{"ID":"` + uid.Hex() + `","group_id":"` + groupId.Hex() + `"}`,
+	})
+	if err != nil {
+		return
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "group=" + groupId.Hex(),
+		Data: outChangeBytes,
+	}
+}
+
+// Lets a user know they have been added to, or removed from a group
+func (h handler) sendGroupChangeToUser(uid primitive.ObjectID, method string, group *models.GroupConversation) {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return
+	}
+	h.SocketServer.SendDataToUser <- socketserver.UserDataMessage{
+		Uid: uid,
+		Data: socketmodels.OutChangeMessage{
+			Method: method,
+			Entity: "GROUP",
+			Data:   string(data),
+		},
+		Type: "CHANGE",
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/notifications"
+	"github.com/web-stuff-98/go-social-media/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (h handler) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	page := 1
+	if r.URL.Query().Has("page") {
+		page, err = strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			responseMessage(w, http.StatusBadRequest, "Invalid page")
+			return
+		}
+	}
+
+	var userNotifications models.Notifications
+	if err := h.Collections.NotificationsCollection.FindOne(r.Context(), bson.M{"_id": uid}).Decode(&userNotifications); err != nil {
+		if err != mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": notifications.GetPage(userNotifications.Notifications, page),
+		"count":         len(userNotifications.Notifications),
+		"unread":        notifications.UnreadCount(userNotifications.Notifications),
+	})
+}
+
+func (h handler) MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	res, err := h.Collections.NotificationsCollection.UpdateOne(r.Context(), bson.M{
+		"_id":               uid,
+		"notifications._id": id,
+	}, bson.M{
+		"$set": bson.M{"notifications.$.read": true},
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		responseMessage(w, http.StatusNotFound, "Notification not found")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Notification marked as read")
+}
+
+func (h handler) MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, err := h.Collections.NotificationsCollection.UpdateByID(r.Context(), uid, bson.M{
+		"$set": bson.M{"notifications.$[].read": true},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Notifications marked as read")
+}
+
+func (h handler) GetDigestSettings(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user.Digest)
+}
+
+func (h handler) UpdateDigestSettings(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var digestInput validation.DigestSettings
+	if err := json.Unmarshal(body, &digestInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(digestInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	set := bson.M{
+		"digest.enabled": digestInput.Enabled,
+		"digest.address": digestInput.Address,
+	}
+	// Notifications from before the user opted in aren't included in their first digest
+	if digestInput.Enabled && !user.Digest.Enabled {
+		set["digest.last_sent"] = primitive.NewDateTimeFromTime(time.Now())
+	}
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": set}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Digest settings updated")
+}
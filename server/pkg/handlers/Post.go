@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,7 +10,6 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -18,6 +18,9 @@ import (
 
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
 	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/mentions"
+	"github.com/web-stuff-98/go-social-media/pkg/notifications"
 	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 	"github.com/web-stuff-98/go-social-media/pkg/validation"
@@ -46,6 +49,15 @@ func (h handler) VoteOnPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Pids[postId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example posts")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -64,6 +76,14 @@ func (h handler) VoteOnPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if visible, err := h.postVisible(r.Context(), postId); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if !visible {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
 	votes := &models.PostVotes{}
 	if err := h.Collections.PostVoteCollection.FindOne(r.Context(), bson.M{"_id": postId}).Decode(&votes); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -120,6 +140,18 @@ func (h handler) VoteOnPost(w http.ResponseWriter, r *http.Request) {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 			return
 		}
+		var post models.Post
+		if err := h.Collections.PostCollection.FindOne(r.Context(), bson.M{"_id": postId}, options.FindOne().SetProjection(bson.M{"author_id": 1})).Decode(&post); err == nil {
+			if err := notifications.Create(r.Context(), h.Collections, post.Author, models.Notification{
+				Kind:       notifications.KindPostVote,
+				Actor:      user.ID,
+				TargetID:   postId,
+				TargetType: "POST",
+			}); err != nil {
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
+				return
+			}
+		}
 	} else {
 		if removeVoteIsUpvote {
 			positiveVotes--
@@ -176,6 +208,15 @@ func (h handler) VoteOnPostComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Pids[postId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example posts")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	rawCmtId := mux.Vars(r)["commentId"]
 	commentId, err := primitive.ObjectIDFromHex(rawCmtId)
 	if err != nil {
@@ -201,6 +242,14 @@ func (h handler) VoteOnPostComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if visible, err := h.postVisible(r.Context(), postId); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if !visible {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
 	comments := &models.PostComments{}
 	if err := h.Collections.PostCommentsCollection.FindOne(r.Context(), bson.M{"_id": postId}).Decode(&comments); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -294,7 +343,7 @@ func (h handler) VoteOnPostComment(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) CommentOnPost(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -331,19 +380,45 @@ func (h handler) CommentOnPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Pids[postId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example posts")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[uid]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	var post models.Post
-	if h.Collections.PostCollection.FindOne(r.Context(), bson.M{"_id": postId}).Decode(&post); err != nil {
-		responseMessage(w, http.StatusNotFound, "Post not found")
+	if err := h.Collections.PostCollection.FindOne(r.Context(), bson.M{"_id": postId, "hidden": bson.M{"$ne": true}}).Decode(&post); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Post not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	content, mentioned, err := mentions.Resolve(r.Context(), h.Collections, commentInput.Content)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Validated again, because mentions are stored as <@UID> which is longer than most usernames
+	commentInput.Content = content
+	if err := validate.Struct(commentInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Comment too long once mentions are included")
 		return
 	}
 
 	comment := models.PostComment{
 		ID:        primitive.NewObjectIDFromTimestamp(time.Now()),
 		ParentID:  parentId,
-		Author:    user.ID,
-		Content:   commentInput.Content,
+		Author:    uid,
+		Content:   content,
 		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
 		UpdatedAt: primitive.NewDateTimeFromTime(time.Now()),
+		Mentions:  mentioned,
 	}
 
 	commentsRes, err := h.Collections.PostCommentsCollection.UpdateByID(r.Context(), post.ID, bson.M{"$push": bson.M{"comments": comment}})
@@ -362,6 +437,39 @@ func (h handler) CommentOnPost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if parentId != "" {
+		if parentOid, err := primitive.ObjectIDFromHex(parentId); err == nil {
+			var parentComments models.PostComments
+			if err := h.Collections.PostCommentsCollection.FindOne(r.Context(), bson.M{"_id": post.ID}, options.FindOne().SetProjection(bson.M{
+				"comments": bson.M{"$elemMatch": bson.M{"_id": parentOid}},
+			})).Decode(&parentComments); err == nil && len(parentComments.Comments) > 0 {
+				if err := notifications.Create(r.Context(), h.Collections, parentComments.Comments[0].Author, models.Notification{
+					Kind:       notifications.KindCommentReply,
+					Actor:      uid,
+					TargetID:   comment.ID,
+					TargetType: "POST_COMMENT",
+					ContextID:  post.ID,
+				}); err != nil {
+					responseMessage(w, http.StatusInternalServerError, "Internal error")
+					return
+				}
+			}
+		}
+	}
+
+	for _, oi := range mentioned {
+		if err := notifications.Create(r.Context(), h.Collections, oi, models.Notification{
+			Kind:       notifications.KindMention,
+			Actor:      uid,
+			TargetID:   comment.ID,
+			TargetType: "POST_COMMENT",
+			ContextID:  post.ID,
+		}); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
 	jsonBytes, err := json.Marshal(comment)
 	outBytes, err := json.Marshal(socketmodels.OutChangeMessage{
 		Type:   "CHANGE",
@@ -379,7 +487,7 @@ func (h handler) CommentOnPost(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) DeleteCommentOnPost(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -397,11 +505,21 @@ func (h handler) DeleteCommentOnPost(w http.ResponseWriter, r *http.Request) {
 		responseMessage(w, http.StatusBadRequest, "Invalid ID")
 		return
 	}
+
+	if _, isProtected := h.ProtectedIDs.Pids[postId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example posts")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[uid]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	res, err := h.Collections.PostCommentsCollection.UpdateByID(r.Context(), postId, bson.M{
 		"$pull": bson.M{
 			"comments": bson.M{
 				"_id":       id,
-				"author_id": user.ID,
+				"author_id": uid,
 			},
 			"votes": bson.M{
 				"comment_id": id,
@@ -443,7 +561,7 @@ func (h handler) DeleteCommentOnPost(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) UpdatePostComment(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -479,10 +597,20 @@ func (h handler) UpdatePostComment(w http.ResponseWriter, r *http.Request) {
 		responseMessage(w, http.StatusBadRequest, "Invalid ID")
 		return
 	}
+
+	if _, isProtected := h.ProtectedIDs.Pids[postId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example posts")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[uid]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	res, err := h.Collections.PostCommentsCollection.UpdateOne(r.Context(), bson.M{
 		"_id":                postId,
 		"comments._id":       id,
-		"comments.author_id": user.ID,
+		"comments.author_id": uid,
 	}, bson.M{
 		"$set": bson.M{
 			"comments.$.content": commentInput.Content,
@@ -518,7 +646,7 @@ func (h handler) GetNewestPosts(w http.ResponseWriter, r *http.Request) {
 	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}})
 
 	var posts []models.Post
-	cursor, err := h.Collections.PostCollection.Find(r.Context(), bson.M{"image_pending": false}, findOptions)
+	cursor, err := h.Collections.PostCollection.Find(r.Context(), bson.M{"image_pending": false, "hidden": bson.M{"$ne": true}}, findOptions)
 	defer cursor.Close(r.Context())
 	if err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -612,6 +740,9 @@ func (h handler) GetPage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Posts by soft deleted users are hidden
+	filter["hidden"] = bson.M{"$ne": true}
+
 	// Because countdocuments is expensive O(n), look for the value stored in cache first
 	// It's fine if the count is slightly out of date. Probably a better way to do this
 	var count int64
@@ -711,7 +842,7 @@ func (h handler) GetPost(w http.ResponseWriter, r *http.Request) {
 	slug := mux.Vars(r)["slug"]
 
 	var post models.Post
-	if err := h.Collections.PostCollection.FindOne(r.Context(), bson.M{"slug": slug}).Decode(&post); err != nil {
+	if err := h.Collections.PostCollection.FindOne(r.Context(), bson.M{"slug": slug, "hidden": bson.M{"$ne": true}}).Decode(&post); err != nil {
 		if err == mongo.ErrNoDocuments {
 			responseMessage(w, http.StatusNotFound, "Not found")
 		} else {
@@ -728,6 +859,23 @@ func (h handler) GetPost(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		comments := commentsDoc.Comments
+		// Comments by users who deleted their account are shown the same way they are once the account is purged
+		authorIds := []primitive.ObjectID{}
+		for _, pc := range comments {
+			authorIds = append(authorIds, pc.Author)
+		}
+		deleted, err := helpers.GetDeletedUids(r.Context(), *h.Collections, authorIds)
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		for i, pc := range comments {
+			if deleted[pc.Author] {
+				comments[i].Author = primitive.NilObjectID
+				comments[i].Content = "[deleted]"
+				comments[i].Mentions = []primitive.ObjectID{}
+			}
+		}
 		for _, pcv := range commentsDoc.Votes {
 			for i, pc := range comments {
 				if pc.ID == pcv.CommentID {
@@ -792,6 +940,14 @@ func (h handler) GetPostImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if visible, err := h.postVisible(r.Context(), id); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if !visible {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
 	var postImage models.PostImage
 	if err := h.Collections.PostImageCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&postImage); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -805,7 +961,7 @@ func (h handler) GetPostImage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.Header().Set("Content-Length", strconv.Itoa(len(postImage.Binary.Data)))
 	if _, err := w.Write(postImage.Binary.Data); err != nil {
-		log.Println("Unable to write image to response")
+		imageLog.Error("Unable to write image to response", err, logger.Fields{"path": r.URL.Path})
 	}
 }
 
@@ -817,6 +973,14 @@ func (h handler) GetPostThumb(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if visible, err := h.postVisible(r.Context(), id); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if !visible {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
 	var postThumb models.PostThumb
 	if err := h.Collections.PostThumbCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&postThumb); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -830,12 +994,12 @@ func (h handler) GetPostThumb(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.Header().Set("Content-Length", strconv.Itoa(len(postThumb.Binary.Data)))
 	if _, err := w.Write(postThumb.Binary.Data); err != nil {
-		log.Println("Unable to write image to response")
+		imageLog.Error("Unable to write image to response", err, logger.Fields{"path": r.URL.Path})
 	}
 }
 
 func (h handler) UpdatePost(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -854,7 +1018,7 @@ func (h handler) UpdatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if post.Author != user.ID {
+	if post.Author != uid {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -887,12 +1051,25 @@ func (h handler) UpdatePost(w http.ResponseWriter, r *http.Request) {
 
 	tags = helpers.RemoveDuplicates(tags)
 
+	postBody, mentioned, err := mentions.Resolve(r.Context(), h.Collections, postInput.Body)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Validated again, because mentions are stored as <@UID> which is longer than most usernames
+	postInput.Body = postBody
+	if err := validate.Struct(postInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Body too long once mentions are included")
+		return
+	}
+
 	result, err := h.Collections.PostCollection.UpdateByID(r.Context(), post.ID, bson.M{
 		"$set": bson.M{
 			"title":       postInput.Title,
 			"description": postInput.Description,
-			"body":        postInput.Body,
+			"body":        postBody,
 			"tags":        tags,
+			"mentions":    mentioned,
 			"updated_at":  primitive.NewDateTimeFromTime(time.Now()),
 		},
 	})
@@ -907,11 +1084,27 @@ func (h handler) UpdatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only notify users who weren't already mentioned
+	for _, oi := range mentioned {
+		if containsObjectID(post.Mentions, oi) {
+			continue
+		}
+		if err := notifications.Create(r.Context(), h.Collections, oi, models.Notification{
+			Kind:       notifications.KindMention,
+			Actor:      uid,
+			TargetID:   post.ID,
+			TargetType: "POST",
+		}); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
 	responseMessage(w, http.StatusOK, "Post updated")
 }
 
 func (h handler) CreatePost(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -954,12 +1147,25 @@ func (h handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 
 	tags = helpers.RemoveDuplicates(tags)
 
+	postBody, mentioned, err := mentions.Resolve(r.Context(), h.Collections, postInput.Body)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Validated again, because mentions are stored as <@UID> which is longer than most usernames
+	postInput.Body = postBody
+	if err := validate.Struct(postInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Body too long once mentions are included")
+		return
+	}
+
 	post.ID = primitive.NewObjectIDFromTimestamp(time.Now())
-	post.Author = user.ID
+	post.Author = uid
 	post.Slug = slug
 	post.Title = postInput.Title
 	post.Description = postInput.Description
-	post.Body = postInput.Body
+	post.Body = postBody
+	post.Mentions = mentioned
 	post.CreatedAt = primitive.NewDateTimeFromTime(time.Now())
 	post.UpdatedAt = primitive.NewDateTimeFromTime(time.Now())
 	post.ImagePending = true
@@ -989,6 +1195,18 @@ func (h handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, oi := range mentioned {
+		if err := notifications.Create(r.Context(), h.Collections, oi, models.Notification{
+			Kind:       notifications.KindMention,
+			Actor:      uid,
+			TargetID:   post.ID,
+			TargetType: "POST",
+		}); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(slug)
@@ -997,7 +1215,7 @@ func (h handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 func (h handler) DeletePost(w http.ResponseWriter, r *http.Request) {
 	slug := mux.Vars(r)["slug"]
 
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -1018,7 +1236,7 @@ func (h handler) DeletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if post.Author != user.ID {
+	if post.Author != uid {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -1034,7 +1252,7 @@ func (h handler) DeletePost(w http.ResponseWriter, r *http.Request) {
 func (h handler) UploadPostImage(w http.ResponseWriter, r *http.Request) {
 	slug := mux.Vars(r)["slug"]
 
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -1050,12 +1268,17 @@ func (h handler) UploadPostImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if post.Author != user.ID {
+	if _, isProtected := h.ProtectedIDs.Pids[post.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example posts")
+		return
+	}
+
+	if post.Author != uid {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	r.ParseMultipartForm(32 << 20) // binary shift maximum 20mb in bytes, i think
+	r.ParseMultipartForm(h.Uploads.MaxImageSize)
 
 	file, handler, err := r.FormFile("file")
 	defer file.Close()
@@ -1064,8 +1287,8 @@ func (h handler) UploadPostImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if handler.Size > 20*1024*1024 {
-		responseMessage(w, http.StatusRequestEntityTooLarge, "File too large, max 20mb.")
+	if handler.Size > h.Uploads.MaxImageSize {
+		responseMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, max %vmb.", h.Uploads.MaxImageSize/1024/1024))
 		return
 	}
 
@@ -1168,3 +1391,9 @@ func (h handler) UploadPostImage(w http.ResponseWriter, r *http.Request) {
 
 	responseMessage(w, http.StatusCreated, "Image uploaded")
 }
+
+// Returns false if the post doesn't exist or is hidden because its authors account is deleted
+func (h handler) postVisible(ctx context.Context, postId primitive.ObjectID) (bool, error) {
+	count, err := h.Collections.PostCollection.CountDocuments(ctx, bson.M{"_id": postId, "hidden": bson.M{"$ne": true}})
+	return count > 0, err
+}
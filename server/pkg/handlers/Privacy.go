@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
+	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
+	"github.com/web-stuff-98/go-social-media/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	DM privacy settings. Messages from users the recipients setting doesn't allow
+	go into the recipients message requests instead of their inbox. Only the first
+	message is accepted as a request, the sender has to wait for the recipient to
+	accept or decline it before they can send more.
+*/
+
+const (
+	dmAllowed = iota
+	dmRequest
+	dmPending
+	dmDeclined
+)
+
+func containsObjectID(oids []primitive.ObjectID, oid primitive.ObjectID) bool {
+	for _, oi := range oids {
+		if oi == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// Works out what should happen to a private message from the sender based on the recipients privacy setting
+func getDMStatus(ctx context.Context, colls *db.Collections, senderId primitive.ObjectID, recipientId primitive.ObjectID) (int, error) {
+	recipient := &models.User{}
+	if err := colls.UserCollection.FindOne(ctx, bson.M{"_id": recipientId}, options.FindOne().SetProjection(bson.M{"dm_privacy": 1})).Decode(&recipient); err != nil {
+		return 0, err
+	}
+	inbox := &models.Inbox{}
+	if err := colls.InboxCollection.FindOne(ctx, bson.M{"_id": recipientId}, options.FindOne().SetProjection(bson.M{
+		"messages_sent_to":       1,
+		"accepted_requests_from": 1,
+		"declined_requests_from": 1,
+		"message_requests.uid":   1,
+	})).Decode(&inbox); err != nil {
+		return 0, err
+	}
+	if containsObjectID(inbox.AcceptedRequestsFrom, senderId) {
+		return dmAllowed, nil
+	}
+	if containsObjectID(inbox.DeclinedRequestsFrom, senderId) {
+		return dmDeclined, nil
+	}
+	switch recipient.DMPrivacy {
+	case models.DMPrivacyNobody:
+	case models.DMPrivacyContacts:
+		if containsObjectID(inbox.MessagesSentTo, senderId) {
+			return dmAllowed, nil
+		}
+	default:
+		return dmAllowed, nil
+	}
+	for _, msg := range inbox.MessageRequests {
+		if msg.Uid == senderId {
+			return dmPending, nil
+		}
+	}
+	return dmRequest, nil
+}
+
+func (h handler) GetPrivacySettings(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	dmPrivacy := user.DMPrivacy
+	if dmPrivacy == "" {
+		dmPrivacy = models.DMPrivacyEveryone
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"dm_privacy": dmPrivacy,
+	})
+}
+
+func (h handler) UpdatePrivacySettings(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[uid]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var privacyInput validation.DMPrivacy
+	if err := json.Unmarshal(body, &privacyInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(privacyInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), uid, bson.M{"$set": bson.M{"dm_privacy": privacyInput.DMPrivacy}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Privacy settings updated")
+}
+
+func (h handler) GetMessageRequests(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	inbox := &models.Inbox{}
+	if err := h.Collections.InboxCollection.FindOne(r.Context(), bson.M{"_id": uid}).Decode(&inbox); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	requests := inbox.MessageRequests
+	if requests == nil {
+		requests = []models.PrivateMessage{}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(requests)
+}
+
+func (h handler) AcceptMessageRequest(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	rawUid := mux.Vars(r)["uid"]
+	senderId, err := primitive.ObjectIDFromHex(rawUid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	inbox := &models.Inbox{}
+	if err := h.Collections.InboxCollection.FindOne(r.Context(), bson.M{"_id": user.ID}).Decode(&inbox); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	requests := []models.PrivateMessage{}
+	for _, msg := range inbox.MessageRequests {
+		if msg.Uid == senderId {
+			requests = append(requests, msg)
+		}
+	}
+	if len(requests) == 0 {
+		responseMessage(w, http.StatusNotFound, "Message request not found")
+		return
+	}
+
+	// Move the requests into the inbox, so that they show up in the conversation
+	if _, err := h.Collections.InboxCollection.UpdateByID(r.Context(), user.ID, bson.M{
+		"$push":     bson.M{"messages": bson.M{"$each": requests}},
+		"$pull":     bson.M{"message_requests": bson.M{"uid": senderId}, "declined_requests_from": senderId},
+		"$addToSet": bson.M{"accepted_requests_from": senderId},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if _, err := h.Collections.InboxCollection.UpdateByID(r.Context(), senderId, bson.M{"$addToSet": bson.M{"messages_sent_to": user.ID}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if err := h.sendMessageRequestDelete(user.ID, senderId); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	for _, msg := range requests {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		outBytes, err := json.Marshal(socketmodels.OutMessage{
+			Type: "PRIVATE_MESSAGE",
+			Data: string(data),
+		})
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		h.SocketServer.SendDataToSubscriptions <- socketserver.SubscriptionDataMessageMulti{
+			Names: []string{"inbox=" + senderId.Hex(), "inbox=" + user.ID.Hex()},
+			Data:  outBytes,
+		}
+	}
+
+	responseMessage(w, http.StatusOK, "Message request accepted")
+}
+
+func (h handler) DeclineMessageRequest(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	rawUid := mux.Vars(r)["uid"]
+	senderId, err := primitive.ObjectIDFromHex(rawUid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	res, err := h.Collections.InboxCollection.UpdateOne(r.Context(), bson.M{
+		"_id":                  user.ID,
+		"message_requests.uid": senderId,
+	}, bson.M{
+		"$pull":     bson.M{"message_requests": bson.M{"uid": senderId}, "accepted_requests_from": senderId},
+		"$addToSet": bson.M{"declined_requests_from": senderId},
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		responseMessage(w, http.StatusNotFound, "Message request not found")
+		return
+	}
+
+	if err := h.sendMessageRequestDelete(user.ID, senderId); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Message request declined")
+}
+
+func (h handler) sendMessageRequestDelete(uid primitive.ObjectID, senderId primitive.ObjectID) error {
+	outBytes, err := json.Marshal(socketmodels.OutMessage{
+		Type: "MESSAGE_REQUEST_DELETE",
+		Data: `{"uid":"` + senderId.Hex() + `"}`,
+	})
+	if err != nil {
+		return err
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "inbox=" + uid.Hex(),
+		Data: outBytes,
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
+	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
+	"github.com/web-stuff-98/go-social-media/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var profileLog = logger.New("profile")
+
+/*
+	Profiles. Profile and username changes are sent to the user=UID subscription.
+	Mentions are stored as UIDs, so they don't break when a user changes their username.
+*/
+
+const (
+	usernameChangeCooldown = time.Hour * 24 * 7
+	maxUsernameHistory     = 20
+	userPostsPageSize      = 20
+)
+
+// Usernames are compared case insensitively. This only gives a friendly error early, the unique index
+// on username is what stops two requests from taking the same name at once.
+func usernameTaken(ctx context.Context, colls *db.Collections, username string) (bool, error) {
+	count, err := colls.UserCollection.CountDocuments(ctx, bson.M{"username": username}, options.Count().SetCollation(db.UsernameCollation))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func sendProfileUpdate(ss *socketserver.SocketServer, user *models.User) {
+	data, err := json.Marshal(map[string]interface{}{
+		"ID":           user.ID.Hex(),
+		"username":     user.Username,
+		"display_name": user.DisplayName,
+		"bio":          user.Bio,
+		"links":        user.Links,
+	})
+	if err != nil {
+		profileLog.Error("Failed to marshal profile update", err, logger.Fields{"uid": user.ID.Hex()})
+		return
+	}
+	outBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "UPDATE",
+		Entity: "USER",
+		Data:   string(data),
+	})
+	if err != nil {
+		profileLog.Error("Failed to marshal profile update", err, logger.Fields{"uid": user.ID.Hex()})
+		return
+	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "user=" + user.ID.Hex(),
+		Data: outBytes,
+	}
+}
+
+func (h handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var profileInput validation.Profile
+	if err := json.Unmarshal(body, &profileInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(profileInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if profileInput.Links == nil {
+		profileInput.Links = []string{}
+	}
+	// Links are rendered on the profile, so only allow web links
+	for _, link := range profileInput.Links {
+		if !strings.HasPrefix(link, "https://") && !strings.HasPrefix(link, "http://") {
+			responseMessage(w, http.StatusBadRequest, "Links must start with http:// or https://")
+			return
+		}
+	}
+
+	user.DisplayName = strings.TrimSpace(profileInput.DisplayName)
+	user.Bio = strings.TrimSpace(profileInput.Bio)
+	user.Links = profileInput.Links
+
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": bson.M{
+		"display_name": user.DisplayName,
+		"bio":          user.Bio,
+		"links":        user.Links,
+	}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	sendProfileUpdate(h.SocketServer, user)
+
+	responseMessage(w, http.StatusOK, "Profile updated")
+}
+
+func (h handler) ChangeUsername(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var usernameInput validation.Username
+	if err := json.Unmarshal(body, &usernameInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(usernameInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(user.UsernameHistory) > 0 {
+		nextChange := user.UsernameHistory[len(user.UsernameHistory)-1].ChangedAt.Time().Add(usernameChangeCooldown)
+		if time.Now().Before(nextChange) {
+			responseMessage(w, http.StatusTooManyRequests, "You can change your username again on "+nextChange.Format("January 2"))
+			return
+		}
+	}
+
+	// Changing the case of your own username is allowed
+	if !strings.EqualFold(usernameInput.Username, user.Username) {
+		if taken, err := usernameTaken(r.Context(), h.Collections, usernameInput.Username); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		} else if taken {
+			responseMessage(w, http.StatusBadRequest, "That username is taken")
+			return
+		}
+	} else if usernameInput.Username == user.Username {
+		responseMessage(w, http.StatusBadRequest, "That is already your username")
+		return
+	}
+
+	// Matching on the old username makes sure two changes at the same time can't both go through
+	res, err := h.Collections.UserCollection.UpdateOne(r.Context(), bson.M{
+		"_id":      user.ID,
+		"username": user.Username,
+	}, bson.M{
+		"$set": bson.M{"username": usernameInput.Username},
+		"$push": bson.M{"username_history": bson.M{
+			"$each": []models.UsernameChange{{
+				Username:  user.Username,
+				ChangedAt: primitive.NewDateTimeFromTime(time.Now()),
+			}},
+			"$slice": -maxUsernameHistory,
+		}},
+	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			responseMessage(w, http.StatusBadRequest, "That username is taken")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusConflict, "Your username was changed by another request")
+		return
+	}
+
+	user.Username = usernameInput.Username
+	sendProfileUpdate(h.SocketServer, user)
+
+	responseMessage(w, http.StatusOK, "Username changed")
+}
+
+func (h handler) GetUserPosts(w http.ResponseWriter, r *http.Request) {
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	page := 1
+	if r.URL.Query().Has("page") {
+		page, err = strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			responseMessage(w, http.StatusBadRequest, "Invalid page")
+			return
+		}
+	}
+
+	uid, _ := helpers.GetUidFromRequest(r)
+
+	filter := bson.M{"author_id": id, "image_pending": false, "hidden": bson.M{"$ne": true}}
+	count, err := h.Collections.PostCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	cursor, err := h.Collections.PostCollection.Find(r.Context(), filter, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64(userPostsPageSize)*int64(page-1)).
+		SetLimit(userPostsPageSize).
+		SetProjection(bson.M{"body": 0}))
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	posts := []models.Post{}
+	for cursor.Next(r.Context()) {
+		var post models.Post
+		if err := cursor.Decode(&post); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		var votes models.PostVotes
+		if err := h.Collections.PostVoteCollection.FindOne(r.Context(), bson.M{"_id": post.ID}).Decode(&votes); err != nil && err != mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		// The users own vote is sent seperately from the counts, the same as on the posts page
+		for _, v := range votes.Votes {
+			if v.Uid == uid && uid != primitive.NilObjectID {
+				post.UsersVote = v
+			} else if v.IsUpvote {
+				post.PositiveVoteCount++
+			} else {
+				post.NegativeVoteCount++
+			}
+		}
+		posts = append(posts, post)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"posts": posts,
+		"count": count,
+	})
+}
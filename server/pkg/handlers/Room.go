@@ -10,7 +10,6 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -21,6 +20,8 @@ import (
 	"github.com/nfnt/resize"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
 	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/notifications"
 	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 	"github.com/web-stuff-98/go-social-media/pkg/validation"
@@ -31,7 +32,7 @@ import (
 )
 
 func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -61,7 +62,7 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 	}
 	if r.URL.Query().Has("OWN_ROOMS") {
 		filter = bson.M{
-			"author_id": user.ID,
+			"author_id": uid,
 		}
 		if r.URL.Query().Has("term") {
 			if r.URL.Query().Get("term") != " " {
@@ -70,14 +71,14 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 						"$search":        r.URL.Query().Get("term"),
 						"$caseSensitive": false,
 					},
-					"author_id": user.ID,
+					"author_id": uid,
 				}
 			}
 		}
 	}
 	if r.URL.Query().Has("INVITED_ROOMS") {
 		matchingIds := []primitive.ObjectID{}
-		if cursor, err := h.Collections.RoomPrivateDataCollection.Find(r.Context(), bson.M{"members": bson.M{"$all": []primitive.ObjectID{user.ID}}}); err != nil {
+		if cursor, err := h.Collections.RoomPrivateDataCollection.Find(r.Context(), bson.M{"members": bson.M{"$all": []primitive.ObjectID{uid}}}); err != nil {
 			cursor.Close(r.Context())
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 			return
@@ -110,6 +111,9 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Rooms by soft deleted users are hidden
+	filter["hidden"] = bson.M{"$ne": true}
+
 	// Because countdocuments is expensive, O(n) it says in docs, look for the value stored in cache first
 	// It's fine if the count is slightly out of date. Probably a better way to do this
 	var count int64
@@ -160,11 +164,11 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		rooms[i].CanAccess = true
-		if room.Author != user.ID {
+		if room.Author != uid {
 			if room.Private {
 				isMember := false
 				for _, oi := range privateData.Members {
-					if oi == user.ID {
+					if oi == uid {
 						isMember = true
 						break
 					}
@@ -173,7 +177,7 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 			}
 			for _, oi := range privateData.Banned {
 				isBanned := false
-				if oi == user.ID {
+				if oi == uid {
 					isBanned = true
 					break
 				}
@@ -197,14 +201,14 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) GetOwnRooms(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	rooms := []models.Room{}
-	cursor, err := h.Collections.RoomCollection.Find(r.Context(), bson.M{"author_id": user.ID})
+	cursor, err := h.Collections.RoomCollection.Find(r.Context(), bson.M{"author_id": uid})
 	defer cursor.Close(r.Context())
 	for cursor.Next(r.Context()) {
 		room := &models.Room{}
@@ -231,6 +235,15 @@ func (h handler) InviteToRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	room := &models.Room{}
 	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -261,6 +274,29 @@ func (h handler) InviteToRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if blocked, err := helpers.IsBlockedBy(r.Context(), *h.Collections, recipientId, user.ID); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if blocked {
+		responseMessage(w, http.StatusForbidden, "This user has blocked you")
+		return
+	}
+
+	// Invitations are private messages, so they follow the recipients DM privacy setting
+	dmStatus, err := getDMStatus(r.Context(), h.Collections, user.ID, recipientId)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	switch dmStatus {
+	case dmDeclined:
+		responseMessage(w, http.StatusForbidden, "This user is not accepting messages from you")
+		return
+	case dmPending:
+		responseMessage(w, http.StatusForbidden, "You have to wait for this user to accept your message request")
+		return
+	}
+
 	msg := &models.PrivateMessage{
 		ID:                   primitive.NewObjectID(),
 		Content:              id.Hex(),
@@ -274,6 +310,33 @@ func (h handler) InviteToRoom(w http.ResponseWriter, r *http.Request) {
 		HasAttachment:        false,
 	}
 
+	// The invitation becomes a message request, it moves into the inbox if the recipient accepts it
+	if dmStatus == dmRequest {
+		if _, err := h.Collections.InboxCollection.UpdateByID(r.Context(), recipientId, bson.M{"$push": bson.M{"message_requests": msg}}); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		outBytes, err := json.Marshal(socketmodels.OutMessage{
+			Type: "MESSAGE_REQUEST",
+			Data: string(data),
+		})
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		h.SocketServer.SendDataToSubscriptions <- socketserver.SubscriptionDataMessageMulti{
+			Names: []string{"inbox=" + recipientId.Hex(), "inbox=" + user.ID.Hex()},
+			Data:  outBytes,
+		}
+		responseMessage(w, http.StatusCreated, "Invitation sent as a message request")
+		return
+	}
+
 	if _, err := h.Collections.InboxCollection.UpdateByID(r.Context(), recipientId, bson.M{"$push": bson.M{"messages": msg}}); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
@@ -284,24 +347,14 @@ func (h handler) InviteToRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hasConvsOpenWithRecv := make(chan bool)
-	h.SocketServer.GetUserConversationsOpenWith <- socketserver.GetUserConversationsOpenWith{
-		RecvChan: hasConvsOpenWithRecv,
-		Uid:      recipientId,
-		UidB:     user.ID,
-	}
-	hasConvsOpenWith := <-hasConvsOpenWithRecv
-	addNotification := !hasConvsOpenWith
-
-	if addNotification {
-		if _, err := h.Collections.NotificationsCollection.UpdateByID(context.TODO(), recipientId, bson.M{
-			"$push": bson.M{
-				"notifications": bson.M{"type": "MSG:" + user.ID.Hex()},
-			},
-		}); err != nil {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-			return
-		}
+	if err := notifications.Create(r.Context(), h.Collections, recipientId, models.Notification{
+		Kind:       notifications.KindRoomInvitation,
+		Actor:      user.ID,
+		TargetID:   room.ID,
+		TargetType: "ROOM",
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
 	data, err := json.Marshal(msg)
@@ -341,6 +394,15 @@ func (h handler) AcceptRoomInvite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	rawMsgId := mux.Vars(r)["msgId"]
 	msgId, err := primitive.ObjectIDFromHex(rawMsgId)
 	if err != nil {
@@ -464,6 +526,15 @@ func (h handler) DeclineRoomInvite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
 	rawMsgId := mux.Vars(r)["msgId"]
 	msgId, err := primitive.ObjectIDFromHex(rawMsgId)
 	if err != nil {
@@ -555,6 +626,11 @@ func (h handler) BanUserFromRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
 	room := &models.Room{}
 	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -585,7 +661,7 @@ func (h handler) BanUserFromRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := h.Collections.RoomPrivateDataCollection.UpdateByID(r.Context(), id, bson.M{"$addToSet": bson.M{"banned": uid}, "$pull": bson.M{"members": uid}}); err != nil {
+	if _, err := h.Collections.RoomPrivateDataCollection.UpdateByID(r.Context(), id, bson.M{"$addToSet": bson.M{"banned": uid}, "$pull": bson.M{"members": uid, "moderators": uid}}); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
@@ -595,6 +671,16 @@ func (h handler) BanUserFromRoom(w http.ResponseWriter, r *http.Request) {
 		Uid:  uid,
 	}
 
+	if err := notifications.Create(r.Context(), h.Collections, uid, models.Notification{
+		Kind:       notifications.KindRoomBan,
+		Actor:      user.ID,
+		TargetID:   room.ID,
+		TargetType: "ROOM",
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
 	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
 		Type:   "CHANGE",
 		Method: "INSERT",
@@ -633,6 +719,11 @@ func (h handler) UnBanUserFromRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
 	room := &models.Room{}
 	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -690,7 +781,7 @@ func (h handler) UnBanUserFromRoom(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -716,7 +807,7 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 
 	numRooms := 0
 	cur, err := h.Collections.RoomCollection.Find(r.Context(), bson.M{
-		"author_id": user.ID,
+		"author_id": uid,
 	})
 	defer cur.Close(r.Context())
 	if err != nil {
@@ -742,7 +833,7 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	var room = &models.Room{
 		ID:           primitive.NewObjectIDFromTimestamp(time.Now()),
 		Name:         roomInput.Name,
-		Author:       user.ID,
+		Author:       uid,
 		CreatedAt:    primitive.NewDateTimeFromTime(time.Now()),
 		UpdatedAt:    primitive.NewDateTimeFromTime(time.Now()),
 		ImgBlur:      "",
@@ -759,6 +850,7 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	var roomMessages = &models.RoomMessages{
 		ID:       inserted.InsertedID.(primitive.ObjectID),
 		Messages: []models.RoomMessage{},
+		Pinned:   []primitive.ObjectID{},
 	}
 
 	if _, err := h.Collections.RoomMessagesCollection.InsertOne(r.Context(), roomMessages); err != nil {
@@ -767,9 +859,10 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var roomPrivateData = &models.RoomPrivateData{
-		ID:      inserted.InsertedID.(primitive.ObjectID),
-		Members: []primitive.ObjectID{},
-		Banned:  []primitive.ObjectID{},
+		ID:         inserted.InsertedID.(primitive.ObjectID),
+		Members:    []primitive.ObjectID{},
+		Banned:     []primitive.ObjectID{},
+		Moderators: []primitive.ObjectID{},
 	}
 
 	if _, err := h.Collections.RoomPrivateDataCollection.InsertOne(r.Context(), roomPrivateData); err != nil {
@@ -783,7 +876,7 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) GetRoomPrivateData(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -818,13 +911,13 @@ func (h handler) GetRoomPrivateData(w http.ResponseWriter, r *http.Request) {
 
 	userIsMember := false
 	for _, oi := range roomPrivateData.Members {
-		if oi == user.ID {
+		if oi == uid {
 			userIsMember = true
 			break
 		}
 	}
 
-	if room.Author != user.ID && !userIsMember {
+	if room.Author != uid && !userIsMember {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -849,7 +942,7 @@ func (h handler) GetRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var room models.Room
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId, "hidden": bson.M{"$ne": true}}).Decode(&room); err != nil {
 		if err == mongo.ErrNoDocuments {
 			responseMessage(w, http.StatusNotFound, "Room not found")
 		} else {
@@ -866,7 +959,7 @@ func (h handler) GetRoom(w http.ResponseWriter, r *http.Request) {
 	for _, oi := range roomPrivateData.Banned {
 		if oi == user.ID {
 			responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
-			break
+			return
 		}
 	}
 	if room.Private == true {
@@ -893,7 +986,44 @@ func (h handler) GetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Leave out messages from users who deleted their account, they are removed once the account is purged
+	senderIds := []primitive.ObjectID{}
+	for _, msg := range roomMessages.Messages {
+		senderIds = append(senderIds, msg.Uid)
+	}
+	deleted, err := helpers.GetDeletedUids(r.Context(), *h.Collections, senderIds)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Mark messages from users the requester has blocked so that the client can collapse them
+	blocked := make(map[primitive.ObjectID]bool)
+	for _, oi := range user.Blocked {
+		blocked[oi] = true
+	}
+	messages := []models.RoomMessage{}
+	for _, msg := range roomMessages.Messages {
+		if deleted[msg.Uid] {
+			continue
+		}
+		msg.Blocked = blocked[msg.Uid]
+		messages = append(messages, msg)
+	}
+	roomMessages.Messages = messages
+
 	room.Messages = roomMessages.Messages
+	room.Announcement = roomMessages.Announcement
+	room.CanModerate = isRoomModerator(&room, &roomPrivateData, user.ID)
+	// Leave out pins for messages that no longer exist
+	room.Pinned = []primitive.ObjectID{}
+	for _, pinnedId := range roomMessages.Pinned {
+		for _, msg := range roomMessages.Messages {
+			if msg.ID == pinnedId {
+				room.Pinned = append(room.Pinned, pinnedId)
+				break
+			}
+		}
+	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -901,7 +1031,7 @@ func (h handler) GetRoom(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	uid, err := helpers.GetUidFromRequest(r)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -925,7 +1055,7 @@ func (h handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if room.Author != user.ID {
+	if room.Author != uid {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -956,7 +1086,7 @@ func (h handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
 			"$regex":   roomInput.Name,
 			"$options": "i",
 		},
-		"author_id": user.ID,
+		"author_id": uid,
 	})
 	defer cursor.Close(r.Context())
 	if err != nil {
@@ -999,7 +1129,7 @@ func (h handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
 	responseMessage(w, http.StatusOK, "Room updated")
 }
 
-func (h handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+func (h handler) SetRoomSlowMode(w http.ResponseWriter, r *http.Request) {
 	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
@@ -1024,7 +1154,7 @@ func (h handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
-		responseMessage(w, http.StatusUnauthorized, "You cannot delete example rooms")
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
 		return
 	}
 
@@ -1033,78 +1163,648 @@ func (h handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := h.Collections.RoomCollection.DeleteOne(r.Context(), bson.M{"_id": roomId})
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		responseMessage(w, http.StatusBadRequest, "Bad request")
 		return
 	}
-	if res.DeletedCount == 0 {
-		responseMessage(w, http.StatusNotFound, "Not found")
+
+	var slowModeInput validation.RoomSlowMode
+	if err := json.Unmarshal(body, &slowModeInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(slowModeInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	responseMessage(w, http.StatusOK, "Room deleted")
+	// The room update changestream sends the new slow mode value to the room subscribers
+	if _, err := h.Collections.RoomCollection.UpdateByID(r.Context(), roomId, bson.M{
+		"$set": bson.M{"slow_mode": slowModeInput.Seconds},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Slow mode updated")
 }
 
-func (h handler) GetRoomImage(w http.ResponseWriter, r *http.Request) {
+const maxPinnedRoomMessages = 5
+
+// Returns true if the room isn't hidden, the user isn't banned, and is a member or the author if the room is private
+func userCanAccessRoom(room *models.Room, roomPrivateData *models.RoomPrivateData, uid primitive.ObjectID) bool {
+	if room.Hidden {
+		return false
+	}
+	for _, oi := range roomPrivateData.Banned {
+		if oi == uid {
+			return false
+		}
+	}
+	if room.Private && room.Author != uid {
+		for _, oi := range roomPrivateData.Members {
+			if oi == uid {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Returns true if the user is the rooms author or one of its moderators
+func isRoomModerator(room *models.Room, roomPrivateData *models.RoomPrivateData, uid primitive.ObjectID) bool {
+	if room.Author == uid {
+		return true
+	}
+	for _, oi := range roomPrivateData.Moderators {
+		if oi == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (h handler) AddRoomModerator(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
 	rawId := mux.Vars(r)["id"]
-	roomId, err := primitive.ObjectIDFromHex(rawId)
+	id, err := primitive.ObjectIDFromHex(rawId)
 	if err != nil {
 		responseMessage(w, http.StatusBadRequest, "Invalid ID")
 		return
 	}
 
-	var roomImage models.RoomImage
-	if err := h.Collections.RoomImageCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomImage); err != nil {
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
+	room := &models.Room{}
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
 		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
+			responseMessage(w, http.StatusNotFound, "Room not found")
 		} else {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Content-Length", strconv.Itoa(len(roomImage.Binary.Data)))
-	if _, err := w.Write(roomImage.Binary.Data); err != nil {
-		log.Println("Unable to write image to response")
+	if room.Author != user.ID {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var rawUid string
+	if r.URL.Query().Has("uid") {
+		rawUid = r.URL.Query().Get("uid")
+	} else {
+		responseMessage(w, http.StatusBadRequest, "No UID provided")
+		return
+	}
+
+	uid, err := primitive.ObjectIDFromHex(rawUid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid UID")
+		return
+	}
+
+	if uid == user.ID {
+		responseMessage(w, http.StatusBadRequest, "You are already the owner of this room")
+		return
+	}
+
+	roomPrivateData := &models.RoomPrivateData{}
+	if err := h.Collections.RoomPrivateDataCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomPrivateData); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for _, oi := range roomPrivateData.Banned {
+		if oi == uid {
+			responseMessage(w, http.StatusBadRequest, "This user is banned from the room")
+			return
+		}
+	}
+	if room.Private {
+		isMember := false
+		for _, oi := range roomPrivateData.Members {
+			if oi == uid {
+				isMember = true
+				break
+			}
+		}
+		if !isMember {
+			responseMessage(w, http.StatusBadRequest, "This user is not a member of the room")
+			return
+		}
+	}
+
+	if _, err := h.Collections.RoomPrivateDataCollection.UpdateByID(r.Context(), id, bson.M{"$addToSet": bson.M{"moderators": uid}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "INSERT",
+		Entity: "MODERATOR",
+		Data:   `{"ID":"` + uid.Hex() + `"}`,
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "room_private_data=" + room.ID.Hex(),
+		Data: outChangeBytes,
+	}
+
+	h.SocketServer.SendDataToUser <- socketserver.UserDataMessage{
+		Uid: uid,
+		Data: socketmodels.OutChangeMessage{
+			Method: "UPDATE",
+			Entity: "ROOM",
+			Data:   `{"ID":"` + room.ID.Hex() + `","can_moderate":true}`,
+		},
+		Type: "CHANGE",
 	}
+
+	responseMessage(w, http.StatusOK, "Moderator added")
 }
 
-func (h handler) UploadRoomImage(w http.ResponseWriter, r *http.Request) {
+func (h handler) RemoveRoomModerator(w http.ResponseWriter, r *http.Request) {
 	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
 	if err != nil {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+
 	rawId := mux.Vars(r)["id"]
-	roomId, err := primitive.ObjectIDFromHex(rawId)
+	id, err := primitive.ObjectIDFromHex(rawId)
 	if err != nil {
 		responseMessage(w, http.StatusBadRequest, "Invalid ID")
 		return
 	}
 
-	var room models.Room
-	if h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
+	if _, isProtected := h.ProtectedIDs.Rids[id]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
+	room := &models.Room{}
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Room not found")
 		} else {
-			responseMessage(w, http.StatusNotFound, "Not found")
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
 		}
 		return
 	}
 
-	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
-		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+	var rawUid string
+	if r.URL.Query().Has("uid") {
+		rawUid = r.URL.Query().Get("uid")
+	} else {
+		responseMessage(w, http.StatusBadRequest, "No UID provided")
 		return
 	}
 
-	if room.Author != user.ID {
+	uid, err := primitive.ObjectIDFromHex(rawUid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid UID")
+		return
+	}
+
+	// Moderators can step down themselves, otherwise only the owner can remove moderators
+	if room.Author != user.ID && uid != user.ID {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	res, err := h.Collections.RoomPrivateDataCollection.UpdateByID(r.Context(), id, bson.M{"$pull": bson.M{"moderators": uid}})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "This user is not a moderator")
+		return
+	}
+
+	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "DELETE",
+		Entity: "MODERATOR",
+		Data:   `{"ID":"` + uid.Hex() + `"}`,
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "room_private_data=" + room.ID.Hex(),
+		Data: outChangeBytes,
+	}
+
+	h.SocketServer.SendDataToUser <- socketserver.UserDataMessage{
+		Uid: uid,
+		Data: socketmodels.OutChangeMessage{
+			Method: "UPDATE",
+			Entity: "ROOM",
+			Data:   `{"ID":"` + room.ID.Hex() + `","can_moderate":false}`,
+		},
+		Type: "CHANGE",
+	}
+
+	responseMessage(w, http.StatusOK, "Moderator removed")
+}
+
+func (h handler) PinRoomMessage(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	roomId, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
+	rawMsgId := mux.Vars(r)["msgId"]
+	msgId, err := primitive.ObjectIDFromHex(rawMsgId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	room := &models.Room{}
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Room not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	roomPrivateData := &models.RoomPrivateData{}
+	if err := h.Collections.RoomPrivateDataCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if !isRoomModerator(room, roomPrivateData, uid) {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Only matches if the message exists and there is space for another pin
+	res, err := h.Collections.RoomMessagesCollection.UpdateOne(r.Context(), bson.M{
+		"_id":          roomId,
+		"messages._id": msgId,
+		"pinned." + strconv.Itoa(maxPinnedRoomMessages-1): bson.M{"$exists": false},
+	}, bson.M{
+		"$addToSet": bson.M{"pinned": msgId},
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		count, err := h.Collections.RoomMessagesCollection.CountDocuments(r.Context(), bson.M{"_id": roomId, "messages._id": msgId})
+		if err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		if count == 0 {
+			responseMessage(w, http.StatusNotFound, "Message not found")
+		} else {
+			responseMessage(w, http.StatusBadRequest, fmt.Sprintf("You can pin a maximum of %d messages", maxPinnedRoomMessages))
+		}
+		return
+	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "Message is already pinned")
+		return
+	}
+
+	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "INSERT",
+		Entity: "PINNED_MESSAGE",
+		Data:   `{"ID":"` + msgId.Hex() + `","room_id":"` + roomId.Hex() + `"}`,
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "room=" + roomId.Hex(),
+		Data: outChangeBytes,
+	}
+
+	responseMessage(w, http.StatusOK, "Message pinned")
+}
+
+func (h handler) UnpinRoomMessage(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	roomId, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
+	rawMsgId := mux.Vars(r)["msgId"]
+	msgId, err := primitive.ObjectIDFromHex(rawMsgId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	room := &models.Room{}
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Room not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	roomPrivateData := &models.RoomPrivateData{}
+	if err := h.Collections.RoomPrivateDataCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if !isRoomModerator(room, roomPrivateData, uid) {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	res, err := h.Collections.RoomMessagesCollection.UpdateByID(r.Context(), roomId, bson.M{
+		"$pull": bson.M{"pinned": msgId},
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "Message is not pinned")
+		return
+	}
+
+	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "DELETE",
+		Entity: "PINNED_MESSAGE",
+		Data:   `{"ID":"` + msgId.Hex() + `","room_id":"` + roomId.Hex() + `"}`,
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "room=" + roomId.Hex(),
+		Data: outChangeBytes,
+	}
+
+	responseMessage(w, http.StatusOK, "Message unpinned")
+}
+
+func (h handler) SetRoomAnnouncement(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	roomId, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	room := &models.Room{}
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Room not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
+	roomPrivateData := &models.RoomPrivateData{}
+	if err := h.Collections.RoomPrivateDataCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if !isRoomModerator(room, roomPrivateData, uid) {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var announcementInput validation.RoomAnnouncement
+	if err := json.Unmarshal(body, &announcementInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(announcementInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// An empty announcement removes the banner
+	announcement := strings.TrimSpace(announcementInput.Announcement)
+	if _, err := h.Collections.RoomMessagesCollection.UpdateByID(r.Context(), roomId, bson.M{
+		"$set": bson.M{"announcement": announcement},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	dataBytes, err := json.Marshal(map[string]string{
+		"ID":           roomId.Hex(),
+		"announcement": announcement,
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "UPDATE",
+		Entity: "ROOM",
+		Data:   string(dataBytes),
+	})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	h.SocketServer.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "room=" + roomId.Hex(),
+		Data: outChangeBytes,
+	}
+
+	responseMessage(w, http.StatusOK, "Announcement updated")
+}
+
+func (h handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	roomId, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	var room models.Room
+	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Room not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot delete example rooms")
+		return
+	}
+
+	if room.Author != uid {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	res, err := h.Collections.RoomCollection.DeleteOne(r.Context(), bson.M{"_id": roomId})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Room deleted")
+}
+
+func (h handler) GetRoomImage(w http.ResponseWriter, r *http.Request) {
+	rawId := mux.Vars(r)["id"]
+	roomId, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if count, err := h.Collections.RoomCollection.CountDocuments(r.Context(), bson.M{"_id": roomId, "hidden": bson.M{"$ne": true}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if count == 0 {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	var roomImage models.RoomImage
+	if err := h.Collections.RoomImageCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomImage); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(roomImage.Binary.Data)))
+	if _, err := w.Write(roomImage.Binary.Data); err != nil {
+		imageLog.Error("Unable to write image to response", err, logger.Fields{"path": r.URL.Path})
+	}
+}
+
+func (h handler) UploadRoomImage(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	rawId := mux.Vars(r)["id"]
+	roomId, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	var room models.Room
+	if h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err != mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		} else {
+			responseMessage(w, http.StatusNotFound, "Not found")
+		}
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Rids[roomId]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example rooms")
+		return
+	}
+
+	if room.Author != uid {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	r.ParseMultipartForm(32 << 40)
+	r.ParseMultipartForm(h.Uploads.MaxImageSize)
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
@@ -1113,8 +1813,8 @@ func (h handler) UploadRoomImage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	if handler.Size > 20*1024*1024 {
-		responseMessage(w, http.StatusRequestEntityTooLarge, "File too large, max 20mb.")
+	if handler.Size > h.Uploads.MaxImageSize {
+		responseMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, max %vmb.", h.Uploads.MaxImageSize/1024/1024))
 		return
 	}
 
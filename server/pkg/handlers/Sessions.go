@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Each device the user logs in on gets its own session. Revoking a session
+	closes the websocket connections that were made with it.
+*/
+
+func (h handler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	user, currentSession, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	cursor, err := h.Collections.SessionCollection.Find(r.Context(), bson.M{"_uid": user.ID}, options.Find().SetSort(bson.M{"last_used": -1}))
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	sessions := []models.Session{}
+	for cursor.Next(r.Context()) {
+		var session models.Session
+		if err := cursor.Decode(&session); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		// The TTL index doesn't remove expired sessions straight away
+		if session.ExpiresAt.Time().Before(time.Now()) {
+			continue
+		}
+		session.IsCurrent = session.ID == currentSession.ID
+		sessions = append(sessions, session)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, currentSession, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	res, err := h.Collections.SessionCollection.DeleteOne(r.Context(), bson.M{"_id": id, "_uid": user.ID})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		responseMessage(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	h.SocketServer.CloseSessionConns <- id
+
+	if id == currentSession.ID {
+		setCookies(w, helpers.GetClearedCookies())
+	}
+
+	responseMessage(w, http.StatusOK, "Session revoked")
+}
+
+func (h handler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user, currentSession, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	if err := h.revokeOtherSessions(r.Context(), user.ID, currentSession.ID); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Other sessions revoked")
+}
+
+// Deletes all the users sessions except the current one, and closes their connections
+func (h handler) revokeOtherSessions(ctx context.Context, uid primitive.ObjectID, currentSid primitive.ObjectID) error {
+	filter := bson.M{"_uid": uid, "_id": bson.M{"$ne": currentSid}}
+
+	cursor, err := h.Collections.SessionCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	sids := []primitive.ObjectID{}
+	for cursor.Next(ctx) {
+		var session models.Session
+		if err := cursor.Decode(&session); err == nil {
+			sids = append(sids, session.ID)
+		}
+	}
+	cursor.Close(ctx)
+
+	if _, err := h.Collections.SessionCollection.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+
+	for _, sid := range sids {
+		h.SocketServer.CloseSessionConns <- sid
+	}
+	return nil
+}
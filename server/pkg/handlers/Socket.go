@@ -2,18 +2,22 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 
+	"github.com/go-redis/redis/v9"
 	"github.com/web-stuff-98/go-social-media/pkg/attachmentserver"
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+var socketLog = logger.New("socket")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  2048,
 	WriteBufferSize: 2048,
@@ -25,21 +29,19 @@ var upgrader = websocket.Upgrader{
 	Voting and commenting are done in the API handlers, I could have put that in here but I didn't
 
 	Todo:
-	 - sendErrorMessageThroughSocket with http status code and message
+	 - sendErrorMessageThroughSocket with http status code
 */
 
-func reader(conn *websocket.Conn, socketServer *socketserver.SocketServer, attachmentServer *attachmentserver.AttachmentServer, uid *primitive.ObjectID, colls *db.Collections) {
+// ip is the client IP resolved from the upgrade request, guests are rate limited by it
+func reader(conn *websocket.Conn, socketServer *socketserver.SocketServer, attachmentServer *attachmentserver.AttachmentServer, uid *primitive.ObjectID, ip string, colls *db.Collections, rdb *redis.Client, protected *ProtectedIDs) {
 	for {
-		defer func() {
-			r := recover()
-			if r != nil {
-				log.Println("Recovered from panic in WS reader loop : ", r)
-			}
-		}()
+		defer socketLog.Recover("WS reader loop")
 
 		_, p, err := conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				socketLog.Warn("WS read failed", logger.Fields{"error": err.Error(), "uid": uid.Hex()})
+			}
 			return
 		}
 
@@ -49,24 +51,38 @@ func reader(conn *websocket.Conn, socketServer *socketserver.SocketServer, attac
 		eventType, eventTypeOk := data["event_type"]
 
 		if eventTypeOk {
-			err := HandleSocketEvent(eventType.(string), p, conn, *uid, socketServer, attachmentServer, colls)
+			err := HandleSocketEvent(eventType.(string), p, conn, *uid, ip, socketServer, attachmentServer, colls, rdb, protected)
 			if err != nil {
-				sendErrorMessageThroughSocket(conn)
+				var sErr socketErr
+				if errors.As(err, &sErr) {
+					sendErrorMessageThroughSocket(conn, sErr.msg)
+				} else {
+					socketLog.Error("Socket event failed", err, logger.Fields{"event_type": eventType, "uid": uid.Hex()})
+					sendErrorMessageThroughSocket(conn, "Socket error")
+				}
 			}
 		} else {
 			// eventType was not received. Send error.
-			sendErrorMessageThroughSocket(conn)
+			sendErrorMessageThroughSocket(conn, "Socket error")
 		}
 	}
 }
 
-func sendErrorMessageThroughSocket(conn *websocket.Conn) {
-	err := conn.WriteJSON(map[string]string{
+func sendErrorMessageThroughSocket(conn *websocket.Conn, msg string) {
+	msgBytes, err := json.Marshal(map[string]interface{}{
+		"msg": msg,
+		"err": true,
+	})
+	if err != nil {
+		socketLog.Error("Failed to marshal socket error message", err, nil)
+		return
+	}
+	err = conn.WriteJSON(map[string]string{
 		"TYPE": "RESPONSE_MESSAGE",
-		"DATA": `{"msg":"Socket error","err":true}`,
+		"DATA": string(msgBytes),
 	})
 	if err != nil {
-		log.Println(err)
+		socketLog.Warn("Failed to send socket error message", logger.Fields{"error": err.Error()})
 	}
 }
 
@@ -74,16 +90,15 @@ func (h handler) WebSocketEndpoint(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
-	}
-	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
-	uid := primitive.NilObjectID
-	if user != nil {
-		uid = user.ID
+		socketLog.Warn("WS upgrade failed", logger.Fields{"error": err.Error()})
+		return
 	}
+	// Users don't have to be logged in, uid and sid are left as primitive.NilObjectID if they aren't
+	uid, sid, _ := helpers.GetUidAndSidFromRequest(r)
 	h.SocketServer.RegisterConn <- socketserver.ConnectionInfo{
 		Conn:        ws,
 		Uid:         uid,
+		Sid:         sid,
 		VidChatOpen: false,
 	}
 	defer func() {
@@ -93,5 +108,5 @@ func (h handler) WebSocketEndpoint(w http.ResponseWriter, r *http.Request) {
 			VidChatOpen: false,
 		}
 	}()
-	reader(ws, h.SocketServer, h.AttachmentServer, &uid, h.Collections)
+	reader(ws, h.SocketServer, h.AttachmentServer, &uid, helpers.GetRequestIP(r), h.Collections, h.RedisClient, h.ProtectedIDs)
 }
@@ -5,15 +5,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-redis/redis/v9"
 	"github.com/gorilla/websocket"
 	"github.com/web-stuff-98/go-social-media/pkg/attachmentserver"
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/handlers/middleware"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/mentions"
+	"github.com/web-stuff-98/go-social-media/pkg/notifications"
 	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /*
@@ -21,7 +29,105 @@ import (
 	handling and was getting messy looking.
 */
 
-func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+// Returned by socket event handlers when the error message should be shown to the user,
+// any other error is sent back to the client as a generic socket error.
+type socketErr struct {
+	msg string
+}
+
+func (e socketErr) Error() string {
+	return e.msg
+}
+
+// Same as the limit on the frontend
+const maxRoomMessageLength = 200
+
+// Rate limits for socket events, keyed by event type. Events not in here are not rate limited.
+var socketEventLimits = map[string]middleware.SocketLimiterOpts{
+	"PRIVATE_MESSAGE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been sending too many messages",
+	},
+	"PRIVATE_MESSAGE_UPDATE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been editing too many messages",
+	},
+	"PRIVATE_MESSAGE_DELETE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been deleting too many messages",
+	},
+	"ROOM_MESSAGE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been sending too many messages",
+	},
+	"ROOM_MESSAGE_UPDATE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been editing too many messages",
+	},
+	"ROOM_MESSAGE_DELETE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been deleting too many messages",
+	},
+	"GROUP_MESSAGE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been sending too many messages",
+	},
+	"GROUP_MESSAGE_UPDATE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been editing too many messages",
+	},
+	"GROUP_MESSAGE_DELETE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been deleting too many messages",
+	},
+	"OPEN_SUBSCRIPTIONS": {
+		Window:        time.Second * 10,
+		MaxReqs:       30,
+		BlockDuration: time.Second * 60,
+		Message:       "Too many requests",
+	},
+	"SET_PRESENCE": {
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 60,
+		Message:       "You have been changing your status too often",
+	},
+}
+
+func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid primitive.ObjectID, ip string, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections, rdb *redis.Client, protected *ProtectedIDs) error {
+	if opts, ok := socketEventLimits[eventType]; ok {
+		// Limit by user, or by the client IP if the user isn't logged in
+		key := uid.Hex()
+		if uid == primitive.NilObjectID {
+			key = ip
+		}
+		opts.EventName = eventType
+		blocked, msg, err := middleware.SocketEventRateLimiter(context.Background(), key, opts, rdb)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return socketErr{msg}
+		}
+	}
 	switch eventType {
 	case "OPEN_SUBSCRIPTION":
 		err := openSubscription(data, conn, uid, ss, as, colls)
@@ -35,6 +141,9 @@ func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid
 	case "OPEN_CONV":
 		err := openConv(data, conn, uid, ss, as, colls)
 		return err
+	case "SET_PRESENCE":
+		err := setPresence(data, conn, uid, ss, as, colls)
+		return err
 	case "EXIT_CONV":
 		err := exitConv(data, conn, uid, ss, as, colls)
 		return err
@@ -48,13 +157,22 @@ func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid
 		err := privateMessageUpdate(data, conn, uid, ss, as, colls)
 		return err
 	case "ROOM_MESSAGE":
-		err := roomMessage(data, conn, uid, ss, as, colls)
+		err := roomMessage(data, conn, uid, ss, as, colls, rdb)
 		return err
 	case "ROOM_MESSAGE_DELETE":
-		err := roomMessageDelete(data, conn, uid, ss, as, colls)
+		err := roomMessageDelete(data, conn, uid, ss, as, colls, protected)
 		return err
 	case "ROOM_MESSAGE_UPDATE":
-		err := roomMessageUpdate(data, conn, uid, ss, as, colls)
+		err := roomMessageUpdate(data, conn, uid, ss, as, colls, protected)
+		return err
+	case "GROUP_MESSAGE":
+		err := groupMessage(data, conn, uid, ss, as, colls)
+		return err
+	case "GROUP_MESSAGE_DELETE":
+		err := groupMessageDelete(data, conn, uid, ss, as, colls)
+		return err
+	case "GROUP_MESSAGE_UPDATE":
+		err := groupMessageUpdate(data, conn, uid, ss, as, colls)
 		return err
 	case "VID_SENDING_SIGNAL_IN":
 		err := vidSendingSignalIn(data, conn, uid, ss, as, colls)
@@ -126,9 +244,13 @@ func openConv(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socket
 			ConvUid: convUid,
 		}
 		// Conversation was opened, remove notifications
+		notificationFilter := bson.M{"kind": notifications.KindMessage, "target_id": convUid}
+		if data.IsGroup {
+			notificationFilter["kind"] = notifications.KindGroupMessage
+		}
 		colls.NotificationsCollection.UpdateByID(context.Background(), uid, bson.M{
 			"$pull": bson.M{
-				"notifications": bson.M{"type": "MSG:" + data.Uid},
+				"notifications": notificationFilter,
 			},
 		})
 	}
@@ -151,6 +273,34 @@ func exitConv(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socket
 	return nil
 }
 
+func setPresence(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	var data socketmodels.SetPresence
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	if uid == primitive.NilObjectID {
+		return socketErr{"You must be logged in to set your status"}
+	}
+	switch data.Presence {
+	case models.PresenceOnline, models.PresenceIdle, models.PresenceDND, models.PresenceInvisible:
+	default:
+		return socketErr{"Invalid status"}
+	}
+	set := bson.M{"presence": data.Presence}
+	// Going invisible should look the same as going offline to other users
+	if data.Presence == models.PresenceInvisible {
+		set["last_seen"] = primitive.NewDateTimeFromTime(time.Now())
+	}
+	if _, err := colls.UserCollection.UpdateByID(context.TODO(), uid, bson.M{"$set": set}); err != nil {
+		return err
+	}
+	ss.SetUserPresence <- socketserver.UserPresenceInfo{
+		Uid:      uid,
+		Presence: data.Presence,
+	}
+	return nil
+}
+
 func privateMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
 	var data socketmodels.PrivateMessage
 	if err := json.Unmarshal(b, &data); err != nil {
@@ -160,6 +310,11 @@ func privateMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *
 	if err != nil {
 		return err
 	}
+	if blocked, err := helpers.IsBlockedBy(context.TODO(), *colls, recipientId, uid); err != nil {
+		return err
+	} else if blocked {
+		return socketErr{"This user has blocked you"}
+	}
 	msg := &models.PrivateMessage{
 		ID:                   primitive.NewObjectIDFromTimestamp(time.Now()),
 		Content:              data.Content,
@@ -180,6 +335,44 @@ func privateMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *
 		}
 		msg.HasAttachment = true
 	}
+	dmStatus, err := getDMStatus(context.TODO(), colls, uid, recipientId)
+	if err != nil {
+		return err
+	}
+	switch dmStatus {
+	case dmDeclined:
+		return socketErr{"This user is not accepting messages from you"}
+	case dmPending:
+		return socketErr{"You have to wait for this user to accept your message request"}
+	case dmRequest:
+		if data.HasAttachment {
+			return socketErr{"You cannot send attachments in a message request"}
+		}
+		// No notification for message requests, they go in the recipients message requests instead of their inbox
+		if _, err := colls.InboxCollection.UpdateByID(context.TODO(), recipientId, bson.M{
+			"$push": bson.M{
+				"message_requests": msg,
+			},
+		}); err != nil {
+			return err
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		outBytes, err := json.Marshal(socketmodels.OutMessage{
+			Type: "MESSAGE_REQUEST",
+			Data: string(data),
+		})
+		if err != nil {
+			return err
+		}
+		ss.SendDataToSubscriptions <- socketserver.SubscriptionDataMessageMulti{
+			Names: []string{"inbox=" + recipientId.Hex(), "inbox=" + uid.Hex()},
+			Data:  outBytes,
+		}
+		return nil
+	}
 	if _, err := colls.InboxCollection.UpdateByID(context.TODO(), uid, bson.M{
 		"$addToSet": bson.M{
 			"messages_sent_to": recipientId,
@@ -195,7 +388,15 @@ func privateMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *
 		UidB:     uid,
 	}
 	hasConvsOpenWith := <-hasConvsOpenWithRecv
-	addNotification := !hasConvsOpenWith
+	// Users set to do not disturb don't get notifications for messages
+	presenceRecv := make(chan string)
+	ss.GetUserPresence <- socketserver.GetUserPresence{
+		RecvChan: presenceRecv,
+		Uid:      recipientId,
+	}
+	// Always received, the socket server blocks until it is
+	presence := <-presenceRecv
+	addNotification := !hasConvsOpenWith && presence != models.PresenceDND
 
 	if _, err := colls.InboxCollection.UpdateByID(context.TODO(), recipientId, bson.M{
 		"$push": bson.M{
@@ -205,12 +406,11 @@ func privateMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *
 		return err
 	} else {
 		if addNotification {
-			if _, err := colls.NotificationsCollection.UpdateByID(context.TODO(), recipientId, bson.M{
-				"$push": bson.M{
-					"notifications": models.Notification{
-						Type: "MSG:" + uid.Hex(),
-					},
-				},
+			if err := notifications.Create(context.TODO(), colls, recipientId, models.Notification{
+				Kind:       notifications.KindMessage,
+				Actor:      uid,
+				TargetID:   uid,
+				TargetType: "USER",
 			}); err != nil {
 				return err
 			}
@@ -321,7 +521,7 @@ func privateMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID
 	return nil
 }
 
-func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections, rdb *redis.Client) error {
 	var data socketmodels.RoomMessage
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
@@ -330,13 +530,61 @@ func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *soc
 	if err != nil {
 		return err
 	}
+	room := &models.Room{}
+	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return err
+	}
+	roomPrivateData := &models.RoomPrivateData{}
+	if err := colls.RoomPrivateDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
+		return err
+	}
+	if !userCanAccessRoom(room, roomPrivateData, uid) {
+		return socketErr{"You do not have access to this room"}
+	}
+	content, mentioned, err := mentions.Resolve(context.TODO(), colls, data.Content)
+	if err != nil {
+		return err
+	}
+	// Checked after resolving, because mentions are stored as <@UID> which is longer than most usernames
+	if utf8.RuneCountInString(content) > maxRoomMessageLength {
+		return socketErr{fmt.Sprintf("Message too long, the limit is %d characters including mentions", maxRoomMessageLength)}
+	}
+	// Slow mode doesn't apply to the rooms owner. The key expires when the user is allowed to send another message.
+	// It is removed again if the message isn't sent, so that a failed message doesn't start the cooldown.
+	slowModeKey := ""
+	sent := false
+	defer func() {
+		if slowModeKey != "" && !sent {
+			rdb.Del(context.Background(), slowModeKey)
+		}
+	}()
+	if room.SlowMode > 0 && room.Author != uid {
+		key := "ROOM-SLOW-MODE=" + roomId.Hex() + "=" + uid.Hex()
+		set, err := rdb.SetNX(context.Background(), key, "", time.Duration(room.SlowMode)*time.Second).Result()
+		if err != nil {
+			return err
+		}
+		if !set {
+			ttl, err := rdb.TTL(context.Background(), key).Result()
+			if err != nil {
+				return err
+			}
+			secs := int(ttl.Seconds())
+			if secs < 1 {
+				secs = 1
+			}
+			return socketErr{fmt.Sprintf("Slow mode is enabled in this room. You can send another message in %d seconds", secs)}
+		}
+		slowModeKey = key
+	}
 	msg := &models.RoomMessage{
 		ID:            primitive.NewObjectID(),
-		Content:       data.Content,
+		Content:       content,
 		HasAttachment: data.HasAttachment,
 		Uid:           uid,
 		CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
 		UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		Mentions:      mentioned,
 	}
 	if data.HasAttachment {
 		msg.HasAttachment = true
@@ -353,6 +601,7 @@ func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *soc
 	}); err != nil {
 		return err
 	}
+	sent = true
 	outData, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -364,15 +613,57 @@ func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *soc
 	if err != nil {
 		return err
 	}
-	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
-		Name: "room=" + roomId.Hex(),
-		Data: outBytes,
+	// Users who have blocked the author get a copy of the message marked as blocked
+	blocking, err := helpers.GetUidsBlocking(context.TODO(), *colls, uid)
+	if err != nil {
+		return err
+	}
+	ss.SendDataToSubscriptionExclusive <- socketserver.ExclusiveSubscriptionDataMessage{
+		Name:    "room=" + roomId.Hex(),
+		Data:    outBytes,
+		Exclude: blocking,
+	}
+	if len(blocking) > 0 {
+		msg.Blocked = true
+		blockedOutData, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		blockedOutBytes, err := json.Marshal(socketmodels.OutMessage{
+			Type: "ROOM_MESSAGE",
+			Data: string(blockedOutData),
+		})
+		if err != nil {
+			return err
+		}
+		ss.SendDataToSubscriptionInclusive <- socketserver.InclusiveSubscriptionDataMessage{
+			Name:    "room=" + roomId.Hex(),
+			Data:    blockedOutBytes,
+			Include: blocking,
+		}
 	}
 	colls.UserCollection.UpdateByID(context.Background(), uid, bson.M{"$addToSet": bson.M{"rooms_messages_in": roomId}})
+	if len(mentioned) > 0 {
+		// Only notify mentioned users who can access the room
+		for _, oi := range mentioned {
+			if !userCanAccessRoom(room, roomPrivateData, oi) {
+				continue
+			}
+			if err := notifications.Create(context.TODO(), colls, oi, models.Notification{
+				Kind:       notifications.KindMention,
+				Actor:      uid,
+				TargetID:   msg.ID,
+				TargetType: "ROOM_MESSAGE",
+				ContextID:  roomId,
+			}); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func roomMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+func roomMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections, protected *ProtectedIDs) error {
 	var data socketmodels.RoomMessageDelete
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
@@ -381,20 +672,62 @@ func roomMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 	if err != nil {
 		return err
 	}
+	if _, isProtected := protected.Rids[roomId]; isProtected {
+		return socketErr{"You cannot modify example rooms"}
+	}
 	msgId, err := primitive.ObjectIDFromHex(data.MsgId)
 	if err != nil {
 		return err
 	}
-	if _, err := colls.RoomMessagesCollection.UpdateByID(context.TODO(), roomId, bson.M{
+	room := &models.Room{}
+	if err := colls.RoomCollection.FindOne(context.TODO(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return err
+	}
+	roomPrivateData := &models.RoomPrivateData{}
+	if err := colls.RoomPrivateDataCollection.FindOne(context.TODO(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
+		return err
+	}
+	// Moderators can delete any message, everyone else can only delete their own
+	msgFilter := bson.M{"_id": msgId}
+	if !isRoomModerator(room, roomPrivateData, uid) {
+		msgFilter["uid"] = uid
+	}
+	roomMessages := &models.RoomMessages{}
+	if err := colls.RoomMessagesCollection.FindOneAndUpdate(context.TODO(), bson.M{
+		"_id":      roomId,
+		"messages": bson.M{"$elemMatch": msgFilter},
+	}, bson.M{
 		"$pull": bson.M{
 			"messages": bson.M{
 				"_id": msgId,
 			},
+			"pinned": msgId,
 		},
-	}); err != nil {
+	}, options.FindOneAndUpdate().SetProjection(bson.M{"pinned": 1})).Decode(&roomMessages); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return socketErr{"Message not found"}
+		}
 		return err
 	}
 	as.DeleteChunksChan <- msgId
+	for _, oi := range roomMessages.Pinned {
+		if oi == msgId {
+			outChangeBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+				Type:   "CHANGE",
+				Method: "DELETE",
+				Entity: "PINNED_MESSAGE",
+				Data:   `{"ID":"` + msgId.Hex() + `","room_id":"` + roomId.Hex() + `"}`,
+			})
+			if err != nil {
+				return err
+			}
+			ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+				Name: "room=" + roomId.Hex(),
+				Data: outChangeBytes,
+			}
+			break
+		}
+	}
 	outData := make(map[string]interface{})
 	outData["ID"] = msgId.Hex()
 	dataBytes, err := json.Marshal(outData)
@@ -415,7 +748,7 @@ func roomMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 	return nil
 }
 
-func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections, protected *ProtectedIDs) error {
 	var data socketmodels.RoomMessageUpdate
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
@@ -424,6 +757,9 @@ func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 	if err != nil {
 		return err
 	}
+	if _, isProtected := protected.Rids[roomId]; isProtected {
+		return socketErr{"You cannot modify example rooms"}
+	}
 	msgId, err := primitive.ObjectIDFromHex(data.MsgId)
 	if err != nil {
 		return err
@@ -457,6 +793,179 @@ func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 	return nil
 }
 
+func groupMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	var data socketmodels.GroupMessage
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	groupId, err := primitive.ObjectIDFromHex(data.GroupId)
+	if err != nil {
+		return err
+	}
+	group := &models.GroupConversation{}
+	if err := colls.GroupConversationCollection.FindOne(context.TODO(), bson.M{"_id": groupId, "participants": uid}).Decode(&group); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return socketErr{"You are not in this group"}
+		}
+		return err
+	}
+	msg := &models.GroupMessage{
+		ID:            primitive.NewObjectID(),
+		Content:       data.Content,
+		HasAttachment: data.HasAttachment,
+		Uid:           uid,
+		CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+	}
+	if data.HasAttachment {
+		msg.AttachmentProgress = models.AttachmentProgress{
+			Failed:  false,
+			Pending: true,
+			Ratio:   0,
+		}
+	}
+	if _, err := colls.GroupMessagesCollection.UpdateByID(context.TODO(), groupId, bson.M{
+		"$push": bson.M{
+			"messages": msg,
+		},
+	}); err != nil {
+		return err
+	}
+	// Notify participants who don't have the group conversation open
+	for _, oi := range group.Participants {
+		if oi == uid {
+			continue
+		}
+		hasConvOpenRecv := make(chan bool)
+		ss.GetUserConversationsOpenWith <- socketserver.GetUserConversationsOpenWith{
+			RecvChan: hasConvOpenRecv,
+			Uid:      oi,
+			UidB:     groupId,
+		}
+		if hasConvOpen := <-hasConvOpenRecv; !hasConvOpen {
+			if err := notifications.Create(context.TODO(), colls, oi, models.Notification{
+				Kind:       notifications.KindGroupMessage,
+				Actor:      uid,
+				TargetID:   groupId,
+				TargetType: "GROUP",
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	outData, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	outBytes, err := json.Marshal(socketmodels.OutMessage{
+		Type: "GROUP_MESSAGE",
+		Data: string(outData),
+	})
+	if err != nil {
+		return err
+	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "group=" + groupId.Hex(),
+		Data: outBytes,
+	}
+	return nil
+}
+
+func groupMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	var data socketmodels.GroupMessageDelete
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	groupId, err := primitive.ObjectIDFromHex(data.GroupId)
+	if err != nil {
+		return err
+	}
+	msgId, err := primitive.ObjectIDFromHex(data.MsgId)
+	if err != nil {
+		return err
+	}
+	// Users can only delete their own messages
+	res, err := colls.GroupMessagesCollection.UpdateOne(context.TODO(), bson.M{
+		"_id":      groupId,
+		"messages": bson.M{"$elemMatch": bson.M{"_id": msgId, "uid": uid}},
+	}, bson.M{
+		"$pull": bson.M{
+			"messages": bson.M{
+				"_id": msgId,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return socketErr{"Message not found"}
+	}
+	as.DeleteChunksChan <- msgId
+	outBytes, err := json.Marshal(socketmodels.OutMessage{
+		Type: "GROUP_MESSAGE_DELETE",
+		Data: `{"ID":"` + msgId.Hex() + `"}`,
+	})
+	if err != nil {
+		return err
+	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "group=" + groupId.Hex(),
+		Data: outBytes,
+	}
+	return nil
+}
+
+func groupMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	var data socketmodels.GroupMessageUpdate
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	groupId, err := primitive.ObjectIDFromHex(data.GroupId)
+	if err != nil {
+		return err
+	}
+	msgId, err := primitive.ObjectIDFromHex(data.MsgId)
+	if err != nil {
+		return err
+	}
+	// Users can only update their own messages
+	res, err := colls.GroupMessagesCollection.UpdateOne(context.TODO(), bson.M{
+		"_id":      groupId,
+		"messages": bson.M{"$elemMatch": bson.M{"_id": msgId, "uid": uid}},
+	}, bson.M{
+		"$set": bson.M{
+			"messages.$.content":    data.Content,
+			"messages.$.updated_at": primitive.NewDateTimeFromTime(time.Now()),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return socketErr{"Message not found"}
+	}
+	outData, err := json.Marshal(map[string]string{
+		"ID":      msgId.Hex(),
+		"content": data.Content,
+	})
+	if err != nil {
+		return err
+	}
+	outBytes, err := json.Marshal(socketmodels.OutMessage{
+		Type: "GROUP_MESSAGE_UPDATE",
+		Data: string(outData),
+	})
+	if err != nil {
+		return err
+	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "group=" + groupId.Hex(),
+		Data: outBytes,
+	}
+	return nil
+}
+
 func vidSendingSignalIn(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
 	var data socketmodels.InVidChatSendingSignal
 	if err := json.Unmarshal(b, &data); err != nil {
@@ -512,6 +1021,13 @@ func vidJoin(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *sockets
 		if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": joinID}).Decode(&room); err != nil {
 			return err
 		}
+		roomPrivateData := &models.RoomPrivateData{}
+		if err := colls.RoomPrivateDataCollection.FindOne(context.Background(), bson.M{"_id": joinID}).Decode(&roomPrivateData); err != nil {
+			return err
+		}
+		if !userCanAccessRoom(room, roomPrivateData, uid) {
+			return socketErr{"You do not have access to this room"}
+		}
 		// Find all the users connected to the room, check if they have video chat
 		// open in the room, if they do add to allUsers
 		allUsersRecv := make(chan []string)
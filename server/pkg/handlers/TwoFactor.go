@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/deletion"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/passwords"
+	"github.com/web-stuff-98/go-social-media/pkg/totp"
+	"github.com/web-stuff-98/go-social-media/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+	Optional two factor authentication using TOTP. Users enroll, then enable it by entering
+	a code from their authenticator app, which gives them a set of one time recovery codes.
+	Once enabled, login sets a short lived challenge cookie instead of logging the user in,
+	and the user has to send a code to /account/login/two-factor to get their session.
+*/
+
+const (
+	twoFactorIssuer       = "GoSocialMedia"
+	recoveryCodeCount     = 10
+	maxTwoFactorAttempts  = 5 // Wrong codes allowed per user within twoFactorAttemptsTime
+	twoFactorAttemptsTime = time.Minute * 5
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Recovery codes are shown as xxxxx-xxxxx, case and the dash don't matter when they are entered
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns the recovery codes to show the user, and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))[:10]
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Accepts a TOTP code or a recovery code. TOTP codes can only be used once, and recovery codes are removed once used.
+func verifyTwoFactorCode(ctx context.Context, colls *db.Collections, user *models.User, code string) (bool, error) {
+	if step, ok := totp.Validate(code, user.TwoFactor.Secret, time.Now()); ok {
+		res, err := colls.UserCollection.UpdateOne(ctx, bson.M{
+			"_id":                       user.ID,
+			"two_factor.last_used_step": bson.M{"$lt": step},
+		}, bson.M{"$set": bson.M{"two_factor.last_used_step": step}})
+		if err != nil {
+			return false, err
+		}
+		return res.ModifiedCount == 1, nil
+	}
+	hash := hashRecoveryCode(code)
+	res, err := colls.UserCollection.UpdateOne(ctx, bson.M{
+		"_id":                       user.ID,
+		"two_factor.recovery_codes": hash,
+	}, bson.M{"$pull": bson.M{"two_factor.recovery_codes": hash}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (h handler) GetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  user.TwoFactor.Enabled,
+		"recovery_codes_remaining": len(user.TwoFactor.RecoveryCodes),
+	})
+}
+
+func (h handler) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	if user.TwoFactor.Enabled {
+		responseMessage(w, http.StatusBadRequest, "Two factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": bson.M{"two_factor.pending_secret": secret}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    totp.ProvisioningURI(secret, twoFactorIssuer, user.Username),
+	})
+}
+
+func (h handler) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var codeInput validation.TwoFactorCode
+	if err := json.Unmarshal(body, &codeInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(codeInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if user.TwoFactor.Enabled {
+		responseMessage(w, http.StatusBadRequest, "Two factor authentication is already enabled")
+		return
+	}
+	if user.TwoFactor.PendingSecret == "" {
+		responseMessage(w, http.StatusBadRequest, "You need to enroll first")
+		return
+	}
+
+	step, ok := totp.Validate(codeInput.Code, user.TwoFactor.PendingSecret, time.Now())
+	if !ok {
+		responseMessage(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": bson.M{
+		"two_factor": models.TwoFactorSettings{
+			Enabled:       true,
+			Secret:        user.TwoFactor.PendingSecret,
+			RecoveryCodes: hashes,
+			LastUsedStep:  step,
+		},
+	}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	// The recovery codes are only ever shown here
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+func (h handler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var disableInput validation.DisableTwoFactor
+	if err := json.Unmarshal(body, &disableInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(disableInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !user.TwoFactor.Enabled {
+		responseMessage(w, http.StatusBadRequest, "Two factor authentication is not enabled")
+		return
+	}
+
+	// The user has to authenticate again to disable it
+	if !passwords.Compare(user.Password, disableInput.Password) {
+		responseMessage(w, http.StatusUnauthorized, "Incorrect credentials")
+		return
+	}
+	if ok, err := verifyTwoFactorCode(r.Context(), h.Collections, user, disableInput.Code); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if !ok {
+		responseMessage(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	if _, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$set": bson.M{"two_factor": models.TwoFactorSettings{}}}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "Two factor authentication disabled")
+}
+
+// The second step of login for users with two factor authentication
+func (h handler) VerifyTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	uid, err := helpers.GetUidFromTwoFactorChallenge(r)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Your login has expired, enter your password again")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	var codeInput validation.TwoFactorCode
+	if err := json.Unmarshal(body, &codeInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(codeInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Limit wrong codes by user as well as by address, so that guesses can't be spread out over addresses
+	attemptsKey := "TWO_FACTOR_ATTEMPTS=" + uid.Hex()
+	attempts, err := h.RedisClient.Incr(r.Context(), attemptsKey).Result()
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if attempts == 1 {
+		h.RedisClient.Expire(r.Context(), attemptsKey, twoFactorAttemptsTime)
+	}
+	if attempts > maxTwoFactorAttempts {
+		clearedCookie := helpers.GetClearedTwoFactorChallengeCookie()
+		http.SetCookie(w, &clearedCookie)
+		responseMessage(w, http.StatusTooManyRequests, "Too many attempts, try again later")
+		return
+	}
+
+	var user models.User
+	if err := h.Collections.UserCollection.FindOne(r.Context(), bson.M{"_id": uid}).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		} else {
+			responseMessage(w, http.StatusNotFound, "Account does not exist")
+		}
+		return
+	}
+
+	if ok, err := verifyTwoFactorCode(r.Context(), h.Collections, &user, codeInput.Code); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if !ok {
+		responseMessage(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	h.RedisClient.Del(r.Context(), attemptsKey)
+
+	// Login only sends soft deleted users here if they asked to restore their account
+	if user.DeletedAt != 0 {
+		if restored, err := deletion.Restore(r.Context(), h.Collections, user.ID); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		} else if !restored {
+			responseMessage(w, http.StatusNotFound, "Account does not exist")
+			return
+		}
+	}
+
+	var pfp models.Pfp
+	if err := h.Collections.PfpCollection.FindOne(r.Context(), bson.M{"_id": user.ID}).Decode(&pfp); err != nil {
+		if err != mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	} else {
+		user.Base64pfp = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(pfp.Binary.Data)
+	}
+
+	cookies, err := helpers.GenerateCookiesAndSession(user.ID, r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	setCookies(w, append(cookies, helpers.GetClearedTwoFactorChallengeCookie()))
+
+	user.IsOnline = true
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := map[string]string{
+		"abcde-fghij":    "abcdefghij",
+		"ABCDE-FGHIJ":    "abcdefghij",
+		"abcdefghij":     "abcdefghij",
+		" abcde fghij ":  "abcdefghij",
+		"AbCdE - fGhIj":  "abcdefghij",
+		"ab-cd-ef-gh-ij": "abcdefghij",
+	}
+	for in, want := range tests {
+		if got := normalizeRecoveryCode(in); got != want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	hash := hashRecoveryCode("abcde-fghij")
+	if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(hash) {
+		t.Fatalf("expected a hex encoded sha256, got %q", hash)
+	}
+	for _, variant := range []string{"ABCDE-FGHIJ", "abcdefghij", " abcde fghij "} {
+		if hashRecoveryCode(variant) != hash {
+			t.Errorf("%q should hash the same as abcde-fghij", variant)
+		}
+	}
+	if hashRecoveryCode("abcde-fghik") == hash {
+		t.Error("different codes hashed the same")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %v codes and %v hashes, want %v of each", len(codes), len(hashes), recoveryCodeCount)
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q is not formatted as xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash %v doesn't match code %q", i, code)
+		}
+		if hashes[i] == code {
+			t.Errorf("code %q was stored unhashed", code)
+		}
+	}
+}
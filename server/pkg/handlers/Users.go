@@ -2,11 +2,13 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 
 	"github.com/gorilla/mux"
@@ -15,6 +17,8 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+var imageLog = logger.New("images")
+
 func (h handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	rawId, _ := vars["id"]
@@ -25,7 +29,7 @@ func (h handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user models.User
-	if err := h.Collections.UserCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&user); err != nil {
+	if err := h.Collections.UserCollection.FindOne(r.Context(), bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}).Decode(&user); err != nil {
 		if err == mongo.ErrNoDocuments {
 			responseMessage(w, http.StatusNotFound, "Not found")
 		} else {
@@ -34,13 +38,27 @@ func (h handler) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recvChan := make(chan bool)
-	h.SocketServer.GetUserOnlineStatus <- socketserver.GetUserOnlineStatus{
+	recvChan := make(chan string)
+	h.SocketServer.GetUserPresence <- socketserver.GetUserPresence{
 		RecvChan: recvChan,
 		Uid:      id,
 	}
-	isOnline := <-recvChan
-	user.IsOnline = isOnline
+	user.Presence = socketserver.VisiblePresence(<-recvChan)
+
+	// Users blocked by the user don't get to see their presence
+	if requesterId, err := helpers.GetUidFromRequest(r); err == nil {
+		for _, oi := range user.Blocked {
+			if oi == requesterId {
+				user.Presence = models.PresenceOffline
+				user.LastSeen = 0
+				break
+			}
+		}
+	}
+	user.IsOnline = user.Presence != models.PresenceOffline
+	if user.IsOnline {
+		user.LastSeen = 0
+	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -69,6 +87,127 @@ func (h handler) GetPfp(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.Header().Set("Content-Length", strconv.Itoa(len(pfp.Binary.Data)))
 	if _, err := w.Write(pfp.Binary.Data); err != nil {
-		log.Println("Unable to write image to response")
+		imageLog.Error("Unable to write image to response", err, logger.Fields{"path": r.URL.Path})
+	}
+}
+
+func (h handler) BlockUser(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if id == user.ID {
+		responseMessage(w, http.StatusBadRequest, "You cannot block yourself")
+		return
+	}
+
+	if count, err := h.Collections.UserCollection.CountDocuments(r.Context(), bson.M{"_id": id}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if count == 0 {
+		responseMessage(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	res, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$addToSet": bson.M{"blocked": id}})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "You have already blocked this user")
+		return
+	}
+
+	// Hide the blockers presence from the blocked user
+	h.SocketServer.SendDataToUser <- socketserver.UserDataMessage{
+		Uid: id,
+		Data: socketmodels.OutChangeMessage{
+			Method: "UPDATE",
+			Entity: "USER",
+			Data:   socketserver.PresenceChangeData(user.ID, models.PresenceOffline, 0),
+		},
+		Type: "CHANGE",
+	}
+
+	responseMessage(w, http.StatusOK, "User blocked")
+}
+
+func (h handler) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, isProtected := h.ProtectedIDs.Uids[user.ID]; isProtected {
+		responseMessage(w, http.StatusUnauthorized, "You cannot modify example users")
+		return
+	}
+
+	rawId := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	res, err := h.Collections.UserCollection.UpdateByID(r.Context(), user.ID, bson.M{"$pull": bson.M{"blocked": id}})
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
+	if res.ModifiedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "This user is not blocked")
+		return
+	}
+
+	recvChan := make(chan string)
+	h.SocketServer.GetUserPresence <- socketserver.GetUserPresence{
+		RecvChan: recvChan,
+		Uid:      user.ID,
+	}
+	presence := socketserver.VisiblePresence(<-recvChan)
+	h.SocketServer.SendDataToUser <- socketserver.UserDataMessage{
+		Uid: id,
+		Data: socketmodels.OutChangeMessage{
+			Method: "UPDATE",
+			Entity: "USER",
+			Data:   socketserver.PresenceChangeData(user.ID, presence, user.LastSeen),
+		},
+		Type: "CHANGE",
+	}
+
+	responseMessage(w, http.StatusOK, "User unblocked")
+}
+
+func (h handler) GetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	user, _, err := helpers.GetUserAndSessionFromRequest(r, *h.Collections)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	blocked := []string{}
+	for _, oi := range user.Blocked {
+		blocked = append(blocked, oi.Hex())
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blocked)
 }
@@ -8,7 +8,10 @@ import (
 
 	"github.com/go-redis/redis/v9"
 	"github.com/web-stuff-98/go-social-media/pkg/attachmentserver"
+	"github.com/web-stuff-98/go-social-media/pkg/config"
 	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/deletion"
+	"github.com/web-stuff-98/go-social-media/pkg/exporter"
 	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -22,6 +25,12 @@ func responseMessage(w http.ResponseWriter, c int, m string) {
 	return
 }
 
+func setCookies(w http.ResponseWriter, cookies []http.Cookie) {
+	for i := range cookies {
+		http.SetCookie(w, &cookies[i])
+	}
+}
+
 type ProtectedIDs struct {
 	Uids map[primitive.ObjectID]struct{}
 	Rids map[primitive.ObjectID]struct{}
@@ -34,9 +43,12 @@ type handler struct {
 	Collections      *db.Collections
 	SocketServer     *socketserver.SocketServer
 	AttachmentServer *attachmentserver.AttachmentServer
+	Exporter         *exporter.Exporter
+	DeletionPolicy   deletion.Policy
 	ProtectedIDs     *ProtectedIDs
+	Uploads          config.Uploads
 }
 
-func New(db *mongo.Database, rdb *redis.Client, collections *db.Collections, sserver *socketserver.SocketServer, aserver *attachmentserver.AttachmentServer, protectedIDs *ProtectedIDs) handler {
-	return handler{db, rdb, collections, sserver, aserver, protectedIDs}
+func New(db *mongo.Database, rdb *redis.Client, collections *db.Collections, sserver *socketserver.SocketServer, aserver *attachmentserver.AttachmentServer, exp *exporter.Exporter, deletionPolicy deletion.Policy, protectedIDs *ProtectedIDs, uploads config.Uploads) handler {
+	return handler{db, rdb, collections, sserver, aserver, exp, deletionPolicy, protectedIDs, uploads}
 }
@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+)
+
+/*
+	Request IDs, access logs and panic recovery. Chained in this order, outermost first:
+
+	RequestID(AccessLog(Recoverer(handler)))
+
+	Every request gets an ID, sent back in the X-Request-ID header. An ID sent by a trusted proxy
+	in the same header is used instead, so that requests can be followed through the proxy logs.
+	The access log has the route name set by the rate limiter, the status, the latency and the user.
+	The request count and latency metrics are recorded along with it.
+*/
+
+var httpLog = logger.New("http")
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route name, method and status.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_request_duration_seconds",
+		Help: "HTTP request latency by route name.",
+	}, []string{"route"})
+)
+
+type requestIDKey struct{}
+type requestInfoKey struct{}
+
+// Set by the handlers further down the chain, read by AccessLog once the request is done
+type requestInfo struct {
+	route string
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9\-_.]{1,64}$`)
+
+func RequestID(next http.Handler, trusted TrustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if ip := net.ParseIP(remoteIP(r)); ip == nil || !trusted.contains(ip) || !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func GetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Sets the route name shown in the access log
+func setRouteName(r *http.Request, name string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.route = name
+	}
+}
+
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		latency := time.Since(start)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// Requests that aren't rate limited, like the websocket endpoint and the frontend
+		route := info.route
+		if route == "" {
+			route = "other"
+		}
+		httpRequests.WithLabelValues(route, metricMethod(r.Method), strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(route).Observe(latency.Seconds())
+
+		fields := logger.Fields{
+			"request_id": GetRequestID(r),
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"route":      info.route,
+			"status":     status,
+			"bytes":      rec.bytes,
+			"latency_ms": float64(latency.Microseconds()) / 1000,
+			"ip":         helpers.GetRequestIP(r),
+		}
+		if uid, err := helpers.GetUidFromRequest(r); err == nil {
+			fields["uid"] = uid.Hex()
+		}
+		httpLog.Info("Request", fields)
+	})
+}
+
+// Any method can be sent, so the ones the router doesn't know about share a label value
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Used by the http server to abort a response, it isn't an error
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			id := GetRequestID(r)
+			httpLog.Panic("HTTP handler", recovered, logger.Fields{
+				"request_id": id,
+				"method":     r.Method,
+				"path":       r.URL.Path,
+			})
+			if rec, ok := w.(*responseRecorder); ok && rec.status != 0 {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"msg":        "Internal error",
+				"request_id": id,
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Records the status and size of the response. Hijacking is passed through for websockets.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response writer does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
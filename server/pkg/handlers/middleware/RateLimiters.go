@@ -1,18 +1,47 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v9"
-	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
 )
 
-type BlockInfo struct {
-	LastRequest      time.Time `json:"last_request"`
-	RequestsInWindow uint16    `json:"reqs_in_window"`
-}
+/*
+	Rate limiting on redis. The check and the count are done together in a Lua script so concurrent
+	requests can't both slip under the limit. Going over the limit blocks the key for BlockDuration,
+	or if there is no block duration, until the limit allows another request.
+
+	sliding_window allows MaxReqs in any period of length Window, by keeping the time of every request in the window.
+	token_bucket allows bursts of up to MaxReqs, refilled at MaxReqs per Window.
+
+	Requests are counted against the logged in user, or the client IP if there isn't one or the route is
+	set to limit by IP. Responses have RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+	RateLimit-Policy headers, and Retry-After when the request is rejected.
+*/
+
+const (
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+
+	KeyByUser = "user"
+	KeyByIP   = "ip"
+)
+
+var rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rate_limit_rejections_total",
+	Help: "Requests rejected by the rate limiter, by route name.",
+}, []string{"route"})
 
 type SimpleLimiterOpts struct {
 	Window        time.Duration `json:"window"`
@@ -20,8 +49,77 @@ type SimpleLimiterOpts struct {
 	BlockDuration time.Duration `json:"block_dur"`
 	Message       string        `json:"msg"`
 	RouteName     string        `json:"-"`
+	Algorithm     string        `json:"algorithm"` // AlgorithmSlidingWindow if empty
+	KeyBy         string        `json:"key_by"`    // KeyByUser if empty
+}
+
+type limitResult struct {
+	allowed   bool
+	remaining int64
+	// How long until a request will be allowed if this one wasn't, otherwise how long until the limit is fully reset
+	reset time.Duration
 }
 
+// KEYS[1] request log, KEYS[2] block. ARGV window ms, max requests, block ms, now ms, unique member.
+// Returns allowed (1 or 0), remaining requests and reset ms.
+var slidingWindowScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local max = tonumber(ARGV[2])
+local block = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local blocked = redis.call('PTTL', KEYS[2])
+if blocked > 0 then
+	return {0, 0, blocked}
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= max then
+	if block > 0 then
+		redis.call('SET', KEYS[2], 1, 'PX', block)
+		redis.call('DEL', KEYS[1])
+		return {0, 0, block}
+	end
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {0, 0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[5])
+redis.call('PEXPIRE', KEYS[1], window)
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {1, max - count - 1, tonumber(oldest[2]) + window - now}
+`)
+
+// KEYS[1] bucket, KEYS[2] block. ARGV window ms, capacity, block ms, now ms.
+// Returns allowed (1 or 0), remaining tokens and reset ms.
+var tokenBucketScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local block = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local blocked = redis.call('PTTL', KEYS[2])
+if blocked > 0 then
+	return {0, 0, blocked}
+end
+local rate = capacity / window
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+if tokens < 1 then
+	if block > 0 then
+		redis.call('SET', KEYS[2], 1, 'PX', block)
+		redis.call('DEL', KEYS[1])
+		return {0, 0, block}
+	end
+	redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {0, 0, math.ceil((1 - tokens) / rate)}
+end
+tokens = tokens - 1
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, math.floor(tokens), math.ceil((capacity - tokens) / rate)}
+`)
+
 func errMsg(w http.ResponseWriter, s int, m string) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(s)
@@ -30,95 +128,67 @@ func errMsg(w http.ResponseWriter, s int, m string) {
 	})
 }
 
-func BasicRateLimiter(next http.HandlerFunc, opts SimpleLimiterOpts, rdb redis.Client, colls db.Collections) http.HandlerFunc {
+func BasicRateLimiter(next http.HandlerFunc, opts SimpleLimiterOpts, rdb *redis.Client) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Find IP block info on redis
-		ipInfoKey := "SIMPLE-LIMITER-INFO=" + r.RemoteAddr + "=" + opts.RouteName
-		ipInfoCmd := rdb.Get(r.Context(), ipInfoKey)
-		ipInfo := &BlockInfo{}
-		if ipInfoCmd.Err() == nil {
-			// IP block info for route found
-			ipInfoString := ipInfoCmd.Val()
-			err := json.Unmarshal([]byte(ipInfoString), ipInfo)
-			if err != nil {
-				errMsg(w, http.StatusInternalServerError, "Internal error")
-				return
-			}
-			// Check if blocked
-			if ipInfo.RequestsInWindow >= opts.MaxReqs {
-				if time.Now().After(ipInfo.LastRequest.Add(opts.BlockDuration)) {
-					// The IP was blocked, but is now no longer blocked, so delete the block info and do next
-					delCmd := rdb.Del(r.Context(), ipInfoKey)
-					if delCmd.Err() != nil {
-						if delCmd.Err() != redis.Nil {
-							errMsg(w, http.StatusInternalServerError, "Internal error")
-							return
-						}
-					}
-					next.ServeHTTP(w, r)
-					return
-				} else {
-					// The IP is blocked, extend redis key expiration to end of block duration and send err msg
-					secsRemaining := ipInfo.LastRequest.Add(opts.BlockDuration).Second() - time.Now().Second()
-					setCmd := rdb.Set(r.Context(), ipInfoKey, ipInfoString, time.Duration(secsRemaining*1000000000))
-					if setCmd.Err() != nil {
-						errMsg(w, http.StatusInternalServerError, "Internal error")
-						return
-					}
-					var msg string
-					if opts.Message != "" {
-						msg = opts.Message
-					} else {
-						msg = "Too many requests"
-					}
-					errMsg(w, http.StatusTooManyRequests, msg)
-					return
-				}
-			}
-			// If not blocked add to the number of requests
-			if ipInfo.LastRequest.Before(time.Now().Add(-opts.Window)) {
-				ipInfo.RequestsInWindow = 1
-			} else {
-				ipInfo.RequestsInWindow++
-			}
-			ipInfo.LastRequest = time.Now()
-			ipInfoBytes, err := json.Marshal(ipInfo)
-			if err != nil {
-				errMsg(w, http.StatusInternalServerError, "Internal error")
-				return
-			}
-			// Set the ip block info
-			setCmd := rdb.Set(r.Context(), ipInfoKey, string(ipInfoBytes), opts.Window)
-			if setCmd.Err() != nil {
-				errMsg(w, http.StatusInternalServerError, "Internal error")
-				return
-			}
-		} else {
-			// IP block info for route was not found, set it, but first check if its because there was an internal error
-			if ipInfoCmd.Err() != redis.Nil {
-				errMsg(w, http.StatusInternalServerError, "Internal error")
-				return
-			} else {
-				// No internal error, create IP block info on redis and do next
-				ipInfo = &BlockInfo{
-					LastRequest:      time.Now(),
-					RequestsInWindow: 1,
-				}
-				ipInfoBytes, err := json.Marshal(ipInfo)
-				if err != nil {
-					errMsg(w, http.StatusInternalServerError, "Internal error")
-					return
-				}
-				// Set the ip block info
-				setCmd := rdb.Set(r.Context(), ipInfoKey, string(ipInfoBytes), opts.Window)
-				if setCmd.Err() != nil {
-					errMsg(w, http.StatusInternalServerError, "Internal error")
-					return
-				}
-				next.ServeHTTP(w, r)
-				return
+		setRouteName(r, opts.RouteName)
+		key := "RATE-LIMITER=" + opts.RouteName + "=" + limiterKey(r, opts.KeyBy)
+		result, err := checkLimit(r.Context(), rdb, key, opts.Algorithm, opts.Window, opts.MaxReqs, opts.BlockDuration)
+		if err != nil {
+			httpLog.Error("Rate limiter failed", err, logger.Fields{"route": opts.RouteName, "request_id": GetRequestID(r)})
+			errMsg(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		resetSecs := strconv.Itoa(int(math.Ceil(result.reset.Seconds())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(int(opts.MaxReqs)))
+		w.Header().Set("RateLimit-Remaining", strconv.FormatInt(result.remaining, 10))
+		w.Header().Set("RateLimit-Reset", resetSecs)
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%v;w=%v", opts.MaxReqs, int(opts.Window.Seconds())))
+		if !result.allowed {
+			msg := opts.Message
+			if msg == "" {
+				msg = "Too many requests"
 			}
+			rateLimitRejections.WithLabelValues(opts.RouteName).Inc()
+			w.Header().Set("Retry-After", resetSecs)
+			errMsg(w, http.StatusTooManyRequests, msg)
+			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Limits by the logged in user where possible, so users behind the same address don't share a limit
+func limiterKey(r *http.Request, keyBy string) string {
+	if keyBy != KeyByIP {
+		if uid, err := helpers.GetUidFromRequest(r); err == nil {
+			return "user:" + uid.Hex()
+		}
+	}
+	return "ip:" + helpers.GetRequestIP(r)
+}
+
+// Shared by the HTTP rate limiter and the socket event rate limiter. Counts the request if it is allowed.
+func checkLimit(ctx context.Context, rdb *redis.Client, key string, algorithm string, window time.Duration, maxReqs uint16, blockDuration time.Duration) (limitResult, error) {
+	now := time.Now().UnixMilli()
+	var cmd *redis.Cmd
+	if algorithm == AlgorithmTokenBucket {
+		cmd = tokenBucketScript.Run(ctx, rdb, []string{key + ":bucket", key + ":block"},
+			window.Milliseconds(), maxReqs, blockDuration.Milliseconds(), now)
+	} else {
+		member := strconv.FormatInt(now, 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+		cmd = slidingWindowScript.Run(ctx, rdb, []string{key + ":log", key + ":block"},
+			window.Milliseconds(), maxReqs, blockDuration.Milliseconds(), now, member)
+	}
+	vals, err := cmd.Int64Slice()
+	if err != nil {
+		return limitResult{}, err
+	}
+	if len(vals) != 3 {
+		return limitResult{}, fmt.Errorf("Unexpected rate limiter script result %v", vals)
+	}
+	return limitResult{
+		allowed:   vals[0] == 1,
+		remaining: vals[1],
+		reset:     time.Duration(vals[2]) * time.Millisecond,
+	}, nil
+}
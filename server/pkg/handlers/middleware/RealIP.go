@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+)
+
+/*
+	Resolves the client IP for requests that come through a proxy. The proxy header is only trusted
+	when the connection comes from one of the trusted proxies, otherwise anyone could set it. Only the
+	header the proxies write to is read, either Forwarded or X-Forwarded-For. Proxies pass the other
+	one through from the client unchanged, so it can't be trusted. The addresses in the header are read
+	from the right, skipping trusted proxies, and the first address that isn't a trusted proxy is the client.
+
+	The resolved IP is put on the request context, helpers.GetRequestIP reads it from there.
+*/
+
+type TrustedProxies []*net.IPNet
+
+// Takes CIDRs or single addresses
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	nets := TrustedProxies{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %v", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %v", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (t TrustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// header is "forwarded" or "x-forwarded-for"
+func RealIP(next http.Handler, trusted TrustedProxies, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if parsed := net.ParseIP(ip); parsed != nil && trusted.contains(parsed) {
+			if forwarded := forwardedFor(r, header); len(forwarded) > 0 {
+				ip = clientIP(forwarded, trusted)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(helpers.WithClientIP(r.Context(), ip)))
+	})
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// The addresses the request was forwarded for, from the client to the last proxy
+func forwardedFor(r *http.Request, header string) []string {
+	addrs := []string{}
+	if header == "forwarded" {
+		for _, value := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || !strings.EqualFold(key, "for") {
+						continue
+					}
+					if addr := parseForwardedAddr(val); addr != "" {
+						addrs = append(addrs, addr)
+					}
+				}
+			}
+		}
+		return addrs
+	}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = parseForwardedAddr(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// Strips quotes, brackets and ports. Returns an empty string for anything that isn't an IP, like obfuscated identifiers and "unknown".
+func parseForwardedAddr(addr string) string {
+	addr = strings.Trim(strings.TrimSpace(addr), `"`)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func clientIP(forwarded []string, trusted TrustedProxies) string {
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if !trusted.contains(net.ParseIP(forwarded[i])) {
+			return forwarded[i]
+		}
+	}
+	// Every address is a trusted proxy, so the first one is as close to the client as it gets
+	return forwarded[0]
+}
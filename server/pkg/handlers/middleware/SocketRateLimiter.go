@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+/*
+	Rate limiting for websocket events. Uses the same sliding window as the HTTP rate limiter,
+	but it is keyed on the user (or the connection address if the user isn't logged in) and the
+	event type instead of the route name.
+*/
+
+var socketRateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "socket_rate_limit_rejections_total",
+	Help: "Socket events rejected by the rate limiter, by event type.",
+}, []string{"event"})
+
+type SocketLimiterOpts struct {
+	Window        time.Duration `json:"window"`
+	MaxReqs       uint16        `json:"max_reqs"`
+	BlockDuration time.Duration `json:"block_dur"`
+	Message       string        `json:"msg"`
+	EventName     string        `json:"-"`
+}
+
+// Returns true if the event should be blocked, along with the message that should be sent back to the client
+func SocketEventRateLimiter(ctx context.Context, key string, opts SocketLimiterOpts, rdb *redis.Client) (bool, string, error) {
+	infoKey := "SOCKET-LIMITER-INFO=" + key + "=" + opts.EventName
+	result, err := checkLimit(ctx, rdb, infoKey, AlgorithmSlidingWindow, opts.Window, opts.MaxReqs, opts.BlockDuration)
+	if err != nil {
+		return false, "", err
+	}
+	if result.allowed {
+		return false, "", nil
+	}
+	socketRateLimitRejections.WithLabelValues(opts.EventName).Inc()
+	if opts.Message != "" {
+		return true, opts.Message, nil
+	}
+	return true, "You are sending too many messages", nil
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+/*
+	Health checks for the load balancer or orchestrator.
+
+	/healthz is liveness, it only checks that the server is responding.
+	/readyz is readiness, it checks MongoDB and Redis, and fails once the server starts shutting down
+	so that no new traffic is sent to it. Other parts of the server can add their own checks with AddCheck.
+	Checks that aren't critical, like the change streams, are reported as "degraded" without failing readiness,
+	because the API still works without them.
+*/
+
+const checkTimeout = time.Second * 2
+
+type Checker struct {
+	db       *mongo.Database
+	rdb      *redis.Client
+	checks   []check
+	draining atomic.Bool
+}
+
+type check struct {
+	name     string
+	fn       func(ctx context.Context) error
+	critical bool
+}
+
+func New(db *mongo.Database, rdb *redis.Client) *Checker {
+	return &Checker{db: db, rdb: rdb}
+}
+
+// Must be called before the server starts
+func (c *Checker) AddCheck(name string, fn func(ctx context.Context) error, critical bool) {
+	c.checks = append(c.checks, check{name, fn, critical})
+}
+
+// Makes readiness fail from now on
+func (c *Checker) SetDraining() {
+	c.draining.Store(true)
+}
+
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	if c.draining.Load() {
+		respond(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	checks := map[string]string{"mongodb": "ok", "redis": "ok"}
+	if err := c.db.Client().Ping(ctx, readpref.Primary()); err != nil {
+		status = http.StatusServiceUnavailable
+		checks["mongodb"] = err.Error()
+	}
+	if err := c.rdb.Ping(ctx).Err(); err != nil {
+		status = http.StatusServiceUnavailable
+		checks["redis"] = err.Error()
+	}
+	degraded := false
+	for _, check := range c.checks {
+		if err := check.fn(ctx); err != nil {
+			checks[check.name] = err.Error()
+			if check.critical {
+				status = http.StatusServiceUnavailable
+			} else {
+				degraded = true
+			}
+			continue
+		}
+		checks[check.name] = "ok"
+	}
+	overall := "ok"
+	if status != http.StatusOK {
+		overall = "unavailable"
+	} else if degraded {
+		overall = "degraded"
+	}
+	respond(w, status, map[string]interface{}{"status": overall, "checks": checks})
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -2,104 +2,426 @@ package helpers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 
+	"github.com/web-stuff-98/go-social-media/pkg/config"
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
 
 	"github.com/dgrijalva/jwt-go"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func createCookie(token string, expiry time.Time) http.Cookie {
+/*
+	Auth uses two cookies. access_token is a short lived JWT containing the uid and the session ID,
+	it's checked without going to the database. refresh_token is an opaque random token, only the
+	hash of it is stored on the session. Every refresh swaps it for a new one, and if an old refresh
+	token is used again the whole session is revoked, since the token must have been stolen.
+*/
+
+const (
+	SessionDuration     = time.Hour * 24 * 30 // Sessions are extended by this much whenever the token is refreshed
+	AccessTokenDuration = time.Minute * 5
+	// Using the previous refresh token this soon after it was swapped is assumed to be another tab
+	// refreshing at the same time, rather than reuse
+	refreshGracePeriod   = time.Second * 10
+	maxUsedRefreshHashes = 50
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("Refresh token reused")
+	ErrRefreshTokenRaced  = errors.New("Refresh token already swapped")
+)
+
+// How long the user has to enter their two factor code after entering their password
+const twoFactorChallengeDuration = time.Minute * 5
+
+const twoFactorChallengeAudience = "two_factor_login"
+
+var (
+	secret  []byte
+	cookies config.Cookies
+)
+
+// Sets the token secret and cookie settings, must be called before handling any requests
+func Init(cfg *config.Config) {
+	secret = []byte(cfg.Secret)
+	cookies = cfg.Cookies
+}
+
+type AccessClaims struct {
+	Sid string `json:"sid"`
+	jwt.StandardClaims
+}
+
+func createCookie(name string, token string, expiry time.Time, path string) http.Cookie {
 	var cookie http.Cookie
-	cookie.Name = "refresh_token"
+	cookie.Name = name
 	cookie.Value = token
 	cookie.Expires = expiry
-	cookie.MaxAge = 120
-	cookie.Secure = os.Getenv("PRODUCTION") == "true"
+	cookie.MaxAge = int(time.Until(expiry).Seconds())
+	cookie.Secure = *cookies.Secure
 	cookie.HttpOnly = true
-	cookie.SameSite = http.SameSiteDefaultMode
-	cookie.Path = "/"
+	cookie.SameSite = cookies.SameSiteMode()
+	cookie.Domain = cookies.Domain
+	cookie.Path = path
 	return cookie
 }
 
-func GetClearedCookie() http.Cookie {
+func getClearedCookie(name string, path string) http.Cookie {
 	var cookie http.Cookie
-	cookie.Name = "refresh_token"
+	cookie.Name = name
 	cookie.Value = ""
 	cookie.Expires = time.Now().Add(-time.Hour)
 	cookie.MaxAge = -1
-	cookie.Secure = os.Getenv("PRODUCTION") == "true"
+	cookie.Secure = *cookies.Secure
 	cookie.HttpOnly = true
-	cookie.SameSite = http.SameSiteDefaultMode
-	cookie.Path = "/"
+	cookie.SameSite = cookies.SameSiteMode()
+	cookie.Domain = cookies.Domain
+	cookie.Path = path
 	return cookie
 }
 
-// Used by login, register and refresh to set the cookie. Cookie is refresh token with encrypted sid
-func GenerateCookieAndSession(uid primitive.ObjectID, collections db.Collections) (http.Cookie, error) {
-	collections.SessionCollection.DeleteMany(context.TODO(), bson.M{"_uid": uid})
-	expiry := primitive.NewDateTimeFromTime(time.Now().Add(time.Minute * 2))
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered from panic in generate cookie helper function, why is this happening?")
+// The refresh token is only sent to the account routes, which is where refresh and logout are
+func GetClearedCookies() []http.Cookie {
+	return []http.Cookie{
+		getClearedCookie("access_token", "/"),
+		getClearedCookie("refresh_token", "/api/account"),
+		// Sessions from before the access token existed put the refresh token on /
+		getClearedCookie("refresh_token", "/"),
+	}
+}
+
+func createAccessCookie(uid primitive.ObjectID, sid primitive.ObjectID) (http.Cookie, error) {
+	expiry := time.Now().Add(AccessTokenDuration)
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, AccessClaims{
+		Sid: sid.Hex(),
+		StandardClaims: jwt.StandardClaims{
+			Subject:   uid.Hex(),
+			ExpiresAt: expiry.Unix(),
+		},
+	})
+	token, err := claims.SignedString(secret)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return createCookie("access_token", token, expiry, "/"), nil
+}
+
+// Returns a new refresh token, and the hash of it to store on the session
+func generateRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// The address the request came from, without the port
+type clientIPKey struct{}
+
+// Used by the RealIP middleware to set the IP resolved from the proxy headers
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// The client IP resolved by the RealIP middleware, or the address of the connection if the request didn't go through it
+func GetRequestIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Used by login and register to create a session for the device the request came from
+func GenerateCookiesAndSession(uid primitive.ObjectID, r *http.Request, collections db.Collections) ([]http.Cookie, error) {
+	refreshToken, refreshHash, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userAgent := r.UserAgent()
+	if len(userAgent) > 300 {
+		userAgent = userAgent[:300]
+	}
+	session := models.Session{
+		ID:          primitive.NewObjectID(),
+		UID:         uid,
+		ExpiresAt:   primitive.NewDateTimeFromTime(now.Add(SessionDuration)),
+		UserAgent:   userAgent,
+		IP:          GetRequestIP(r),
+		CreatedAt:   primitive.NewDateTimeFromTime(now),
+		LastUsed:    primitive.NewDateTimeFromTime(now),
+		RefreshHash: refreshHash,
+		UsedHashes:  []string{},
+	}
+	if _, err := collections.SessionCollection.InsertOne(context.TODO(), session); err != nil {
+		return nil, err
+	}
+	accessCookie, err := createAccessCookie(uid, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return []http.Cookie{accessCookie, createCookie("refresh_token", refreshToken, session.ExpiresAt.Time(), "/api/account")}, nil
+}
+
+// Used by refresh. Swaps the refresh token for a new one and extends the session. If the refresh token has
+// already been swapped the session is deleted and returned with ErrRefreshTokenReused, so that the caller
+// can close its connections.
+func RotateRefreshToken(r *http.Request, collections db.Collections) (*models.Session, []http.Cookie, error) {
+	originalCookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := hashRefreshToken(originalCookie.Value)
+	refreshToken, refreshHash, err := generateRefreshToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+
+	session := &models.Session{}
+	err = collections.SessionCollection.FindOneAndUpdate(context.TODO(), bson.M{
+		"refresh_hash": hash,
+		"exp":          bson.M{"$gt": primitive.NewDateTimeFromTime(now)},
+	}, bson.M{
+		"$set": bson.M{
+			"refresh_hash":  refreshHash,
+			"previous_hash": hash,
+			"rotated_at":    primitive.NewDateTimeFromTime(now),
+			"exp":           primitive.NewDateTimeFromTime(now.Add(SessionDuration)),
+			"last_used":     primitive.NewDateTimeFromTime(now),
+			"ip":            GetRequestIP(r),
+		},
+		"$push": bson.M{
+			"used_hashes": bson.M{"$each": []string{hash}, "$slice": -maxUsedRefreshHashes},
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&session)
+	if err == nil {
+		accessCookie, err := createAccessCookie(session.UID, session.ID)
+		if err != nil {
+			return nil, nil, err
 		}
-	}()
-	inserted, err := collections.SessionCollection.InsertOne(context.TODO(), models.Session{
-		ExpiresAt: expiry,
-		UID:       uid,
+		return session, []http.Cookie{accessCookie, createCookie("refresh_token", refreshToken, session.ExpiresAt.Time(), "/api/account")}, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+
+	// The token wasn't the current one, check if it's an old one
+	if err := collections.SessionCollection.FindOne(context.TODO(), bson.M{"used_hashes": hash}).Decode(&session); err != nil {
+		return nil, nil, err
+	}
+	if session.PreviousHash == hash && now.Sub(session.RotatedAt.Time()) < refreshGracePeriod {
+		return nil, nil, ErrRefreshTokenRaced
+	}
+	if _, err := collections.SessionCollection.DeleteOne(context.TODO(), bson.M{"_id": session.ID}); err != nil {
+		return nil, nil, err
+	}
+	return session, nil, ErrRefreshTokenReused
+}
+
+// Finds the session using the refresh token, used by logout since the access token might have expired
+func GetSessionFromRefreshToken(r *http.Request, collections db.Collections) (*models.Session, error) {
+	originalCookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		return nil, err
+	}
+	session := &models.Session{}
+	if err := collections.SessionCollection.FindOne(context.TODO(), bson.M{"refresh_hash": hashRefreshToken(originalCookie.Value)}).Decode(&session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Gets the uid and session ID from the access token, without going to the database
+func GetUidAndSidFromRequest(r *http.Request) (primitive.ObjectID, primitive.ObjectID, error) {
+	originalCookie, err := r.Cookie("access_token")
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, err
+	}
+	token, err := jwt.ParseWithClaims(originalCookie.Value, &AccessClaims{}, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method")
+		}
+		return secret, nil
 	})
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, err
+	}
+	claims := token.Claims.(*AccessClaims)
+	if claims.Audience != "" {
+		return primitive.NilObjectID, primitive.NilObjectID, fmt.Errorf("Not an access token")
+	}
+	uid, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, err
+	}
+	sid, err := primitive.ObjectIDFromHex(claims.Sid)
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, err
+	}
+	if uid == primitive.NilObjectID || sid == primitive.NilObjectID {
+		return primitive.NilObjectID, primitive.NilObjectID, fmt.Errorf("NIL OBJECT ID")
+	}
+	return uid, sid, nil
+}
+
+// Used by login for users with two factor authentication. The cookie proves the user entered their password.
+func CreateTwoFactorChallengeCookie(uid primitive.ObjectID) (http.Cookie, error) {
+	expiry := time.Now().Add(twoFactorChallengeDuration)
 	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Issuer:    inserted.InsertedID.(primitive.ObjectID).Hex(),
-		ExpiresAt: expiry.Time().Unix(),
+		Subject:   uid.Hex(),
+		Audience:  twoFactorChallengeAudience,
+		ExpiresAt: expiry.Unix(),
 	})
-	token, err := claims.SignedString([]byte(os.Getenv("SECRET")))
-	cookie := createCookie(token, expiry.Time())
-	return cookie, err
+	token, err := claims.SignedString(secret)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return createCookie("two_factor_challenge", token, expiry, "/api/account"), nil
 }
 
-func GetUserAndSessionFromRequest(r *http.Request, collections db.Collections) (*models.User, *models.Session, error) {
-	originalCookie, err := r.Cookie("refresh_token")
+func GetClearedTwoFactorChallengeCookie() http.Cookie {
+	return getClearedCookie("two_factor_challenge", "/api/account")
+}
+
+// Gets the uid of the user who entered their password from the two factor challenge cookie
+func GetUidFromTwoFactorChallenge(r *http.Request) (primitive.ObjectID, error) {
+	originalCookie, err := r.Cookie("two_factor_challenge")
 	if err != nil {
-		return nil, nil, err
+		return primitive.NilObjectID, err
 	}
 	token, err := jwt.ParseWithClaims(originalCookie.Value, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("SECRET")), nil
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method")
+		}
+		return secret, nil
 	})
-	rawSID := token.Claims.(*jwt.StandardClaims).Issuer
-	sessionID, err := primitive.ObjectIDFromHex(rawSID)
-	if sessionID == primitive.NilObjectID {
-		return nil, nil, fmt.Errorf("NIL OBJECT ID")
+	if err != nil {
+		return primitive.NilObjectID, err
 	}
+	claims := token.Claims.(*jwt.StandardClaims)
+	if !claims.VerifyAudience(twoFactorChallengeAudience, true) {
+		return primitive.NilObjectID, fmt.Errorf("Not a two factor challenge")
+	}
+	return primitive.ObjectIDFromHex(claims.Subject)
+}
+
+// Gets the uid from the access token, without going to the database
+func GetUidFromRequest(r *http.Request) (primitive.ObjectID, error) {
+	uid, _, err := GetUidAndSidFromRequest(r)
+	return uid, err
+}
+
+// Use GetUidFromRequest if only the uid is needed. The returned session only has its ID and UID set.
+// Soft deleted users are treated as not found, so their tokens stop working straight away.
+func GetUserAndSessionFromRequest(r *http.Request, collections db.Collections) (*models.User, *models.Session, error) {
+	uid, sid, err := GetUidAndSidFromRequest(r)
 	if err != nil {
 		return nil, nil, err
 	}
-	var session models.Session
 	var user models.User
-	if err := collections.SessionCollection.FindOne(context.TODO(), bson.M{"_id": sessionID}).Decode(&session); err != nil {
+	if err := collections.UserCollection.FindOne(context.TODO(), bson.M{"_id": uid, "deleted_at": bson.M{"$exists": false}}).Decode(&user); err != nil {
 		return nil, nil, err
 	}
-	if err := collections.UserCollection.FindOne(context.TODO(), bson.M{"_id": session.UID}).Decode(&user); err != nil {
-		return nil, nil, err
+	return &user, &models.Session{ID: sid, UID: uid}, nil
+}
+
+// Returns true if the blocker has the other user on their block list
+func IsBlockedBy(ctx context.Context, collections db.Collections, blocker primitive.ObjectID, uid primitive.ObjectID) (bool, error) {
+	count, err := collections.UserCollection.CountDocuments(ctx, bson.M{"_id": blocker, "blocked": uid})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Returns the users on the users block list
+func GetBlockedUids(ctx context.Context, collections db.Collections, uid primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	var user models.User
+	if err := collections.UserCollection.FindOne(ctx, bson.M{"_id": uid}, options.FindOne().SetProjection(bson.M{"blocked": 1})).Decode(&user); err != nil {
+		return nil, err
+	}
+	blocked := make(map[primitive.ObjectID]bool)
+	for _, oi := range user.Blocked {
+		blocked[oi] = true
+	}
+	return blocked, nil
+}
+
+// Returns the users that have the user on their block list
+func GetUidsBlocking(ctx context.Context, collections db.Collections, uid primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	cursor, err := collections.UserCollection.Find(ctx, bson.M{"blocked": uid}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
 	}
-	if user.ID == primitive.NilObjectID {
-		return nil, nil, fmt.Errorf("NIL UID")
+	defer cursor.Close(ctx)
+	blocking := make(map[primitive.ObjectID]bool)
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		blocking[user.ID] = true
 	}
-	return &user, &session, nil
+	return blocking, cursor.Err()
 }
 
+// Returns which of the users have soft deleted their accounts
+func GetDeletedUids(ctx context.Context, collections db.Collections, uids []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	deleted := make(map[primitive.ObjectID]bool)
+	if len(uids) == 0 {
+		return deleted, nil
+	}
+	cursor, err := collections.UserCollection.Find(ctx, bson.M{
+		"_id":        bson.M{"$in": uids},
+		"deleted_at": bson.M{"$exists": true},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		deleted[user.ID] = true
+	}
+	return deleted, cursor.Err()
+}
+
+var log = logger.New("helpers")
+
 func DownloadURL(inputURL string) io.ReadCloser {
 	_, err := url.Parse(inputURL)
 	if err != nil {
-		log.Fatal("Failed to parse image url")
+		log.Fatal("Failed to parse image url", err, logger.Fields{"url": inputURL})
 	}
 	client := http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -109,7 +431,7 @@ func DownloadURL(inputURL string) io.ReadCloser {
 	}
 	resp, err := client.Get(inputURL)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Failed to download image", err, logger.Fields{"url": inputURL})
 	}
 	return resp.Body
 }
@@ -0,0 +1,116 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+	Structured logging. Every entry is written as a line of JSON to stdout, with the time, level,
+	the component that logged it and any extra fields:
+
+	{"time":"...","level":"error","component":"changestreams","msg":"Decode error","error":"..."}
+
+	Each part of the server gets its own logger with New, they all write to the same output.
+*/
+
+type Fields map[string]interface{}
+
+type Logger struct {
+	component string
+}
+
+var (
+	mutex  sync.Mutex
+	output io.Writer = os.Stdout
+)
+
+func New(component string) *Logger {
+	return &Logger{component}
+}
+
+// Sets where every logger writes to, stdout by default
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	output = w
+	mutex.Unlock()
+}
+
+func (l *Logger) Info(msg string, fields Fields) {
+	l.write("info", msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields Fields) {
+	l.write("warn", msg, fields)
+}
+
+// The error is added to the fields, under "error"
+func (l *Logger) Error(msg string, err error, fields Fields) {
+	if fields == nil {
+		fields = Fields{}
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	l.write("error", msg, fields)
+}
+
+// Logs the error and exits, for errors the server can't start or carry on with
+func (l *Logger) Fatal(msg string, err error, fields Fields) {
+	if fields == nil {
+		fields = Fields{}
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	l.write("fatal", msg, fields)
+	os.Exit(1)
+}
+
+// Logs a panic along with the stack trace. Must be deferred directly, recover doesn't work otherwise:
+//
+//	defer log.Recover("WS registration")
+func (l *Logger) Recover(where string) {
+	if r := recover(); r != nil {
+		l.Panic(where, r, nil)
+	}
+}
+
+// Logs a value that was recovered from a panic, for when something else needs to be done after recovering
+func (l *Logger) Panic(where string, recovered interface{}, fields Fields) {
+	if fields == nil {
+		fields = Fields{}
+	}
+	fields["panic"] = fmt.Sprint(recovered)
+	fields["stack"] = string(debug.Stack())
+	l.write("error", "Recovered from panic in "+where, fields)
+}
+
+func (l *Logger) write(level string, msg string, fields Fields) {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["component"] = l.component
+	entry["msg"] = msg
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":      entry["time"],
+			"level":     "error",
+			"component": l.component,
+			"msg":       "Failed to marshal log entry for: " + msg,
+			"error":     err.Error(),
+		})
+	}
+	mutex.Lock()
+	output.Write(append(line, '\n'))
+	mutex.Unlock()
+}
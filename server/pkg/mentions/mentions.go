@@ -0,0 +1,72 @@
+package mentions
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	@username mentions are resolved to <@UID> when content is stored, so that mentions
+	keep pointing at the same user if they change their username. The client renders
+	the tokens using the users ID.
+*/
+
+var mentionRegex = regexp.MustCompile(`@(\w{2,16})`)
+
+// Replaces @username with <@UID> for every username that exists, and returns the IDs of the mentioned users
+func Resolve(ctx context.Context, colls *db.Collections, content string) (string, []primitive.ObjectID, error) {
+	mentioned := []primitive.ObjectID{}
+	matches := mentionRegex.FindAllStringSubmatch(content, -1)
+	if len(matches) == 0 {
+		return content, mentioned, nil
+	}
+
+	usernames := []string{}
+	for _, m := range matches {
+		usernames = append(usernames, m[1])
+	}
+
+	// Usernames are matched case insensitively. Users who deleted their account can't be mentioned.
+	cursor, err := colls.UserCollection.Find(ctx, bson.M{
+		"username":   bson.M{"$in": usernames},
+		"deleted_at": bson.M{"$exists": false},
+	}, options.Find().
+		SetProjection(bson.M{"_id": 1, "username": 1}).
+		SetCollation(&options.Collation{Locale: "en", Strength: 2}))
+	if err != nil {
+		return content, mentioned, err
+	}
+	defer cursor.Close(ctx)
+	uids := make(map[string]primitive.ObjectID)
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return content, mentioned, err
+		}
+		uids[strings.ToLower(user.Username)] = user.ID
+	}
+	if err := cursor.Err(); err != nil {
+		return content, mentioned, err
+	}
+
+	found := make(map[primitive.ObjectID]struct{})
+	resolved := mentionRegex.ReplaceAllStringFunc(content, func(m string) string {
+		uid, ok := uids[strings.ToLower(m[1:])]
+		if !ok {
+			return m
+		}
+		if _, ok := found[uid]; !ok {
+			found[uid] = struct{}{}
+			mentioned = append(mentioned, uid)
+		}
+		return "<@" + uid.Hex() + ">"
+	})
+	return resolved, mentioned, nil
+}
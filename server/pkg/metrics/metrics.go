@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+	Metrics in the Prometheus text format, served by Handler on /metrics.
+
+	Counters, gauges and histograms are created with promauto at package level, which registers them
+	with the default registry along with the Go runtime and process metrics. Gauge funcs are read when
+	the metrics are scraped, for values that are already kept somewhere else, like the number of socket
+	connections.
+*/
+
+type gaugeFunc struct {
+	desc  *prometheus.Desc
+	label string
+	fn    func() map[string]float64
+}
+
+// The function returns the value for each value of the label. If label is empty the function should
+// return a single value under the empty string.
+func NewGaugeFunc(name string, help string, label string, fn func() map[string]float64) {
+	var labels []string
+	if label != "" {
+		labels = []string{label}
+	}
+	prometheus.MustRegister(&gaugeFunc{prometheus.NewDesc(name, help, labels, nil), label, fn})
+}
+
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	for labelValue, value := range g.fn() {
+		var labelValues []string
+		if g.label != "" {
+			labelValues = []string{labelValue}
+		}
+		metric, err := prometheus.NewConstMetric(g.desc, prometheus.GaugeValue, value, labelValues...)
+		if err != nil {
+			metric = prometheus.NewInvalidMetric(g.desc, err)
+		}
+		ch <- metric
+	}
+}
+
+// Requires the token as a bearer token. Without a token the metrics are only served if public is true.
+func Handler(token string, public bool) http.Handler {
+	metricsHandler := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" && !public {
+			http.NotFound(w, r)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metricsHandler.ServeHTTP(w, r)
+	})
+}
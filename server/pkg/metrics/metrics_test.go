@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func init() {
+	NewGaugeFunc("test_gauge_func", "A gauge func with a label.", "queue", func() map[string]float64 {
+		return map[string]float64{"a": 1, "b": 2}
+	})
+	NewGaugeFunc("test_gauge_func_unlabelled", "A gauge func without a label.", "", func() map[string]float64 {
+		return map[string]float64{"": 3}
+	})
+}
+
+func scrape(h http.Handler, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerAccess(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		public        bool
+		authorization string
+		status        int
+	}{
+		{"closed without a token", "", false, "", http.StatusNotFound},
+		{"public without a token", "", true, "", http.StatusOK},
+		{"token missing", "secret", false, "", http.StatusUnauthorized},
+		{"token wrong", "secret", true, "Bearer wrong", http.StatusUnauthorized},
+		{"token correct", "secret", false, "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		if rec := scrape(Handler(test.token, test.public), test.authorization); rec.Code != test.status {
+			t.Errorf("%v: got status %v, want %v", test.name, rec.Code, test.status)
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	body := scrape(Handler("", true), "").Body.String()
+	for _, want := range []string{
+		"# TYPE test_gauge_func gauge\n",
+		`test_gauge_func{queue="a"} 1` + "\n",
+		`test_gauge_func{queue="b"} 2` + "\n",
+		"test_gauge_func_unlabelled 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %q:\n%v", want, body)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package notifications
+
+import (
+	"context"
+	"time"
+
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Notifications are stored newest first in an array on the users notifications document,
+	capped at MaxNotifications. The notifications changestream sends the newest page and
+	the unread count to the notifications=UID subscription whenever the document changes.
+*/
+
+const (
+	KindMessage        = "MSG"       // Target is the user who sent the message
+	KindGroupMessage   = "GROUP_MSG" // Target is the group conversation
+	KindCommentReply   = "COMMENT_REPLY"
+	KindPostVote       = "POST_VOTE"
+	KindRoomInvitation = "ROOM_INVITATION"
+	KindMention        = "MENTION"
+	KindRoomBan        = "ROOM_BAN"
+)
+
+const (
+	MaxNotifications = 200
+	PageSize         = 20
+)
+
+// Adds a notification for the user. Nothing is created if the user is the actor, or if the user has blocked the actor.
+func Create(ctx context.Context, colls *db.Collections, uid primitive.ObjectID, n models.Notification) error {
+	if n.Actor == uid {
+		return nil
+	}
+	if blocked, err := helpers.IsBlockedBy(ctx, *colls, uid, n.Actor); err != nil {
+		return err
+	} else if blocked {
+		return nil
+	}
+	n.ID = primitive.NewObjectID()
+	n.CreatedAt = primitive.NewDateTimeFromTime(time.Now())
+	n.Read = false
+	// Message notifications are counted by the client, everything else replaces the previous notification
+	// for the same thing, so that toggling a vote doesn't spam the user
+	if n.Kind != KindMessage && n.Kind != KindGroupMessage {
+		if _, err := colls.NotificationsCollection.UpdateByID(ctx, uid, bson.M{
+			"$pull": bson.M{"notifications": bson.M{"kind": n.Kind, "actor": n.Actor, "target_id": n.TargetID}},
+		}); err != nil {
+			return err
+		}
+	}
+	_, err := colls.NotificationsCollection.UpdateByID(ctx, uid, bson.M{
+		"$push": bson.M{
+			"notifications": bson.M{
+				"$each":     []models.Notification{n},
+				"$position": 0,
+				"$slice":    MaxNotifications,
+			},
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// Counts the unread notifications
+func UnreadCount(notifications []models.Notification) int {
+	count := 0
+	for _, n := range notifications {
+		if !n.Read {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns a page of notifications, pages start at 1
+func GetPage(notifications []models.Notification, page int) []models.Notification {
+	start := (page - 1) * PageSize
+	if start >= len(notifications) || start < 0 {
+		return []models.Notification{}
+	}
+	end := start + PageSize
+	if end > len(notifications) {
+		end = len(notifications)
+	}
+	return notifications[start:end]
+}
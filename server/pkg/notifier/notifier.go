@@ -0,0 +1,357 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/notifications"
+	"github.com/web-stuff-98/go-social-media/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var log = logger.New("notifier")
+
+/*
+	Digests of unread notifications for users who are offline. Users opt in from their
+	digest settings. Once a users newest unread notification is older than the idle
+	period, and they are not connected, everything unread since their last digest is
+	sent as one digest through the configured Notifier.
+
+	The notifier and the idle period are set in the config package.
+*/
+
+var ErrNoAddress = errors.New("No address to deliver the digest to")
+
+type DigestItem struct {
+	Kind       string    `json:"kind"`
+	ActorName  string    `json:"actor_name"`
+	TargetID   string    `json:"target_id"`
+	TargetType string    `json:"target_type"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Digest struct {
+	Uid      string       `json:"uid"`
+	Username string       `json:"username"`
+	Address  string       `json:"address,omitempty"`
+	Items    []DigestItem `json:"items"`
+}
+
+type Notifier interface {
+	Send(ctx context.Context, digest Digest) error
+}
+
+/*--------------- WEBHOOK ---------------*/
+
+// Posts the digest as JSON to a URL, for delivery by some other service
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Send(ctx context.Context, digest Digest) error {
+	body, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with status %v", res.StatusCode)
+	}
+	return nil
+}
+
+/*--------------- SMTP ---------------*/
+
+// Sends the digest as a plain text email to the address in the users digest settings
+type SMTPNotifier struct {
+	Addr    string // host:port
+	From    string
+	Auth    smtp.Auth     // Can be nil
+	Timeout time.Duration // For the whole conversation with the server, 30 seconds if zero
+}
+
+// Like smtp.SendMail, except that the connection has a deadline and is closed if the context is cancelled,
+// so that a server that stops responding can't hold up the digester
+func (n *SMTPNotifier) Send(ctx context.Context, digest Digest) error {
+	if digest.Address == "" {
+		return ErrNoAddress
+	}
+	if strings.ContainsAny(digest.Address, "\r\n") {
+		return fmt.Errorf("Invalid address")
+	}
+	host, _, err := net.SplitHostPort(n.Addr)
+	if err != nil {
+		return err
+	}
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblocks whatever read or write is in progress
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP server doesn't support AUTH")
+		}
+		if err := c.Auth(n.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(digest.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatEmail(n.From, digest)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func formatEmail(from string, digest Digest) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %v\r\n", from)
+	fmt.Fprintf(&b, "To: %v\r\n", digest.Address)
+	fmt.Fprintf(&b, "Subject: You have %v unread notifications\r\n", len(digest.Items))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "Hi %v, here's what you missed while you were away:\r\n\r\n", digest.Username)
+	for _, item := range digest.Items {
+		fmt.Fprintf(&b, "- %v\r\n", describeItem(item))
+	}
+	return []byte(b.String())
+}
+
+func describeItem(item DigestItem) string {
+	switch item.Kind {
+	case notifications.KindMessage:
+		return fmt.Sprintf("%v sent you a message", item.ActorName)
+	case notifications.KindGroupMessage:
+		return fmt.Sprintf("%v sent a message to a group you're in", item.ActorName)
+	case notifications.KindCommentReply:
+		return fmt.Sprintf("%v replied to your comment", item.ActorName)
+	case notifications.KindPostVote:
+		return fmt.Sprintf("%v voted on your post", item.ActorName)
+	case notifications.KindRoomInvitation:
+		return fmt.Sprintf("%v invited you to a room", item.ActorName)
+	case notifications.KindMention:
+		return fmt.Sprintf("%v mentioned you", item.ActorName)
+	case notifications.KindRoomBan:
+		return fmt.Sprintf("%v banned you from a room", item.ActorName)
+	}
+	return fmt.Sprintf("%v from %v", item.Kind, item.ActorName)
+}
+
+/*--------------- SETUP ---------------*/
+
+// Returns the configured notifier, or nil if digests are disabled
+func New(cfg config.Digests) (Notifier, error) {
+	switch cfg.Notifier {
+	case "":
+		return nil, nil
+	case "WEBHOOK":
+		return &WebhookNotifier{URL: cfg.WebhookURL}, nil
+	case "SMTP":
+		n := &SMTPNotifier{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Timeout: cfg.SMTPTimeout}
+		if cfg.SMTPUsername != "" {
+			host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+			if err != nil {
+				return nil, err
+			}
+			n.Auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("Unknown notifier %v", cfg.Notifier)
+}
+
+/*--------------- DIGESTER ---------------*/
+
+// Checks for digests to send every minute, until the context is cancelled
+func RunDigester(ctx context.Context, colls *db.Collections, ss *socketserver.SocketServer, n Notifier, idle time.Duration) {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := sendDigests(ctx, colls, ss, n, idle); err != nil {
+					log.Error("Failed to send digests", err, nil)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func sendDigests(ctx context.Context, colls *db.Collections, ss *socketserver.SocketServer, n Notifier, idle time.Duration) error {
+	cursor, err := colls.UserCollection.Find(ctx, bson.M{"digest.enabled": true}, options.Find().SetProjection(bson.M{"username": 1, "digest": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		if err := sendDigest(ctx, colls, ss, n, idle, user); err != nil {
+			log.Error("Failed to send digest", err, logger.Fields{"uid": user.ID.Hex()})
+		}
+	}
+	return cursor.Err()
+}
+
+func sendDigest(ctx context.Context, colls *db.Collections, ss *socketserver.SocketServer, n Notifier, idle time.Duration, user *models.User) error {
+	userNotifications := &models.Notifications{}
+	if err := colls.NotificationsCollection.FindOne(ctx, bson.M{"_id": user.ID}).Decode(&userNotifications); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+
+	// Notifications are stored newest first
+	pending := []models.Notification{}
+	for _, notification := range userNotifications.Notifications {
+		if notification.CreatedAt <= user.Digest.LastSent {
+			break
+		}
+		if !notification.Read {
+			pending = append(pending, notification)
+		}
+	}
+	if len(pending) == 0 || pending[0].CreatedAt.Time().After(time.Now().Add(-idle)) {
+		return nil
+	}
+
+	recvChan := make(chan bool)
+	ss.GetUserOnlineStatus <- socketserver.GetUserOnlineStatus{
+		RecvChan: recvChan,
+		Uid:      user.ID,
+	}
+	if <-recvChan {
+		return nil
+	}
+
+	actorIds := []primitive.ObjectID{}
+	for _, notification := range pending {
+		actorIds = append(actorIds, notification.Actor)
+	}
+	actorNames := make(map[primitive.ObjectID]string)
+	cursor, err := colls.UserCollection.Find(ctx, bson.M{"_id": bson.M{"$in": actorIds}}, options.Find().SetProjection(bson.M{"username": 1}))
+	if err != nil {
+		return err
+	}
+	for cursor.Next(ctx) {
+		actor := &models.User{}
+		if err := cursor.Decode(&actor); err == nil {
+			actorNames[actor.ID] = actor.Username
+		}
+	}
+	cursor.Close(ctx)
+
+	digest := Digest{
+		Uid:      user.ID.Hex(),
+		Username: user.Username,
+		Address:  user.Digest.Address,
+		Items:    []DigestItem{},
+	}
+	for _, notification := range pending {
+		actorName, ok := actorNames[notification.Actor]
+		if !ok {
+			actorName = "Deleted user"
+		}
+		digest.Items = append(digest.Items, DigestItem{
+			Kind:       notification.Kind,
+			ActorName:  actorName,
+			TargetID:   notification.TargetID.Hex(),
+			TargetType: notification.TargetType,
+			CreatedAt:  notification.CreatedAt.Time(),
+		})
+	}
+
+	sendErr := n.Send(ctx, digest)
+	if sendErr != nil && sendErr != ErrNoAddress {
+		// Try again on the next tick
+		return sendErr
+	}
+	// Digests that can't be delivered because the user has no address are dropped
+	if _, err := colls.UserCollection.UpdateByID(ctx, user.ID, bson.M{"$set": bson.M{"digest.last_sent": pending[0].CreatedAt}}); err != nil {
+		return err
+	}
+	return sendErr
+}
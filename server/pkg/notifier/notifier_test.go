@@ -0,0 +1,253 @@
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/web-stuff-98/go-social-media/pkg/notifications"
+)
+
+// A minimal SMTP server that accepts one message per connection and records what it was sent
+type fakeSMTPServer struct {
+	listener net.Listener
+	// Reply to RCPT TO, 250 if empty
+	rcptReply string
+
+	mutex sync.Mutex
+	from  string
+	rcpt  []string
+	data  string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.mutex.Lock()
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			s.mutex.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			if s.rcptReply != "" {
+				reply(s.rcptReply)
+				continue
+			}
+			s.mutex.Lock()
+			s.rcpt = append(s.rcpt, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			s.mutex.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			s.mutex.Lock()
+			s.data = data.String()
+			s.mutex.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func testDigest() Digest {
+	return Digest{
+		Uid:      "63a1e1f0c2a3b4c5d6e7f809",
+		Username: "recipient",
+		Address:  "recipient@example.com",
+		Items: []DigestItem{
+			{Kind: notifications.KindMessage, ActorName: "alice", CreatedAt: time.Now()},
+			{Kind: notifications.KindMention, ActorName: "bob", CreatedAt: time.Now()},
+		},
+	}
+}
+
+func TestSMTPNotifierSend(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	n := &SMTPNotifier{Addr: server.listener.Addr().String(), From: "digests@example.com"}
+
+	if err := n.Send(context.Background(), testDigest()); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.from != "digests@example.com" {
+		t.Errorf("MAIL FROM was %q", server.from)
+	}
+	if len(server.rcpt) != 1 || server.rcpt[0] != "recipient@example.com" {
+		t.Errorf("RCPT TO was %v", server.rcpt)
+	}
+	for _, want := range []string{
+		"From: digests@example.com\r\n",
+		"To: recipient@example.com\r\n",
+		"Subject: You have 2 unread notifications\r\n",
+		"Hi recipient",
+		"- alice sent you a message\r\n",
+		"- bob mentioned you\r\n",
+	} {
+		if !strings.Contains(server.data, want) {
+			t.Errorf("message is missing %q:\n%v", want, server.data)
+		}
+	}
+}
+
+func TestSMTPNotifierRejectedRecipient(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.rcptReply = "550 No such user"
+	n := &SMTPNotifier{Addr: server.listener.Addr().String(), From: "digests@example.com"}
+
+	if err := n.Send(context.Background(), testDigest()); err == nil {
+		t.Fatal("expected an error when the recipient is rejected")
+	}
+}
+
+func TestSMTPNotifierInvalidAddress(t *testing.T) {
+	n := &SMTPNotifier{Addr: "127.0.0.1:1", From: "digests@example.com"}
+
+	digest := testDigest()
+	digest.Address = ""
+	if err := n.Send(context.Background(), digest); err != ErrNoAddress {
+		t.Errorf("expected ErrNoAddress, got %v", err)
+	}
+	digest.Address = "recipient@example.com\r\nBcc: someone@example.com"
+	if err := n.Send(context.Background(), digest); err == nil {
+		t.Error("expected an error for an address containing a line break")
+	}
+}
+
+// A server that accepts the connection and never says anything must not block Send forever
+func TestSMTPNotifierHungServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	t.Run("context", func(t *testing.T) {
+		n := &SMTPNotifier{Addr: listener.Addr().String(), From: "digests@example.com"}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := n.Send(ctx, testDigest()); err == nil {
+			t.Fatal("expected an error from a server that never responds")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Send took %v to give up", elapsed)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		n := &SMTPNotifier{Addr: listener.Addr().String(), From: "digests@example.com", Timeout: 200 * time.Millisecond}
+		start := time.Now()
+		err := n.Send(context.Background(), testDigest())
+		if err == nil {
+			t.Fatal("expected an error from a server that never responds")
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Send took %v to give up", elapsed)
+		}
+	})
+}
+
+func TestWebhookNotifierSend(t *testing.T) {
+	var received Digest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	n := &WebhookNotifier{URL: server.URL}
+	if err := n.Send(context.Background(), testDigest()); err != nil {
+		t.Fatal(err)
+	}
+	if received.Username != "recipient" || len(received.Items) != 2 || received.Items[0].ActorName != "alice" {
+		t.Errorf("unexpected digest %+v", received)
+	}
+}
+
+func TestWebhookNotifierErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	n := &WebhookNotifier{URL: server.URL}
+	if err := n.Send(context.Background(), testDigest()); err == nil {
+		t.Fatal("expected an error for a 500 response")
+	}
+}
@@ -0,0 +1,124 @@
+package passwords
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	Password policy, blocked passwords and hashing. Configured by Init, see the config package
+	for the settings. Passwords hashed with a lower cost are rehashed at login, lowering the cost
+	never weakens existing hashes.
+
+	The policy is only checked when a password is set, so users with passwords from before a change
+	to the policy can still log in.
+*/
+
+var log = logger.New("passwords")
+
+const MaxLength = 72 // In bytes, bcrypt can't hash anything longer
+
+var (
+	policy    = config.Passwords{MinLength: 8, BcryptCost: 14}
+	blocklist = map[string]struct{}{}
+)
+
+// Returns an error if the blocklist file can't be loaded
+func Init(cfg config.Passwords) error {
+	policy = cfg
+	if cfg.BlocklistFile == "" {
+		blocklist = map[string]struct{}{}
+		return nil
+	}
+	if err := loadBlocklist(cfg.BlocklistFile); err != nil {
+		return fmt.Errorf("Could not load password blocklist: %w", err)
+	}
+	log.Info("Loaded blocked passwords", logger.Fields{"count": len(blocklist)})
+	return nil
+}
+
+func loadBlocklist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	list := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	blocklist = list
+	return nil
+}
+
+// Returns an error describing the first problem with the password, the message can be shown to the user
+func Check(password string, username string) error {
+	if len(password) < policy.MinLength {
+		return fmt.Errorf("Password must be at least %v characters", policy.MinLength)
+	}
+	if len(password) > MaxLength {
+		return fmt.Errorf("Password is too long, it must be at most %v bytes", MaxLength)
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		return fmt.Errorf("Password must contain an uppercase letter")
+	}
+	if policy.RequireLower && !hasLower {
+		return fmt.Errorf("Password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		return fmt.Errorf("Password must contain a number")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		return fmt.Errorf("Password must contain a symbol")
+	}
+	if username != "" && strings.EqualFold(password, username) {
+		return fmt.Errorf("Password cannot be the same as your username")
+	}
+	if _, blocked := blocklist[strings.ToLower(password)]; blocked {
+		return fmt.Errorf("This password is too common, it has appeared in data breaches")
+	}
+	return nil
+}
+
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), policy.BcryptCost)
+	return string(hash), err
+}
+
+func Compare(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// True if the hash was made with a lower cost than the one configured
+func NeedsRehash(hash string) bool {
+	hashCost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || hashCost < policy.BcryptCost
+}
@@ -0,0 +1,58 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNeedsRehashOnlyWhenCostIsRaised(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("Password1!"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(config.Passwords{MinLength: 8, BcryptCost: 14})
+
+	tests := []struct {
+		cost   int
+		rehash bool
+	}{
+		{5, false},
+		{6, false},
+		{7, true},
+	}
+	for _, test := range tests {
+		if err := Init(config.Passwords{MinLength: 8, BcryptCost: test.cost}); err != nil {
+			t.Fatal(err)
+		}
+		if got := NeedsRehash(string(hash)); got != test.rehash {
+			t.Errorf("cost %v: got %v, want %v", test.cost, got, test.rehash)
+		}
+	}
+	if !NeedsRehash("not a bcrypt hash") {
+		t.Error("an invalid hash should be rehashed")
+	}
+}
+
+func TestCheckMaxLengthInBytes(t *testing.T) {
+	defer Init(config.Passwords{MinLength: 8, BcryptCost: 14})
+	if err := Init(config.Passwords{MinLength: 8, BcryptCost: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Check(strings.Repeat("a", MaxLength), ""); err != nil {
+		t.Errorf("a %v byte password was rejected: %v", MaxLength, err)
+	}
+	if err := Check(strings.Repeat("a", MaxLength+1), ""); err == nil {
+		t.Errorf("a %v byte password was accepted", MaxLength+1)
+	}
+	// 40 characters, but 80 bytes
+	if err := Check(strings.Repeat("é", 40), ""); err == nil {
+		t.Error("a password over the limit in bytes was accepted")
+	}
+	if _, err := Hash(strings.Repeat("a", MaxLength)); err != nil {
+		t.Errorf("a password at the limit couldn't be hashed: %v", err)
+	}
+}
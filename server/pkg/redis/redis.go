@@ -2,37 +2,26 @@ package rdb
 
 import (
 	"context"
-	"log"
-	"os"
 
 	"github.com/go-redis/redis/v9"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
 )
 
-func Init() *redis.Client {
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "localhost:6379"
-	}
-
-	var rdb *redis.Client
+var log = logger.New("redis")
 
-	opt, _ := redis.ParseURL(redisURL)
-	if os.Getenv("PRODUCTION") == "true" {
-		rdb = redis.NewClient(opt)
-	} else {
-		rdb = redis.NewClient(&redis.Options{
-			Addr:     "localhost:6379",
-			Password: "",
-			DB:       0,
-		})
+func Init(redisURL string) *redis.Client {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Fatal("Invalid Redis URL", err, nil)
 	}
+	rdb := redis.NewClient(opt)
 
-	_, err := rdb.Ping(context.TODO()).Result()
+	_, err = rdb.Ping(context.TODO()).Result()
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatal("Failed to connect to Redis", err, nil)
 	}
 
-	log.Println("Redis client created and connected successfully...")
+	log.Info("Connected to Redis", nil)
 
 	return rdb
 }
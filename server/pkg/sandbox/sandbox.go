@@ -0,0 +1,354 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/web-stuff-98/go-social-media/pkg/config"
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/deletion"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/seed"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/maps"
+)
+
+/*
+	Sandbox mode, for running the site as a public demo.
+
+	The example users, posts and rooms are protected, they can't be modified or deleted
+	through the API, and new accounts are purged a while after they are created. The
+	protected entities are stored in the protected_entities collection along with a copy
+	of their documents. The snapshot command protects everything currently in the database
+	and copies it, the reset command removes everything that isn't protected and puts the
+	protected entities back the way they were when the snapshot was taken.
+
+	See the config package for the settings.
+
+	Commands are run with the server binary, which exits once the command is done:
+	 - sandbox seed     generates example content and takes a snapshot
+	 - sandbox snapshot protects and copies everything in the database
+	 - sandbox reset    removes everything that isn't protected and restores the snapshot
+*/
+
+var log = logger.New("sandbox")
+
+type Protected struct {
+	Uids map[primitive.ObjectID]struct{}
+	Pids map[primitive.ObjectID]struct{}
+	Rids map[primitive.ObjectID]struct{}
+}
+
+// Applies the sandbox purge schedule to the deletion policy. Protected users are never purged for their age.
+func DeletionPolicy(cfg config.Sandbox, policy deletion.Policy, protected *Protected) deletion.Policy {
+	if cfg.Enabled {
+		policy.NewAccountLifetime = cfg.AccountLifetime
+		policy.Protected = protected.Uids
+	}
+	return policy
+}
+
+// Loads the protected entities. Nothing is protected if sandbox mode is off. If nothing has
+// been protected yet, a snapshot is taken so that existing content is protected straight away.
+func Load(ctx context.Context, colls *db.Collections, cfg config.Sandbox) (*Protected, error) {
+	protected := &Protected{
+		Uids: make(map[primitive.ObjectID]struct{}),
+		Pids: make(map[primitive.ObjectID]struct{}),
+		Rids: make(map[primitive.ObjectID]struct{}),
+	}
+	if !cfg.Enabled {
+		return protected, nil
+	}
+	if count, err := colls.ProtectedCollection.CountDocuments(ctx, bson.M{}); err != nil {
+		return nil, err
+	} else if count == 0 {
+		if err := Snapshot(ctx, colls); err != nil {
+			return nil, err
+		}
+	}
+	cursor, err := colls.ProtectedCollection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"kind": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var entity models.ProtectedEntity
+		if err := cursor.Decode(&entity); err != nil {
+			return nil, err
+		}
+		protected.add(entity)
+	}
+	return protected, cursor.Err()
+}
+
+// Each kind has its own set, the handlers check the set for the kind of entity being modified
+func (p *Protected) add(entity models.ProtectedEntity) {
+	switch entity.Kind {
+	case models.ProtectedUser:
+		p.Uids[entity.ID] = struct{}{}
+	case models.ProtectedPost:
+		p.Pids[entity.ID] = struct{}{}
+	case models.ProtectedRoom:
+		p.Rids[entity.ID] = struct{}{}
+	}
+}
+
+/*--------------- COMMANDS ---------------*/
+
+// Runs a sandbox command from the command line arguments after "sandbox"
+func RunCommand(ctx context.Context, colls *db.Collections, cfg config.Sandbox, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: sandbox seed|snapshot|reset")
+	}
+	switch args[0] {
+	case "seed":
+		return Seed(ctx, colls, cfg)
+	case "snapshot":
+		return Snapshot(ctx, colls)
+	case "reset":
+		return Reset(ctx, colls)
+	}
+	return fmt.Errorf("Unknown sandbox command %v", args[0])
+}
+
+// Generates example content and protects it, along with anything else already in the database
+func Seed(ctx context.Context, colls *db.Collections, cfg config.Sandbox) error {
+	protected := &Protected{
+		Uids: make(map[primitive.ObjectID]struct{}),
+		Pids: make(map[primitive.ObjectID]struct{}),
+		Rids: make(map[primitive.ObjectID]struct{}),
+	}
+	if err := seed.SeedDB(colls, cfg.SeedUsers, cfg.SeedPosts, cfg.SeedRooms, protected.Uids, protected.Pids, protected.Rids); err != nil {
+		return err
+	}
+	return Snapshot(ctx, colls)
+}
+
+// The collections each kind of entity is kept in, the first is the entity itself and the rest use its ID
+func entityCollections(colls *db.Collections) map[string][]*mongo.Collection {
+	return map[string][]*mongo.Collection{
+		models.ProtectedUser: {colls.UserCollection, colls.PfpCollection, colls.InboxCollection, colls.NotificationsCollection},
+		models.ProtectedPost: {colls.PostCollection, colls.PostImageCollection, colls.PostThumbCollection, colls.PostVoteCollection, colls.PostCommentsCollection},
+		models.ProtectedRoom: {colls.RoomCollection, colls.RoomMessagesCollection, colls.RoomImageCollection, colls.RoomPrivateDataCollection},
+	}
+}
+
+// Protects every user, post and room in the database, replacing the copies of any that were already protected
+func Snapshot(ctx context.Context, colls *db.Collections) error {
+	for kind, entityColls := range entityCollections(colls) {
+		ids, err := findIds(ctx, entityColls[0], bson.M{})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			documents, err := copyDocuments(ctx, id, entityColls)
+			if err != nil {
+				return err
+			}
+			if _, err := colls.ProtectedCollection.ReplaceOne(ctx, bson.M{"_id": id}, models.ProtectedEntity{
+				ID:        id,
+				Kind:      kind,
+				Documents: documents,
+			}, options.Replace().SetUpsert(true)); err != nil {
+				return err
+			}
+		}
+		log.Info("Protected entities", logger.Fields{"kind": kind, "count": len(ids)})
+	}
+	return nil
+}
+
+func copyDocuments(ctx context.Context, id primitive.ObjectID, entityColls []*mongo.Collection) (map[string]bson.Raw, error) {
+	documents := make(map[string]bson.Raw)
+	for _, coll := range entityColls {
+		doc, err := coll.FindOne(ctx, bson.M{"_id": id}).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		documents[coll.Name()] = doc
+	}
+	return documents, nil
+}
+
+// Puts back the documents copied by the last snapshot, undoing any changes made to protected entities since
+func restore(ctx context.Context, colls *db.Collections) error {
+	byName := make(map[string]*mongo.Collection)
+	for _, entityColls := range entityCollections(colls) {
+		for _, coll := range entityColls {
+			byName[coll.Name()] = coll
+		}
+	}
+	cursor, err := colls.ProtectedCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	restored, missing := 0, 0
+	for cursor.Next(ctx) {
+		var entity models.ProtectedEntity
+		if err := cursor.Decode(&entity); err != nil {
+			return err
+		}
+		// Protected before snapshots kept a copy
+		if len(entity.Documents) == 0 {
+			missing++
+			continue
+		}
+		for name, doc := range entity.Documents {
+			coll, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("Protected %v has a copy from unknown collection %v", entity.ID.Hex(), name)
+			}
+			if _, err := coll.ReplaceOne(ctx, bson.M{"_id": entity.ID}, doc, options.Replace().SetUpsert(true)); err != nil {
+				return err
+			}
+		}
+		restored++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	log.Info("Restored protected entities", logger.Fields{"count": restored})
+	if missing > 0 {
+		log.Warn("Protected entities have no copy to restore, run sandbox snapshot to take one", logger.Fields{"count": missing})
+	}
+	return nil
+}
+
+// Removes everything that isn't protected and restores the snapshot. Users are removed by deletion
+// jobs, which are run by the server, everything else is removed straight away.
+func Reset(ctx context.Context, colls *db.Collections) error {
+	protected, err := Load(ctx, colls, config.Sandbox{Enabled: true})
+	if err != nil {
+		return err
+	}
+	uids := maps.Keys(protected.Uids)
+
+	// Users
+	ids, err := findIds(ctx, colls.UserCollection, bson.M{"_id": bson.M{"$nin": uids}})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := deletion.Enqueue(ctx, colls, id); err != nil {
+			return err
+		}
+	}
+	log.Info("Queued user deletions", logger.Fields{"count": len(ids)})
+
+	// Posts
+	ids, err = findIds(ctx, colls.PostCollection, bson.M{"_id": bson.M{"$nin": maps.Keys(protected.Pids)}})
+	if err != nil {
+		return err
+	}
+	if err := deleteByIds(ctx, ids,
+		colls.PostImageCollection,
+		colls.PostThumbCollection,
+		colls.PostVoteCollection,
+		colls.PostCommentsCollection,
+		colls.PostCollection,
+	); err != nil {
+		return err
+	}
+	log.Info("Deleted posts", logger.Fields{"count": len(ids)})
+	// Deletion jobs anonymize comments instead of removing them, so they are removed here. Replies
+	// to removed comments are removed by the posts cleanup. Votes are removed by the deletion jobs.
+	if _, err := colls.PostCommentsCollection.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{
+		"comments": bson.M{"author_id": bson.M{"$nin": uids}},
+	}}); err != nil {
+		return err
+	}
+
+	// Rooms
+	ids, err = findIds(ctx, colls.RoomCollection, bson.M{"_id": bson.M{"$nin": maps.Keys(protected.Rids)}})
+	if err != nil {
+		return err
+	}
+	if err := deleteByIds(ctx, ids,
+		colls.RoomMessagesCollection,
+		colls.RoomImageCollection,
+		colls.RoomPrivateDataCollection,
+		colls.RoomCollection,
+	); err != nil {
+		return err
+	}
+	log.Info("Deleted rooms", logger.Fields{"count": len(ids)})
+	if _, err := colls.RoomMessagesCollection.UpdateMany(ctx, bson.M{}, bson.M{"$set": bson.M{
+		"messages":     []models.RoomMessage{},
+		"pinned":       []primitive.ObjectID{},
+		"announcement": "",
+	}}); err != nil {
+		return err
+	}
+	if _, err := colls.RoomPrivateDataCollection.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{
+		"members":    bson.M{"$nin": uids},
+		"banned":     bson.M{"$nin": uids},
+		"moderators": bson.M{"$nin": uids},
+	}}); err != nil {
+		return err
+	}
+
+	// Messages, groups and notifications. Every attachment belongs to a message, so they all go.
+	if _, err := colls.InboxCollection.UpdateMany(ctx, bson.M{}, bson.M{"$set": bson.M{
+		"messages":               []models.PrivateMessage{},
+		"messages_sent_to":       []primitive.ObjectID{},
+		"message_requests":       []models.PrivateMessage{},
+		"accepted_requests_from": []primitive.ObjectID{},
+		"declined_requests_from": []primitive.ObjectID{},
+	}}); err != nil {
+		return err
+	}
+	for _, coll := range []*mongo.Collection{
+		colls.GroupConversationCollection,
+		colls.GroupMessagesCollection,
+		colls.AttachmentMetadataCollection,
+		colls.AttachmentChunksCollection,
+	} {
+		if _, err := coll.DeleteMany(ctx, bson.M{}); err != nil {
+			return err
+		}
+	}
+	if _, err := colls.NotificationsCollection.UpdateMany(ctx, bson.M{}, bson.M{"$set": bson.M{"notifications": []models.Notification{}}}); err != nil {
+		return err
+	}
+
+	return restore(ctx, colls)
+}
+
+func findIds(ctx context.Context, coll *mongo.Collection, filter bson.M) ([]primitive.ObjectID, error) {
+	cursor, err := coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	ids := []primitive.ObjectID{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids, cursor.Err()
+}
+
+func deleteByIds(ctx context.Context, ids []primitive.ObjectID, collections ...*mongo.Collection) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, coll := range collections {
+		if _, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package sandbox
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/web-stuff-98/go-social-media/pkg/db"
+	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestProtectedKeepsKindsApart(t *testing.T) {
+	p := &Protected{
+		Uids: make(map[primitive.ObjectID]struct{}),
+		Pids: make(map[primitive.ObjectID]struct{}),
+		Rids: make(map[primitive.ObjectID]struct{}),
+	}
+	uid, pid, rid := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	p.add(models.ProtectedEntity{ID: uid, Kind: models.ProtectedUser})
+	p.add(models.ProtectedEntity{ID: pid, Kind: models.ProtectedPost})
+	p.add(models.ProtectedEntity{ID: rid, Kind: models.ProtectedRoom})
+	p.add(models.ProtectedEntity{ID: primitive.NewObjectID(), Kind: "unknown"})
+
+	tests := []struct {
+		name string
+		set  map[primitive.ObjectID]struct{}
+		want primitive.ObjectID
+	}{
+		{"users", p.Uids, uid},
+		{"posts", p.Pids, pid},
+		{"rooms", p.Rids, rid},
+	}
+	for _, test := range tests {
+		if len(test.set) != 1 {
+			t.Errorf("%v has %v entries, want 1", test.name, len(test.set))
+		}
+		if _, ok := test.set[test.want]; !ok {
+			t.Errorf("%v is missing %v", test.name, test.want.Hex())
+		}
+	}
+}
+
+// Set MONGODB_TEST_URI to run this, a database is created for it and dropped afterwards
+func TestResetRestoresSnapshot(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	DB, colls := db.Init(ctx, uri, "sandbox_test_"+primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		cancel()
+		DB.Drop(context.Background())
+		DB.Client().Disconnect(context.Background())
+	})
+
+	uid, pid := primitive.NewObjectID(), primitive.NewObjectID()
+	if _, err := colls.UserCollection.InsertOne(ctx, bson.M{"_id": uid, "username": "example", "bio": "original bio", "blocked": bson.A{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := colls.PostCollection.InsertOne(ctx, bson.M{"_id": pid, "author_id": uid, "title": "Original title"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := colls.PostCommentsCollection.InsertOne(ctx, bson.M{"_id": pid, "comments": bson.A{}, "votes": bson.A{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Snapshot(ctx, colls); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made after the snapshot, including a comment by a protected user and a deleted document
+	if _, err := colls.UserCollection.UpdateByID(ctx, uid, bson.M{"$set": bson.M{"bio": "changed", "blocked": bson.A{primitive.NewObjectID()}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := colls.PostCommentsCollection.UpdateByID(ctx, pid, bson.M{"$push": bson.M{"comments": bson.M{"_id": primitive.NewObjectID(), "author_id": uid, "content": "new"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := colls.PostCollection.DeleteOne(ctx, bson.M{"_id": pid}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Reset(ctx, colls); err != nil {
+		t.Fatal(err)
+	}
+
+	var user models.User
+	if err := colls.UserCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Bio != "original bio" || len(user.Blocked) != 0 {
+		t.Errorf("user was not restored: bio %q, blocked %v", user.Bio, user.Blocked)
+	}
+	var post models.Post
+	if err := colls.PostCollection.FindOne(ctx, bson.M{"_id": pid}).Decode(&post); err != nil {
+		t.Fatalf("deleted post was not restored: %v", err)
+	}
+	if post.Title != "Original title" {
+		t.Errorf("post title is %q", post.Title)
+	}
+	var cmts models.PostComments
+	if err := colls.PostCommentsCollection.FindOne(ctx, bson.M{"_id": pid}).Decode(&cmts); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmts.Comments) != 0 {
+		t.Errorf("comments made after the snapshot survived the reset: %v", cmts.Comments)
+	}
+}
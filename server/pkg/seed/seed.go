@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
-	"log"
 	"math/rand"
 	"regexp"
 	"strconv"
@@ -17,6 +16,7 @@ import (
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
 	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
 
 	"github.com/lucsky/cuid"
 	"github.com/nfnt/resize"
@@ -25,14 +25,16 @@ import (
 	"gopkg.in/loremipsum.v1"
 )
 
+var log = logger.New("seed")
+
 func SeedDB(colls *db.Collections, numUsers int, numPosts int, numRooms int, uids map[primitive.ObjectID]struct{}, pids map[primitive.ObjectID]struct{}, rids map[primitive.ObjectID]struct{}) (err error) {
-	log.Println("Generating seed...")
+	log.Info("Generating seed", nil)
 
 	// Generate users
 	for i := 0; i < numUsers; i++ {
 		uid, err := generateUser(i, colls)
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatal("Failed to generate seed", err, nil)
 		}
 		uids[uid] = struct{}{}
 	}
@@ -44,7 +46,7 @@ func SeedDB(colls *db.Collections, numUsers int, numPosts int, numRooms int, uid
 		uid := randomKey(uids)
 		pid, err := generatePost(colls, lipsum, uid)
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatal("Failed to generate seed", err, nil)
 		}
 		pids[pid] = struct{}{}
 	}
@@ -60,16 +62,16 @@ func SeedDB(colls *db.Collections, numUsers int, numPosts int, numRooms int, uid
 	}
 
 	// Generate rooms
-	for i := 0; i < numPosts; i++ {
+	for i := 0; i < numRooms; i++ {
 		uid := randomKey(uids)
 		rid, err := generateRoom(colls, lipsum, uid, i)
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatal("Failed to generate seed", err, nil)
 		}
 		rids[rid] = struct{}{}
 	}
 
-	log.Println("Seed generated...")
+	log.Info("Seed generated", logger.Fields{"users": len(uids), "posts": len(pids), "rooms": len(rids)})
 
 	return nil
 }
@@ -89,8 +91,12 @@ func generateUser(i int, colls *db.Collections) (uid primitive.ObjectID, err err
 		return primitive.NilObjectID, err
 	}
 	inserted, err := colls.UserCollection.InsertOne(context.TODO(), models.User{
-		Username: fmt.Sprintf("TestAcc%d", i+1),
-		Password: "$2a$12$VyvB4n4y8eq6mX8of9A3OOv/FRSzxSe54sk6ptifiT82RMtGpPI4a",
+		Username:        fmt.Sprintf("TestAcc%d", i+1),
+		Password:        "$2a$12$VyvB4n4y8eq6mX8of9A3OOv/FRSzxSe54sk6ptifiT82RMtGpPI4a",
+		Blocked:         []primitive.ObjectID{},
+		Links:           []string{},
+		CreatedAt:       primitive.NewDateTimeFromTime(time.Now()),
+		UsernameHistory: []models.UsernameChange{},
 	})
 	if err != nil {
 		return primitive.NilObjectID, err
@@ -105,7 +111,7 @@ func generateUser(i int, colls *db.Collections) (uid primitive.ObjectID, err err
 	if _, err := colls.InboxCollection.InsertOne(context.TODO(), inbox); err != nil {
 		return primitive.NilObjectID, err
 	}
-	if _, err := colls.NotificationsCollection.InsertOne(context.TODO(), inbox); err != nil {
+	if _, err := colls.NotificationsCollection.InsertOne(context.TODO(), notifications); err != nil {
 		return primitive.NilObjectID, err
 	}
 	if colls.PfpCollection.InsertOne(context.TODO(), models.Pfp{
@@ -293,11 +299,11 @@ func generatePostVotes(colls *db.Collections, pid primitive.ObjectID, uids map[p
 
 	_, err := colls.PostVoteCollection.UpdateByID(context.TODO(), pid, bson.M{"$set": bson.M{"votes": votes.Votes}})
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatal("Failed to generate seed", err, nil)
 	}
 
 	if colls.PostCollection.UpdateByID(context.TODO(), pid, bson.M{"$set": bson.M{"sort_vote_count": positiveVotes - negativeVotes}}); err != nil {
-		log.Fatalln(err)
+		log.Fatal("Failed to generate seed", err, nil)
 	}
 
 	return nil
@@ -433,7 +439,7 @@ func generateComments(colls *db.Collections, pid primitive.ObjectID, uids map[pr
 	}
 
 	if _, err := colls.PostCommentsCollection.UpdateByID(context.TODO(), pid, bson.M{"$set": bson.M{"comments": comments.Comments, "votes": comments.Votes}}); err != nil {
-		log.Fatalln(err)
+		log.Fatal("Failed to generate seed", err, nil)
 	}
 
 	return nil
@@ -11,7 +11,13 @@ package socketmodels
 
 // TYPE: OPEN_CONV & EXIT_CONV
 type OpenExitConv struct {
-	Uid string `json:"uid"`
+	Uid     string `json:"uid"` // The other users ID, or the group ID if IsGroup is true
+	IsGroup bool   `json:"is_group"`
+}
+
+// TYPE: SET_PRESENCE
+type SetPresence struct {
+	Presence string `json:"presence"` // ONLINE, IDLE, DND or INVISIBLE
 }
 
 // TYPE: PRIVATE_MESSAGE
@@ -63,6 +69,29 @@ type RoomMessageUpdate struct {
 	RoomId  string `json:"room_id"`
 }
 
+// TYPE: GROUP_MESSAGE
+type GroupMessage struct {
+	Type          string `json:"TYPE"`
+	GroupId       string `json:"group_id"`
+	Content       string `json:"content"`
+	HasAttachment bool   `json:"has_attachment"`
+}
+
+// TYPE: GROUP_MESSAGE_DELETE
+type GroupMessageDelete struct {
+	Type    string `json:"TYPE"`
+	MsgId   string `json:"msg_id"`
+	GroupId string `json:"group_id"`
+}
+
+// TYPE: GROUP_MESSAGE_UPDATE
+type GroupMessageUpdate struct {
+	Type    string `json:"TYPE"`
+	MsgId   string `json:"msg_id"`
+	Content string `json:"content"`
+	GroupId string `json:"group_id"`
+}
+
 // TYPE: OPEN_SUBSCRIPTION/CLOSE_SUBSCRIPTION
 type OpenCloseSubscription struct {
 	Name string `json:"name"`
@@ -73,7 +102,7 @@ type OpenCloseSubscriptions struct {
 	Names []string `json:"names"`
 }
 
-// TYPE: ROOM_MESSAGE/ROOM_MESSAGE_DELETE/ROOM_MESSAGE_UPDATE/PRIVATE_MESSAGE/PRIVATE_MESSAGE_DELETE/PRIVATE_MESSAGE_UPDATE/PRIVATE_MESSAGE_INVITE_RESPONDED/POST_VOTE/POST_COMMENT_VOTE/ATTACHMENT_PROGRESS/ATTACHMENT_COMPLETE/RESPONSE_MESSAGE/NOTIFICATIONS
+// TYPE: ROOM_MESSAGE/ROOM_MESSAGE_DELETE/ROOM_MESSAGE_UPDATE/GROUP_MESSAGE/GROUP_MESSAGE_DELETE/GROUP_MESSAGE_UPDATE/PRIVATE_MESSAGE/PRIVATE_MESSAGE_DELETE/PRIVATE_MESSAGE_UPDATE/PRIVATE_MESSAGE_INVITE_RESPONDED/POST_VOTE/POST_COMMENT_VOTE/ATTACHMENT_PROGRESS/ATTACHMENT_COMPLETE/RESPONSE_MESSAGE/NOTIFICATIONS
 type OutMessage struct {
 	Type string `json:"TYPE"`
 	Data string `json:"DATA"`
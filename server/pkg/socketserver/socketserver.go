@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 	"time"
@@ -12,9 +11,13 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/web-stuff-98/go-social-media/pkg/db"
 	"github.com/web-stuff-98/go-social-media/pkg/db/models"
+	"github.com/web-stuff-98/go-social-media/pkg/helpers"
+	"github.com/web-stuff-98/go-social-media/pkg/logger"
+	"github.com/web-stuff-98/go-social-media/pkg/metrics"
 	"github.com/web-stuff-98/go-social-media/pkg/socketmodels"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /*
@@ -24,6 +27,8 @@ import (
 	inboxes/notifications or subscribe to rooms etc without being authenticated.
 */
 
+var log = logger.New("socketserver")
+
 /*--------------- SOCKET SERVER STRUCT ---------------*/
 type SocketServer struct {
 	Connections                 Connections
@@ -31,15 +36,22 @@ type SocketServer struct {
 	ConnectionSubscriptionCount ConnectionsSubscriptionCount
 	UserOnlineStatus            UserOnlineStatus
 	GetUserOnlineStatus         chan GetUserOnlineStatus
+	GetUserPresence             chan GetUserPresence
+	SetUserPresence             chan UserPresenceInfo
 
 	RegisterConn   chan ConnectionInfo
 	UnregisterConn chan ConnectionInfo
 
+	// Closes all the connections made with a session, when the session is revoked or the user logs out
+	ConnectionSessions ConnectionSessions
+	CloseSessionConns  chan primitive.ObjectID
+
 	RegisterSubscriptionConn   chan SubscriptionConnectionInfo
 	UnregisterSubscriptionConn chan SubscriptionConnectionInfo
 
 	SendDataToSubscription           chan SubscriptionDataMessage
 	SendDataToSubscriptionExclusive  chan ExclusiveSubscriptionDataMessage
+	SendDataToSubscriptionInclusive  chan InclusiveSubscriptionDataMessage
 	SendDataToSubscriptions          chan SubscriptionDataMessageMulti
 	SendDataToSubscriptionsExclusive chan ExclusiveSubscriptionDataMessageMulti
 	RemoveUserFromSubscription       chan RemoveUserFromSubscription
@@ -70,6 +82,10 @@ type Connections struct {
 	data  map[*websocket.Conn]primitive.ObjectID
 	mutex sync.Mutex
 }
+type ConnectionSessions struct {
+	data  map[*websocket.Conn]primitive.ObjectID
+	mutex sync.Mutex
+}
 type Subscriptions struct {
 	data  map[string]map[*websocket.Conn]primitive.ObjectID
 	mutex sync.Mutex
@@ -87,7 +103,7 @@ type OpenConversations struct {
 	mutex sync.Mutex
 }
 type UserOnlineStatus struct {
-	data  map[primitive.ObjectID]bool
+	data  map[primitive.ObjectID]string // The presence state of each connected user
 	mutex sync.Mutex
 }
 
@@ -111,11 +127,16 @@ type GetUserOnlineStatus struct {
 	RecvChan chan<- bool
 	Uid      primitive.ObjectID
 }
+type GetUserPresence struct {
+	RecvChan chan<- string // Receives the users own presence state, OFFLINE if they aren't connected
+	Uid      primitive.ObjectID
+}
 
 /*--------------- OTHER STRUCTS ---------------*/
 type ConnectionInfo struct {
 	Conn        *websocket.Conn
 	Uid         primitive.ObjectID
+	Sid         primitive.ObjectID // Will be primitive.NilObjectID if the user isn't logged in
 	VidChatOpen bool
 }
 type SubscriptionConnectionInfo struct {
@@ -132,6 +153,11 @@ type ExclusiveSubscriptionDataMessage struct {
 	Data    []byte
 	Exclude map[primitive.ObjectID]bool
 }
+type InclusiveSubscriptionDataMessage struct {
+	Name    string
+	Data    []byte
+	Include map[primitive.ObjectID]bool
+}
 type SubscriptionDataMessageMulti struct {
 	Names []string
 	Data  []byte
@@ -158,12 +184,17 @@ type RemoveUserFromSubscription struct {
 	Name string
 	Uid  primitive.ObjectID
 }
+type UserPresenceInfo struct {
+	Uid      primitive.ObjectID
+	Presence string
+}
 type UserOpenCloseConversationWith struct {
 	Uid     primitive.ObjectID
 	ConvUid primitive.ObjectID
 }
 
-func Init(colls *db.Collections) (*SocketServer, error) {
+// The cleanup ticker stops when the context is cancelled
+func Init(ctx context.Context, colls *db.Collections) (*SocketServer, error) {
 	socketServer := &SocketServer{
 		Connections: Connections{
 			data: make(map[*websocket.Conn]primitive.ObjectID),
@@ -175,23 +206,31 @@ func Init(colls *db.Collections) (*SocketServer, error) {
 			data: make(map[*websocket.Conn]uint8),
 		},
 		UserOnlineStatus: UserOnlineStatus{
-			data: make(map[primitive.ObjectID]bool),
+			data: make(map[primitive.ObjectID]string),
 		},
 		GetUserOnlineStatus: make(chan GetUserOnlineStatus),
+		GetUserPresence:     make(chan GetUserPresence),
+		SetUserPresence:     make(chan UserPresenceInfo),
 
 		RegisterConn:   make(chan ConnectionInfo),
 		UnregisterConn: make(chan ConnectionInfo),
 
+		ConnectionSessions: ConnectionSessions{
+			data: make(map[*websocket.Conn]primitive.ObjectID),
+		},
+		CloseSessionConns: make(chan primitive.ObjectID),
+
 		RegisterSubscriptionConn:   make(chan SubscriptionConnectionInfo),
 		UnregisterSubscriptionConn: make(chan SubscriptionConnectionInfo),
 
 		SendDataToSubscription:           make(chan SubscriptionDataMessage),
 		SendDataToSubscriptionExclusive:  make(chan ExclusiveSubscriptionDataMessage),
+		SendDataToSubscriptionInclusive:  make(chan InclusiveSubscriptionDataMessage),
 		SendDataToSubscriptions:          make(chan SubscriptionDataMessageMulti),
 		SendDataToSubscriptionsExclusive: make(chan ExclusiveSubscriptionDataMessageMulti),
 		RemoveUserFromSubscription:       make(chan RemoveUserFromSubscription),
 
-		MessageSendQueue: make(chan QueuedMessage),
+		MessageSendQueue: make(chan QueuedMessage, messageSendQueueSize),
 
 		VidChatOpenChan:  make(chan VidChatOpenData),
 		VidChatCloseChan: make(chan *websocket.Conn),
@@ -212,40 +251,60 @@ func Init(colls *db.Collections) (*SocketServer, error) {
 
 		DestroySubscription: make(chan string),
 	}
-	RunServer(socketServer, colls)
+	RunServer(ctx, socketServer, colls)
+	registerMetrics(socketServer)
 	return socketServer, nil
 }
 
-func RunServer(socketServer *SocketServer, colls *db.Collections) {
+// Buffered so that a slow connection doesn't hold up the subscription loops straight away
+const messageSendQueueSize = 256
+
+func registerMetrics(socketServer *SocketServer) {
+	metrics.NewGaugeFunc("websocket_connections", "Open websocket connections.", "", func() map[string]float64 {
+		socketServer.Connections.mutex.Lock()
+		defer socketServer.Connections.mutex.Unlock()
+		return map[string]float64{"": float64(len(socketServer.Connections.data))}
+	})
+	metrics.NewGaugeFunc("socket_subscriptions", "Open subscriptions by the part of the subscription name before the =.", "prefix", func() map[string]float64 {
+		socketServer.Subscriptions.mutex.Lock()
+		defer socketServer.Subscriptions.mutex.Unlock()
+		counts := make(map[string]float64)
+		for name := range socketServer.Subscriptions.data {
+			prefix, _, _ := strings.Cut(name, "=")
+			counts[prefix]++
+		}
+		return counts
+	})
+	metrics.NewGaugeFunc("socket_queue_length", "Messages waiting in the socket server queues.", "queue", func() map[string]float64 {
+		return map[string]float64{"message_send": float64(len(socketServer.MessageSendQueue))}
+	})
+}
+
+func RunServer(ctx context.Context, socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Connection registration ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in WS registration :", r)
-				}
-			}()
+			defer log.Recover("WS registration")
 			connData := <-socketServer.RegisterConn
 			if connData.Conn != nil {
 				socketServer.Connections.mutex.Lock()
 				socketServer.Connections.data[connData.Conn] = connData.Uid
 				socketServer.Connections.mutex.Unlock()
+				if connData.Sid != primitive.NilObjectID {
+					socketServer.ConnectionSessions.mutex.Lock()
+					socketServer.ConnectionSessions.data[connData.Conn] = connData.Sid
+					socketServer.ConnectionSessions.mutex.Unlock()
+				}
 				if connData.Uid != primitive.NilObjectID {
 					socketServer.UserOnlineStatus.mutex.Lock()
-					socketServer.UserOnlineStatus.data[connData.Uid] = true
+					presence, alreadyOnline := socketServer.UserOnlineStatus.data[connData.Uid]
+					if !alreadyOnline {
+						presence = getStoredPresence(colls, connData.Uid)
+						socketServer.UserOnlineStatus.data[connData.Uid] = presence
+					}
 					socketServer.UserOnlineStatus.mutex.Unlock()
-				}
-				outBytes, err := json.Marshal(socketmodels.OutChangeMessage{
-					Type:   "CHANGE",
-					Method: "UPDATE",
-					Data:   `{"ID":"` + connData.Uid.Hex() + `"` + `,"online":true}`,
-					Entity: "USER",
-				})
-				if err == nil {
-					socketServer.SendDataToSubscription <- SubscriptionDataMessage{
-						Name: "user=" + connData.Uid.Hex(),
-						Data: outBytes,
+					if !alreadyOnline && presence != models.PresenceInvisible {
+						sendPresenceToSubscribers(socketServer, colls, connData.Uid, presence)
 					}
 				}
 			}
@@ -254,12 +313,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Disconnect registration ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in WS deregistration :", r)
-				}
-			}()
+			defer log.Recover("WS deregistration")
 			connData := <-socketServer.UnregisterConn
 			socketServer.Connections.mutex.Lock()
 			socketServer.Subscriptions.mutex.Lock()
@@ -272,7 +326,6 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 					delete(socketServer.Connections.data, conn)
 					delete(socketServer.VidChatStatus.data, conn)
 					delete(socketServer.ConnectionSubscriptionCount.data, conn)
-					delete(socketServer.UserOnlineStatus.data, connData.Uid)
 					if connData.Uid != primitive.NilObjectID {
 						delete(socketServer.OpenConversations.data, connData.Uid)
 					}
@@ -287,22 +340,24 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 					break
 				}
 			}
+			socketServer.ConnectionSessions.mutex.Lock()
+			delete(socketServer.ConnectionSessions.data, connData.Conn)
+			socketServer.ConnectionSessions.mutex.Unlock()
+			// The user is still online if they have another connection open
+			wentOffline := false
+			presence := ""
 			if connData.Uid != primitive.NilObjectID {
-				socketServer.UserOnlineStatus.mutex.Lock()
-				delete(socketServer.UserOnlineStatus.data, connData.Uid)
-				socketServer.UserOnlineStatus.mutex.Unlock()
-				outBytes, err := json.Marshal(socketmodels.OutChangeMessage{
-					Type:   "CHANGE",
-					Method: "UPDATE",
-					Data:   `{"ID":"` + connData.Uid.Hex() + `"` + `,"online":false}`,
-					Entity: "USER",
-				})
-				if err == nil {
-					socketServer.SendDataToSubscription <- SubscriptionDataMessage{
-						Name: "user=" + connData.Uid.Hex(),
-						Data: outBytes,
+				wentOffline = true
+				for _, uid := range socketServer.Connections.data {
+					if uid == connData.Uid {
+						wentOffline = false
+						break
 					}
 				}
+				if wentOffline {
+					presence = socketServer.UserOnlineStatus.data[connData.Uid]
+					delete(socketServer.UserOnlineStatus.data, connData.Uid)
+				}
 			}
 			socketServer.Connections.mutex.Unlock()
 			socketServer.Subscriptions.mutex.Unlock()
@@ -310,36 +365,74 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 			socketServer.ConnectionSubscriptionCount.mutex.Unlock()
 			socketServer.OpenConversations.mutex.Unlock()
 			socketServer.UserOnlineStatus.mutex.Unlock()
+			// Sent after the mutexes are unlocked because the subscription channel needs to lock them.
+			// Invisible users already appear offline, so their last seen time is left alone.
+			if wentOffline && presence != models.PresenceInvisible {
+				colls.UserCollection.UpdateByID(context.Background(), connData.Uid, bson.M{"$set": bson.M{"last_seen": primitive.NewDateTimeFromTime(time.Now())}})
+				sendPresenceToSubscribers(socketServer, colls, connData.Uid, models.PresenceOffline)
+			}
 		}
 	}()
-	/* ----- Get user online status ----- */
+	/* ----- Close session connections ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in get user online status :", r)
+			defer log.Recover("close session connections")
+			sid := <-socketServer.CloseSessionConns
+			socketServer.ConnectionSessions.mutex.Lock()
+			for conn, connSid := range socketServer.ConnectionSessions.data {
+				if connSid == sid {
+					// The reader loop will error and deregister the connection
+					conn.Close()
 				}
-			}()
+			}
+			socketServer.ConnectionSessions.mutex.Unlock()
+		}
+	}()
+	/* ----- Get user online status ----- */
+	go func() {
+		for {
+			defer log.Recover("get user online status")
 			data := <-socketServer.GetUserOnlineStatus
 			socketServer.UserOnlineStatus.mutex.Lock()
-			if isOnline, ok := socketServer.UserOnlineStatus.data[data.Uid]; ok {
-				data.RecvChan <- isOnline
-			} else {
-				data.RecvChan <- false
+			_, isOnline := socketServer.UserOnlineStatus.data[data.Uid]
+			socketServer.UserOnlineStatus.mutex.Unlock()
+			data.RecvChan <- isOnline
+		}
+	}()
+	/* ----- Get user presence ----- */
+	go func() {
+		for {
+			defer log.Recover("get user presence")
+			data := <-socketServer.GetUserPresence
+			socketServer.UserOnlineStatus.mutex.Lock()
+			presence, ok := socketServer.UserOnlineStatus.data[data.Uid]
+			socketServer.UserOnlineStatus.mutex.Unlock()
+			if !ok {
+				presence = models.PresenceOffline
+			}
+			data.RecvChan <- presence
+		}
+	}()
+	/* ----- Set user presence ----- */
+	go func() {
+		for {
+			defer log.Recover("set user presence")
+			data := <-socketServer.SetUserPresence
+			socketServer.UserOnlineStatus.mutex.Lock()
+			_, ok := socketServer.UserOnlineStatus.data[data.Uid]
+			if ok {
+				socketServer.UserOnlineStatus.data[data.Uid] = data.Presence
 			}
 			socketServer.UserOnlineStatus.mutex.Unlock()
+			if ok {
+				sendPresenceToSubscribers(socketServer, colls, data.Uid, VisiblePresence(data.Presence))
+			}
 		}
 	}()
 	/* ----- Send messages in queue ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in queued socket messages :", r)
-				}
-			}()
+			defer log.Recover("queued socket messages")
 			data := <-socketServer.MessageSendQueue
 			data.Conn.WriteMessage(websocket.TextMessage, data.Data)
 		}
@@ -347,12 +440,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Subscription connection registration (also check the authorization if subscription requires it) ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in subscription registration :", r)
-				}
-			}()
+			defer log.Recover("subscription registration")
 			connData := <-socketServer.RegisterSubscriptionConn
 			if connData.Conn != nil {
 				allow := true
@@ -378,7 +466,8 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 						allow = false
 					}
 				}
-				// Make sure users cannot subscribe to rooms if they aren't logged in, banned, or not a member (if rooms private)
+				// Make sure users cannot subscribe to rooms if they aren't logged in, banned, or not a member (if rooms private).
+				// Rooms hidden because their authors account is deleted can't be subscribed to either.
 				if strings.Contains(connData.Name, "room=") {
 					if connData.Uid == primitive.NilObjectID {
 						allow = false
@@ -389,15 +478,12 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 						allow = false
 					} else {
 						var room models.Room
-						if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+						var roomPrivateData models.RoomPrivateData
+						if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId, "hidden": bson.M{"$ne": true}}).Decode(&room); err != nil {
+							allow = false
+						} else if err := colls.RoomPrivateDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
 							allow = false
-							return
 						} else {
-							var roomPrivateData models.RoomPrivateData
-							if err := colls.RoomPrivateDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&roomPrivateData); err != nil {
-								allow = false
-								return
-							}
 							for _, oi := range roomPrivateData.Banned {
 								if oi == connData.Uid {
 									allow = false
@@ -408,13 +494,12 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 								isMember := false
 								for _, oi := range roomPrivateData.Members {
 									if oi == connData.Uid {
-										allow = true
+										isMember = true
 										break
 									}
 								}
 								if connData.Uid != room.Author && !isMember {
 									allow = false
-									return
 								}
 							}
 						}
@@ -455,6 +540,22 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 						}
 					}
 				}
+				// Make sure users cannot subscribe to group conversations they aren't a participant in
+				if strings.Contains(connData.Name, "group=") {
+					if connData.Uid == primitive.NilObjectID {
+						allow = false
+					} else {
+						id, err := primitive.ObjectIDFromHex(strings.ReplaceAll(connData.Name, "group=", ""))
+						if err != nil {
+							allow = false
+						} else {
+							count, err := colls.GroupConversationCollection.CountDocuments(context.Background(), bson.M{"_id": id, "participants": connData.Uid})
+							if err != nil || count == 0 {
+								allow = false
+							}
+						}
+					}
+				}
 				// Make sure users cannot open too many subscriptions
 				socketServer.ConnectionSubscriptionCount.mutex.Lock()
 				socketServer.Subscriptions.mutex.Lock()
@@ -482,12 +583,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Subscription disconnect registration ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in subscription disconnect registration :", r)
-				}
-			}()
+			defer log.Recover("subscription disconnect registration")
 			connData := <-socketServer.UnregisterSubscriptionConn
 			var err error
 			if connData.Conn == nil {
@@ -513,12 +609,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Send data to subscription ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in subscription data channel :", r)
-				}
-			}()
+			defer log.Recover("subscription data channel")
 			subsData := <-socketServer.SendDataToSubscription
 			socketServer.Subscriptions.mutex.Lock()
 			for k, s := range socketServer.Subscriptions.data {
@@ -538,12 +629,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Send data to subscription excluding uids ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in exclusive subscription data channel :", r)
-				}
-			}()
+			defer log.Recover("exclusive subscription data channel")
 			subsData := <-socketServer.SendDataToSubscriptionExclusive
 			socketServer.Subscriptions.mutex.Lock()
 			for k, s := range socketServer.Subscriptions.data {
@@ -562,15 +648,29 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 			socketServer.Subscriptions.mutex.Unlock()
 		}
 	}()
-	/* ----- Send data to multiple subscriptions ----- */
+	/* ----- Send data to subscription only including uids ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in subscription data channel :", r)
+			defer log.Recover("inclusive subscription data channel")
+			subsData := <-socketServer.SendDataToSubscriptionInclusive
+			socketServer.Subscriptions.mutex.Lock()
+			if s, ok := socketServer.Subscriptions.data[subsData.Name]; ok {
+				for conn, oid := range s {
+					if subsData.Include[oid] {
+						socketServer.MessageSendQueue <- QueuedMessage{
+							Conn: conn,
+							Data: subsData.Data,
+						}
+					}
 				}
-			}()
+			}
+			socketServer.Subscriptions.mutex.Unlock()
+		}
+	}()
+	/* ----- Send data to multiple subscriptions ----- */
+	go func() {
+		for {
+			defer log.Recover("subscription data channel")
 			subsData := <-socketServer.SendDataToSubscriptions
 			socketServer.Subscriptions.mutex.Lock()
 			for _, v := range subsData.Names {
@@ -592,12 +692,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Send data to multiple subscriptions excluding uids ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in exclusive subscription data channel :", r)
-				}
-			}()
+			defer log.Recover("exclusive subscription data channel")
 			subsData := <-socketServer.SendDataToSubscriptionsExclusive
 			socketServer.Subscriptions.mutex.Lock()
 			for _, v := range subsData.Names {
@@ -621,12 +716,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Send data to a specific user ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in send data to user channel :", r)
-				}
-			}()
+			defer log.Recover("send data to user channel")
 			data := <-socketServer.SendDataToUser
 			socketServer.Connections.mutex.Lock()
 			for conn, uid := range socketServer.Connections.data {
@@ -642,7 +732,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 							Data: outBytes,
 						}
 					} else {
-						log.Println("Error marshaling data to be sent to user :", err)
+						log.Error("Error marshaling data to be sent to user", err, logger.Fields{"uid": data.Uid.Hex()})
 					}
 					break
 				}
@@ -653,38 +743,27 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Remove a user from subscription ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in remove user from subscription channel :", r)
-				}
-			}()
+			defer log.Recover("remove user from subscription channel")
 			data := <-socketServer.RemoveUserFromSubscription
+			// Removes every connection the user has, they can be subscribed from more than one tab
 			socketServer.Subscriptions.mutex.Lock()
-			if subs, ok := socketServer.Subscriptions.data[data.Name]; ok {
-				for c, oi := range subs {
-					if oi == data.Uid {
-						defer func() {
-							socketServer.Subscriptions.mutex.Unlock()
-						}()
-						socketServer.Subscriptions.mutex.Lock()
-						delete(socketServer.Subscriptions.data[data.Name], c)
-						break
+			socketServer.ConnectionSubscriptionCount.mutex.Lock()
+			for c, oi := range socketServer.Subscriptions.data[data.Name] {
+				if oi == data.Uid {
+					delete(socketServer.Subscriptions.data[data.Name], c)
+					if _, ok := socketServer.ConnectionSubscriptionCount.data[c]; ok {
+						socketServer.ConnectionSubscriptionCount.data[c]--
 					}
 				}
 			}
 			socketServer.Subscriptions.mutex.Unlock()
+			socketServer.ConnectionSubscriptionCount.mutex.Unlock()
 		}
 	}()
 	/* ----- Destroy subscription ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in destroy subscription channel :", r)
-				}
-			}()
+			defer log.Recover("destroy subscription channel")
 			subsName := <-socketServer.DestroySubscription
 			socketServer.Subscriptions.mutex.Lock()
 			socketServer.ConnectionSubscriptionCount.mutex.Lock()
@@ -719,12 +798,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Get user has conversations open with other user chan ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in get user has conversations open with other user chan :", r)
-				}
-			}()
+			defer log.Recover("get user has conversations open with other user chan")
 			data := <-socketServer.GetUserConversationsOpenWith
 			socketServer.OpenConversations.mutex.Lock()
 			sendTrue := false
@@ -743,12 +817,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Open conversation with other user chan ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in open conversation with other user chan :", r)
-				}
-			}()
+			defer log.Recover("open conversation with other user chan")
 			data := <-socketServer.UserOpenConversationWith
 			socketServer.OpenConversations.mutex.Lock()
 			if _, ok := socketServer.OpenConversations.data[data.Uid]; ok {
@@ -764,12 +833,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Close conversation with other user chan ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in close conversation with other user chan :", r)
-				}
-			}()
+			defer log.Recover("close conversation with other user chan")
 			data := <-socketServer.UserCloseConversationWith
 			socketServer.OpenConversations.mutex.Lock()
 			if _, ok := socketServer.OpenConversations.data[data.Uid]; ok {
@@ -781,12 +845,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Get UID hexes of other users in a room (vidChat) chan ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in room vidChat get all users chan :", r)
-				}
-			}()
+			defer log.Recover("room vidChat get all users chan")
 			data := <-socketServer.VidChatGetAllUsersInRoom
 			allUsers := []string{}
 			socketServer.Subscriptions.mutex.Lock()
@@ -820,12 +879,7 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 	/* ----- Get UID hex of other user in a conversation (vidChat) chan ----- */
 	go func() {
 		for {
-			defer func() {
-				r := recover()
-				if r != nil {
-					log.Println("Recovered from panic in room vidChat get all users (conversation) chan :", r)
-				}
-			}()
+			defer log.Recover("room vidChat get all users (conversation) chan")
 			data := <-socketServer.VidChatGetOtherUserVidOpen
 			allUsers := []string{}
 			hasOpen := false
@@ -852,10 +906,6 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 
 	/* -------- Cleanup ticker -------- */
 	cleanupTicker := time.NewTicker(20 * time.Minute)
-	quitCleanup := make(chan struct{})
-	defer func() {
-		quitCleanup <- struct{}{}
-	}()
 	go func() {
 		for {
 			select {
@@ -868,10 +918,106 @@ func RunServer(socketServer *SocketServer, colls *db.Collections) {
 					}
 				}
 				socketServer.Subscriptions.mutex.Unlock()
-			case <-quitCleanup:
+			case <-ctx.Done():
 				cleanupTicker.Stop()
 				return
 			}
 		}
 	}()
 }
+
+// The presence state other users see. Invisible users appear offline.
+func VisiblePresence(presence string) string {
+	if presence == "" || presence == models.PresenceInvisible {
+		return models.PresenceOffline
+	}
+	return presence
+}
+
+// The data for a USER change event updating the users presence, last seen is only included for offline users
+func PresenceChangeData(uid primitive.ObjectID, presence string, lastSeen primitive.DateTime) string {
+	data := map[string]interface{}{
+		"ID":       uid.Hex(),
+		"online":   presence != models.PresenceOffline,
+		"presence": presence,
+	}
+	if presence == models.PresenceOffline && lastSeen != 0 {
+		data["last_seen"] = lastSeen
+	}
+	dataBytes, _ := json.Marshal(data)
+	return string(dataBytes)
+}
+
+// Idle is reset when the user comes back online
+func getStoredPresence(colls *db.Collections, uid primitive.ObjectID) string {
+	user := &models.User{}
+	if err := colls.UserCollection.FindOne(context.Background(), bson.M{"_id": uid}, options.FindOne().SetProjection(bson.M{"presence": 1})).Decode(&user); err != nil {
+		return models.PresenceOnline
+	}
+	if user.Presence == models.PresenceDND || user.Presence == models.PresenceInvisible {
+		return user.Presence
+	}
+	return models.PresenceOnline
+}
+
+// Users on the users block list don't get to see the users presence
+func sendPresenceToSubscribers(socketServer *SocketServer, colls *db.Collections, uid primitive.ObjectID, presence string) {
+	blocked, err := helpers.GetBlockedUids(context.Background(), *colls, uid)
+	if err != nil {
+		blocked = make(map[primitive.ObjectID]bool)
+	}
+	lastSeen := primitive.DateTime(0)
+	if presence == models.PresenceOffline {
+		lastSeen = primitive.NewDateTimeFromTime(time.Now())
+	}
+	outBytes, err := json.Marshal(socketmodels.OutChangeMessage{
+		Type:   "CHANGE",
+		Method: "UPDATE",
+		Data:   PresenceChangeData(uid, presence, lastSeen),
+		Entity: "USER",
+	})
+	if err != nil {
+		log.Error("Error marshaling online status", err, logger.Fields{"uid": uid.Hex()})
+		return
+	}
+	socketServer.SendDataToSubscriptionExclusive <- ExclusiveSubscriptionDataMessage{
+		Name:    "user=" + uid.Hex(),
+		Data:    outBytes,
+		Exclude: blocked,
+	}
+}
+
+/*--------------- SHUTDOWN ---------------*/
+
+// Sent in the close frame, clients should reconnect after a short delay
+const shutdownCloseReason = "Server restarting, reconnect"
+
+// Waits for the queued messages to be sent, then closes every connection with a close frame
+// telling the client to reconnect. Returns early if the context is done.
+func (socketServer *SocketServer) Shutdown(ctx context.Context) {
+	for len(socketServer.MessageSendQueue) > 0 && ctx.Err() == nil {
+		select {
+		case <-time.After(time.Millisecond * 50):
+		case <-ctx.Done():
+		}
+	}
+
+	socketServer.Connections.mutex.Lock()
+	conns := make([]*websocket.Conn, 0, len(socketServer.Connections.data))
+	for conn := range socketServer.Connections.data {
+		conns = append(conns, conn)
+	}
+	socketServer.Connections.mutex.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, shutdownCloseReason)
+	for _, conn := range conns {
+		// WriteControl is safe to call alongside the message send queue
+		conn.WriteControl(websocket.CloseMessage, msg, deadline)
+		conn.Close()
+	}
+	log.Info("Closed websocket connections", logger.Fields{"count": len(conns)})
+}
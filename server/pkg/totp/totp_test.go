@@ -0,0 +1,128 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 seed from RFC 6238 Appendix B, "12345678901234567890" base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 Appendix B SHA1 vectors. The RFC lists 8 digit codes, these are the last 6 digits of each.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeAtRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		code, err := CodeAt(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("T=%d: %v", v.unix, err)
+		}
+		if code != v.code {
+			t.Errorf("T=%d: got %v, want %v", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestCodeAtLowercaseSecret(t *testing.T) {
+	code, err := CodeAt(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "287082" {
+		t.Errorf("got %v, want 287082", code)
+	}
+}
+
+func TestCodeAtInvalidSecret(t *testing.T) {
+	if _, err := CodeAt("not base32!", 1); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	tests := []struct {
+		name   string
+		offset int64
+		valid  bool
+	}{
+		{"two steps behind", -2, false},
+		{"one step behind", -1, true},
+		{"current step", 0, true},
+		{"one step ahead", 1, true},
+		{"two steps ahead", 2, false},
+	}
+	for _, test := range tests {
+		code, err := CodeAt(rfcSecret, current+test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(code, rfcSecret, now)
+		if ok != test.valid {
+			t.Errorf("%v: got valid %v, want %v", test.name, ok, test.valid)
+			continue
+		}
+		if ok && step != current+test.offset {
+			t.Errorf("%v: got step %v, want %v", test.name, step, current+test.offset)
+		}
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "abcdef", "94287082"} {
+		if _, ok := Validate(code, rfcSecret, now); ok {
+			t.Errorf("%q was accepted", code)
+		}
+	}
+	if _, ok := Validate(" 287082 ", rfcSecret, now); !ok {
+		t.Error("surrounding whitespace should be ignored")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("two generated secrets were the same")
+	}
+	if _, err := CodeAt(a, 1); err != nil {
+		t.Errorf("generated secret can't be used: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI(rfcSecret, "Issuer", "user name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("unexpected URI %v", uri)
+	}
+	if uri.Path != "/Issuer:user name" {
+		t.Errorf("got label %q", uri.Path)
+	}
+	q := uri.Query()
+	if q.Get("secret") != rfcSecret || q.Get("issuer") != "Issuer" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected parameters %v", q)
+	}
+}
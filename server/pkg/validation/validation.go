@@ -6,7 +6,32 @@ package validation
 
 type Credentials struct {
 	Username string `json:"username" validate:"required,min=2,max=16"`
-	Password string `json:"password" validate:"required,min=2,max=100"`
+	Password string `json:"password" validate:"required,min=2,max=72"`
+	Restore  bool   `json:"restore"` // Restores the account if it was deleted and is still in its grace period
+}
+
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password" validate:"required,max=72"`
+	NewPassword     string `json:"new_password" validate:"required,max=72"`
+}
+
+type TwoFactorCode struct {
+	Code string `json:"code" validate:"required,min=6,max=11"` // A TOTP code or a recovery code
+}
+
+type DisableTwoFactor struct {
+	Password string `json:"password" validate:"required,max=72"`
+	Code     string `json:"code" validate:"required,min=6,max=11"`
+}
+
+type Profile struct {
+	DisplayName string   `json:"display_name" validate:"max=32"`
+	Bio         string   `json:"bio" validate:"max=300"`
+	Links       []string `json:"links" validate:"max=5,dive,url,max=200"`
+}
+
+type Username struct {
+	Username string `json:"username" validate:"required,min=2,max=16"`
 }
 
 type Post struct {
@@ -25,6 +50,28 @@ type Room struct {
 	Private bool   `json:"private"`
 }
 
+type DMPrivacy struct {
+	DMPrivacy string `json:"dm_privacy" validate:"required,oneof=EVERYONE CONTACTS NOBODY"`
+}
+
+type DigestSettings struct {
+	Enabled bool   `json:"enabled"`
+	Address string `json:"address" validate:"omitempty,email,max=254"`
+}
+
+type GroupConversation struct {
+	Name         string   `json:"name" validate:"required,min=2,max=24"`
+	Participants []string `json:"participants" validate:"max=9,dive,len=24"`
+}
+
+type RoomSlowMode struct {
+	Seconds int `json:"seconds" validate:"min=0,max=21600"`
+}
+
+type RoomAnnouncement struct {
+	Announcement string `json:"announcement" validate:"max=300"`
+}
+
 type PostComment struct {
 	Content string `json:"content" validate:"required,min=1,max=200"`
 }